@@ -2,33 +2,110 @@ package authentication
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/ipset"
 )
 
-// IP whitelist handler for the proxdy
+// IP whitelist handler for the proxdy - it is shared between the connection
+// goroutines and the API handlers, so every method is safe for concurrent use
 type ProxyAuthHandler struct {
-	WhitelistFilepath string   // string field of the path to the whitelist file
-	Whitelist         []string // list of IP addresses to represent the whitelist
+	WhitelistFilepath string           // string field of the path to the whitelist file
+	Whitelist         []WhitelistEntry // list of IP addresses and CIDR blocks to represent the whitelist, guarded by mutex
+	set               *ipset.IPSet     // prefix trie of the addresses in the Whitelist, which lookups find the matching entries through
+	index             map[string][]int // the positions of the entries in the Whitelist by their address
+	nextExpiry        time.Time        // no later than the earliest expiry of any entry in the Whitelist, zero if none expire
+	mutex             sync.RWMutex     // guards the Whitelist, set, index and nextExpiry fields
+}
+
+// a single address or CIDR block in the whitelist
+type WhitelistEntry struct {
+	Address string     `json:"address"`           // the IP address or CIDR block this entry allows
+	Expires *time.Time `json:"expires,omitempty"` // when this entry stops being valid, nil means it never expires
+	Added   *time.Time `json:"added,omitempty"`   // when this entry was added, nil for entries from before it was recorded
+	AddedBy string     `json:"addedBy,omitempty"` // who or what added this entry, e.g. "email approval"
+	Reason  string     `json:"reason,omitempty"`  // why this entry was added
+	User    string     `json:"user,omitempty"`    // the registered user this entry was granted to, empty if it was granted to nobody in particular
+	Routes  []string   `json:"routes,omitempty"`  // the names of the routes this entry allows, empty for every route
+	Issuer  string     `json:"issuer,omitempty"`  // the OIDC issuer which named the entry's user, empty if the user is from the user registry
+}
+
+// decodes a whitelist entry from either its object form or a plain
+// string, so whitelist files written before expiry existed still load
+func (e *WhitelistEntry) UnmarshalJSON(data []byte) error {
+	// a plain string is an address that never expires
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*e = WhitelistEntry{Address: address}
+		return nil
+	}
+
+	// an alias type is used so this method is not called recursively
+	type entry WhitelistEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// returns whether or not this entry allows a route
+func (e *WhitelistEntry) AllowsRoute(route string) bool {
+	if len(e.Routes) == 0 {
+		return true
+	}
+	for _, r := range e.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether or not two entries are the same grant - the same address,
+// routes, user and issuer - which are the entries a grant may extend
+func (e *WhitelistEntry) sameGrant(other WhitelistEntry) bool {
+	if e.Address != other.Address || e.User != other.User || e.Issuer != other.Issuer || len(e.Routes) != len(other.Routes) {
+		return false
+	}
+	for _, route := range other.Routes {
+		if !e.AllowsRoute(route) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the later of two expiries, where nil never expires
+func laterExpiry(a *time.Time, b *time.Time) *time.Time {
+	if a == nil || b == nil {
+		return nil
+	}
+	if b.After(*a) {
+		return b
+	}
+	return a
+}
+
+// returns whether or not this entry has expired at a certain time
+func (e *WhitelistEntry) Expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
 }
 
 // constructor for proxy auth handler - loads the file
 // and decodes the existing whitelist as JSON and loads into array field
-func NewProxyAuthHandler(filepath string) (ProxyAuthHandler, error) {
-	// ProxyAuthHandler variable
-	var handler ProxyAuthHandler
-
+func NewProxyAuthHandler(filepath string) (*ProxyAuthHandler, error) {
 	// checks if file is present, if not:
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
 		// creates the file
 		file, err := os.Create(filepath)
 		// error handling
 		if err != nil {
-			return handler, fmt.Errorf("line 21: %s", err)
+			return nil, fmt.Errorf("line 21: %s", err)
 		}
 		// attempts to write an empty JSON list and handles any errors
 		if _, err := file.Write([]byte("[]")); err != nil {
-			return handler, fmt.Errorf("line 24: %s", err)
+			return nil, fmt.Errorf("line 24: %s", err)
 		}
 		// closes the file as we are now done with it
 		file.Close()
@@ -36,24 +113,44 @@ func NewProxyAuthHandler(filepath string) (ProxyAuthHandler, error) {
 	// opens the file and handles errors
 	file, err := os.Open(filepath)
 	if err != nil {
-		return handler, fmt.Errorf("line 29: %s", err)
+		return nil, fmt.Errorf("line 29: %s", err)
 	}
 
 	// defers closing the file until after function ends
 	defer file.Close()
 
 	// local variable for whitelist to be loaded
-	var whitelist []string
+	var whitelist []WhitelistEntry
 
 	// decode the JSON of the file into the whitelist ptr and handles errors
 	if err := json.NewDecoder(file).Decode(&whitelist); err != nil {
-		return handler, fmt.Errorf("line 36: %s", err)
+		return nil, fmt.Errorf("line 36: %s", err)
 	}
 
-	// instantiates the proxy auth handler struct
-	handler = ProxyAuthHandler{
+	// instantiates the proxy auth handler struct with an empty
+	// prefix trie used for matching addresses against the whitelist
+	handler := &ProxyAuthHandler{
 		WhitelistFilepath: filepath,
-		Whitelist:         whitelist,
+		Whitelist:         make([]WhitelistEntry, 0, len(whitelist)),
+	}
+	handler.rebuild()
+
+	// normalizes every entry so that lookups and removals by entry are
+	// consistent, and handles invalid entries - entries which are the same
+	// grant once normalized, such as for "10.0.0.1" and "10.0.0.1/32", are
+	// merged into the first of them with the later expiry
+	for i, entry := range whitelist {
+		canonical, err := ipset.Canonical(entry.Address)
+		if err != nil {
+			return nil, fmt.Errorf("whitelist entry %d: %s", i, err)
+		}
+		entry.Address = canonical
+		if j := handler.find(entry); j > -1 {
+			handler.Whitelist[j].Expires = laterExpiry(handler.Whitelist[j].Expires, entry.Expires)
+			continue
+		}
+		handler.Whitelist = append(handler.Whitelist, entry)
+		handler.insert(len(handler.Whitelist) - 1)
 	}
 
 	// returns handler and no error to represent successful load
@@ -62,83 +159,327 @@ func NewProxyAuthHandler(filepath string) (ProxyAuthHandler, error) {
 
 // function to save the contents of the Whitelist array to the file
 func (p *ProxyAuthHandler) Save() error {
-	// pointer to the whitelist file
-	var file *os.File
-
-	// if whitelist file does not exist
-	if _, err := os.Stat(p.WhitelistFilepath); os.IsNotExist(err) {
-		// create the file and assign it to our 'file' variable
-		file, err = os.Create(p.WhitelistFilepath)
-		// if an error is returned, return the error
-		if err != nil {
-			return err
-		}
-	} else {
-		// if the file does exist, open it and assign the opened file to our 'file' var
-		file, err = os.OpenFile(p.WhitelistFilepath, os.O_WRONLY, 0644)
-		// if an error is returned, return the error
-		if err != nil {
-			return err
-		}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.save()
+}
+
+// saves the whitelist to the file, the caller must hold the mutex - the
+// whitelist is written to a temporary file which then replaces the real one,
+// so the file is never left half written if the process is stopped mid-save
+func (p *ProxyAuthHandler) save() error {
+	temporary := p.WhitelistFilepath + ".tmp"
+
+	// creates the temporary file, truncating any left over from an earlier failed save
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
 	}
 
-	// defers closing the file until after the function ends
-	defer file.Close()
+	// creates a new json encoder and encodes the Whitelist as a reference,
+	// then flushes it to disk before closing the file
+	if err := json.NewEncoder(file).Encode(&p.Whitelist); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	// creates a new json encoder, encodes the Whitelist as a reference and returns the encoded string
-	return json.NewEncoder(file).Encode(&p.Whitelist)
+	// swaps the temporary file into place in one step
+	return os.Rename(temporary, p.WhitelistFilepath)
 }
 
+// returned when adding an entry which is already in the whitelist
+var ErrAlreadyWhitelisted = errors.New("IP address already exists in the whitelist")
+
+// returned when removing an entry which is not in the whitelist
+var ErrNotWhitelisted = errors.New("IP address is not whitelisted")
+
 /**
 **  Functions to add and remove IP addresses
-**  from the whitelist.
+**  and CIDR blocks from the whitelist.
 **/
 func (p *ProxyAuthHandler) AddWhitelistIP(ip string) error {
+	_, err := p.AddWhitelistEntry(WhitelistEntry{Address: ip})
+	return err
+}
+
+// adds an entry along with its metadata to the whitelist, recording when it
+// was added if the entry does not say, and returns the entry as it was added
+func (p *ProxyAuthHandler) AddWhitelistEntry(entry WhitelistEntry) (WhitelistEntry, error) {
+	// parses the address or CIDR block into its canonical form
+	// and returns an error if it is invalid
+	address, err := ipset.Canonical(entry.Address)
+	if err != nil {
+		return WhitelistEntry{}, err
+	}
+	entry.Address = address
+	if entry.Added == nil {
+		now := time.Now()
+		entry.Added = &now
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	// precondition check to ensure that the IP does not
-	// already exist in this list.
-	if p.GetWhitelistIPIndex(ip) > -1 {
-		return fmt.Errorf("IP address already exists in the whitelist")
+	// already exist in this list, whatever it was granted for
+	if p.indexOf(address) > -1 {
+		return WhitelistEntry{}, ErrAlreadyWhitelisted
 	}
 
-	// appends to the whitelist
-	p.Whitelist = append(p.Whitelist, ip)
+	// appends to the whitelist and the lookup trie
+	p.Whitelist = append(p.Whitelist, entry)
+	p.insert(len(p.Whitelist) - 1)
 
 	// saves the contents of whitelist to file
 	// and returns the error if any
-	return p.Save()
+	return entry, p.save()
 }
 
 func (p *ProxyAuthHandler) RemoveWhitelistIP(ip string) error {
-	// gets the index of this IP and returns error if not exists
-	index := p.GetWhitelistIPIndex(ip)
-	if index == -1 {
-		return fmt.Errorf("IP address is not whitelisted")
+	// uses the canonical form of the entry if it can be parsed
+	if entry, err := ipset.Canonical(ip); err == nil {
+		ip = entry
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// returns error if this IP does not exist, otherwise removes
+	// every entry granted to it whichever routes they were for
+	if p.indexOf(ip) == -1 {
+		return ErrNotWhitelisted
 	}
-	// swaps the elements of this IP and last and then changes length of list
+	for p.indexOf(ip) > -1 {
+		p.removeAt(p.indexOf(ip))
+	}
+
+	// saves the content of the modified whitelist to the file
+	return p.save()
+}
+
+// removes the entry at a position in the Whitelist, the caller must hold the
+// mutex - it swaps the elements of the entry and last and then changes length
+// of list, moving the last entry's position in the index along with it
+func (p *ProxyAuthHandler) removeAt(i int) {
+	address := p.Whitelist[i].Address
 	last := len(p.Whitelist) - 1
-	p.Whitelist[index], p.Whitelist[last] = p.Whitelist[last], p.Whitelist[index]
+	p.Whitelist[i] = p.Whitelist[last]
 	p.Whitelist = p.Whitelist[:last]
 
-	// saves the content of the modified whitelist to the file
-	return p.Save()
+	positions := p.index[address]
+	for k, position := range positions {
+		if position == i {
+			positions = append(positions[:k], positions[k+1:]...)
+			break
+		}
+	}
+	if len(positions) == 0 {
+		p.set.Remove(address)
+		delete(p.index, address)
+	} else {
+		p.index[address] = positions
+	}
+
+	if i < last {
+		moved := p.index[p.Whitelist[i].Address]
+		for k, position := range moved {
+			if position == last {
+				moved[k] = i
+			}
+		}
+	}
+}
+
+// function to whitelist an IP address or CIDR block for a limited time,
+// a ttl of 0 grants access with no expiry - if the entry already exists
+// its expiry is extended rather than returning an error
+func (p *ProxyAuthHandler) GrantWhitelistIP(ip string, ttl time.Duration) error {
+	return p.GrantWhitelistEntry(WhitelistEntry{Address: ip}, ttl)
+}
+
+// grants an entry along with its metadata for a limited time in the same way
+// as GrantWhitelistIP - only an entry which is the same grant, for the same
+// routes, user and issuer, is extended, a grant for anything else is added as
+// an entry of its own so that no grant widens or lengthens another
+func (p *ProxyAuthHandler) GrantWhitelistEntry(grant WhitelistEntry, ttl time.Duration) error {
+	// parses the address or CIDR block into its canonical form
+	entry, err := ipset.Canonical(grant.Address)
+	if err != nil {
+		return err
+	}
+
+	// calculates the expiry of the grant, nil represents no expiry
+	now := time.Now()
+	var expires *time.Time
+	if ttl > 0 {
+		t := now.Add(ttl)
+		expires = &t
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	grant.Address = entry
+	if index := p.find(grant); index > -1 {
+		// the grant already exists, so only extend its expiry - a permanent
+		// entry stays permanent and a later expiry is never shortened
+		existing := &p.Whitelist[index]
+		if existing.Expires == nil || (expires != nil && !expires.After(*existing.Expires)) {
+			return nil
+		}
+		existing.Expires = expires
+	} else {
+		grant.Expires = expires
+		if grant.Added == nil {
+			grant.Added = &now
+		}
+		p.Whitelist = append(p.Whitelist, grant)
+		p.insert(len(p.Whitelist) - 1)
+	}
+
+	return p.save()
+}
+
+// function to remove every expired entry from the whitelist and save
+// the file, returning the entries that were evicted
+func (p *ProxyAuthHandler) EvictExpired() ([]WhitelistEntry, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+
+	// nothing has expired yet so there is nothing to do
+	if p.nextExpiry.IsZero() || now.Before(p.nextExpiry) {
+		return nil, nil
+	}
+
+	// removes the expired entries from the end of the whitelist backwards,
+	// so the entry moved into the place of each has already been checked,
+	// and then works out the earliest expiry of the entries that are left
+	var evicted []WhitelistEntry
+	for i := len(p.Whitelist) - 1; i >= 0; i-- {
+		if p.Whitelist[i].Expired(now) {
+			evicted = append(evicted, p.Whitelist[i])
+			p.removeAt(i)
+		}
+	}
+	p.nextExpiry = time.Time{}
+	for _, entry := range p.Whitelist {
+		p.noteExpiry(entry)
+	}
+	if len(evicted) == 0 {
+		// the entry which would have expired first was extended or removed
+		return nil, nil
+	}
+
+	return evicted, p.save()
 }
 
 // Function to find the index of an existing
-// IP address if one exists, or returns -1
+// whitelist entry if one exists, or returns -1
 // to represent no indexes found
 func (p *ProxyAuthHandler) GetWhitelistIPIndex(ip string) int {
-	// loop through every element in the list
-	for i, v := range p.Whitelist {
-		// if the element we are at is equal to the IP, return index
-		if v == ip {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.indexOf(ip)
+}
+
+// finds the index of the first entry for an address, the caller must hold the mutex
+func (p *ProxyAuthHandler) indexOf(ip string) int {
+	// looks the entry up in the index, returning -1 to represent no indexes found
+	if positions := p.index[ip]; len(positions) > 0 {
+		return positions[0]
+	}
+	return -1
+}
+
+// finds the index of the entry which is the same grant as another,
+// or returns -1 if there is none - the caller must hold the mutex
+func (p *ProxyAuthHandler) find(grant WhitelistEntry) int {
+	for _, i := range p.index[grant.Address] {
+		if p.Whitelist[i].sameGrant(grant) {
 			return i
 		}
 	}
-
-	// return -1 to represent no indexes found
 	return -1
 }
 
+// returns whether or not an IP address is matched by any address
+// or CIDR block in the whitelist
 func (p *ProxyAuthHandler) IsWhitelisted(ip string) bool {
-	return p.GetWhitelistIPIndex(ip) > -1
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.matching(ip)) > 0
+}
+
+// returns the unexpired entries whose address or CIDR block matches an IP address
+func (p *ProxyAuthHandler) Matching(ip string) []WhitelistEntry {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.matching(ip)
+}
+
+// finds the matching entries through the trie, which holds the address of
+// every entry, so only the entries an IP address falls within are looked at -
+// expired entries are skipped as they may not have been evicted yet, and the
+// caller must hold the mutex
+func (p *ProxyAuthHandler) matching(ip string) []WhitelistEntry {
+	var matching []WhitelistEntry
+	now := time.Now()
+	for _, address := range p.set.Matching(ip) {
+		for _, i := range p.index[address] {
+			if entry := p.Whitelist[i]; !entry.Expired(now) {
+				matching = append(matching, entry)
+			}
+		}
+	}
+	return matching
+}
+
+// returns a copy of the whitelist that is safe to read
+// while the whitelist is being modified
+func (p *ProxyAuthHandler) Entries() []WhitelistEntry {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	entries := make([]WhitelistEntry, len(p.Whitelist))
+	copy(entries, p.Whitelist)
+	return entries
+}
+
+// rebuilds the lookup trie, the index and the earliest expiry from the
+// Whitelist field, the caller must hold the mutex - this is only needed once
+// the whole whitelist has changed, single entries are added with insert
+func (p *ProxyAuthHandler) rebuild() {
+	p.set, _ = ipset.NewIPSet()
+	p.index = make(map[string][]int, len(p.Whitelist))
+	p.nextExpiry = time.Time{}
+	for i := range p.Whitelist {
+		p.insert(i)
+	}
+}
+
+// adds the entry at a position in the Whitelist to the lookup trie, the index
+// and the earliest expiry, the caller must hold the mutex - removing or
+// extending an entry leaves the earliest expiry as it is, which only costs
+// an eviction that finds nothing to evict
+func (p *ProxyAuthHandler) insert(i int) {
+	entry := p.Whitelist[i]
+	_ = p.set.Add(entry.Address)
+	p.index[entry.Address] = append(p.index[entry.Address], i)
+	p.noteExpiry(entry)
+}
+
+// brings the earliest expiry forward to the expiry of an entry
+// if it is earlier, the caller must hold the mutex
+func (p *ProxyAuthHandler) noteExpiry(entry WhitelistEntry) {
+	if entry.Expires != nil && (p.nextExpiry.IsZero() || entry.Expires.Before(p.nextExpiry)) {
+		p.nextExpiry = *entry.Expires
+	}
 }
@@ -0,0 +1,248 @@
+package authentication
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLegacyWhitelistFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist.json")
+	if err := ioutil.WriteFile(path, []byte(`["127.0.0.1", "10.0.0.0/8"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewProxyAuthHandler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handler.IsWhitelisted("127.0.0.1") || !handler.IsWhitelisted("10.20.30.40") {
+		t.Error("legacy string entries should be loaded as permanent entries")
+	}
+}
+
+func TestDuplicateEntriesMerged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	data := `[
+		{"address": "10.0.0.1", "expires": "2000-01-01T00:00:00Z", "reason": "first"},
+		{"address": "10.0.0.1/32", "expires": "2100-01-01T00:00:00Z", "reason": "second"}
+	]`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewProxyAuthHandler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both are the same address once normalized, so they are loaded as one with the later expiry
+	if len(handler.Whitelist) != 1 || handler.Whitelist[0].Reason != "first" || handler.Whitelist[0].Expires.Year() != 2100 {
+		t.Fatalf("expected the entries to be merged, got %+v", handler.Whitelist)
+	}
+	if !handler.IsWhitelisted("10.0.0.1") {
+		t.Error("expected the merged entry to be whitelisted")
+	}
+
+	// removing the address leaves nothing behind in the whitelist or the trie
+	if err := handler.RemoveWhitelistIP("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.Whitelist) != 0 || handler.IsWhitelisted("10.0.0.1") || handler.GetWhitelistIPIndex("10.0.0.1") != -1 {
+		t.Errorf("expected the address to be removed, got %+v", handler.Whitelist)
+	}
+}
+
+func TestWhitelistGrantExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	handler, err := NewProxyAuthHandler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.GrantWhitelistIP("192.0.2.1", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.GrantWhitelistIP("192.0.2.2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	// the expired grant must stop matching even before it is evicted
+	if handler.IsWhitelisted("192.0.2.1") {
+		t.Error("expired grant should no longer be whitelisted")
+	}
+
+	evicted, err := handler.EvictExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 || evicted[0].Address != "192.0.2.1" {
+		t.Errorf("expected 192.0.2.1 to be evicted, got %+v", evicted)
+	}
+	if !handler.IsWhitelisted("192.0.2.2") {
+		t.Error("permanent grant should still be whitelisted")
+	}
+
+	// the eviction must also be persisted to the whitelist file
+	reloaded, err := NewProxyAuthHandler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Whitelist) != 1 || reloaded.Whitelist[0].Address != "192.0.2.2" {
+		t.Errorf("unexpected whitelist after reload: %+v", reloaded.Whitelist)
+	}
+}
+
+func TestGrantDoesNotShortenExpiry(t *testing.T) {
+	handler, err := NewProxyAuthHandler(filepath.Join(t.TempDir(), "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.GrantWhitelistIP("2001:db8::1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.GrantWhitelistIP("2001:db8::1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Whitelist[0].Expires != nil {
+		t.Error("a permanent entry should stay permanent")
+	}
+}
+
+// returns the expiry of the grant for a route on an address, failing if there is not exactly one
+func grantExpiry(t *testing.T, handler *ProxyAuthHandler, ip string, route string) *time.Time {
+	var found []WhitelistEntry
+	for _, entry := range handler.Matching(ip) {
+		if entry.AllowsRoute(route) {
+			found = append(found, entry)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected one grant for %s, got %+v", route, found)
+	}
+	return found[0].Expires
+}
+
+func TestGrantsKeptPerRoute(t *testing.T) {
+	handler, err := NewProxyAuthHandler(filepath.Join(t.TempDir(), "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := func(entry WhitelistEntry, ttl time.Duration) {
+		entry.Address = "192.0.2.1"
+		if err := handler.GrantWhitelistEntry(entry, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a short grant on ssh does not take the expiry of a permanent grant on rdp
+	grant(WhitelistEntry{Routes: []string{"rdp"}}, 0)
+	grant(WhitelistEntry{User: "alice", Routes: []string{"ssh"}}, time.Hour)
+	if grantExpiry(t, handler, "192.0.2.1", "rdp") != nil {
+		t.Error("expected the rdp grant to stay permanent")
+	}
+	if expires := grantExpiry(t, handler, "192.0.2.1", "ssh"); expires == nil || time.Until(*expires) > time.Hour {
+		t.Errorf("expected the ssh grant to expire within the hour, got %v", expires)
+	}
+	if entries := handler.Entries(); len(entries) != 2 {
+		t.Errorf("expected a grant for each route, got %+v", entries)
+	}
+
+	// the same grant again only extends its expiry
+	grant(WhitelistEntry{User: "alice", Routes: []string{"ssh"}}, 2*time.Hour)
+	if expires := grantExpiry(t, handler, "192.0.2.1", "ssh"); expires == nil || time.Until(*expires) < time.Hour {
+		t.Errorf("expected the ssh grant to be extended, got %v", expires)
+	}
+	if entries := handler.Entries(); len(entries) != 2 {
+		t.Errorf("expected the ssh grant to be extended in place, got %+v", entries)
+	}
+
+	// a grant expiring on the address is evicted without the others
+	grant(WhitelistEntry{Routes: []string{"web"}}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if evicted, err := handler.EvictExpired(); err != nil || len(evicted) != 1 || !evicted[0].AllowsRoute("web") {
+		t.Errorf("expected the web grant to be evicted, got %+v %v", evicted, err)
+	}
+	grantExpiry(t, handler, "192.0.2.1", "rdp")
+	grantExpiry(t, handler, "192.0.2.1", "ssh")
+}
+
+func TestGrantDoesNotExtendQuorumRoute(t *testing.T) {
+	handler, err := NewProxyAuthHandler(filepath.Join(t.TempDir(), "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// administrators approve rdp briefly, then the user signs in for ssh for longer
+	approval := WhitelistEntry{Address: "192.0.2.1", AddedBy: "approved by alice, bob", Routes: []string{"rdp"}}
+	if err := handler.GrantWhitelistEntry(approval, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	signIn := WhitelistEntry{Address: "192.0.2.1", User: "carol", Issuer: "https://login.example.com", Routes: []string{"ssh"}}
+	if err := handler.GrantWhitelistEntry(signIn, 12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if expires := grantExpiry(t, handler, "192.0.2.1", "rdp"); expires == nil || time.Until(*expires) > 10*time.Minute {
+		t.Errorf("expected the rdp approval to keep its expiry, got %v", expires)
+	}
+	if expires := grantExpiry(t, handler, "192.0.2.1", "ssh"); expires == nil || time.Until(*expires) < 11*time.Hour {
+		t.Errorf("expected the ssh sign-in to keep its own expiry, got %v", expires)
+	}
+
+	// revoking the address removes both grants
+	if err := handler.RemoveWhitelistIP("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.Entries()) != 0 || handler.IsWhitelisted("192.0.2.1") {
+		t.Errorf("expected every grant to be revoked, got %+v", handler.Entries())
+	}
+}
+
+func TestMatchingAfterRemoval(t *testing.T) {
+	handler, err := NewProxyAuthHandler(filepath.Join(t.TempDir(), "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []WhitelistEntry{
+		{Address: "10.0.0.0/8", Reason: "office"},
+		{Address: "10.1.2.3", Reason: "laptop"},
+		{Address: "192.0.2.1", Reason: "home"},
+	} {
+		if _, err := handler.AddWhitelistEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every entry an address falls within is found, from the widest to the narrowest
+	if matching := handler.Matching("10.1.2.3"); len(matching) != 2 || matching[0].Reason != "office" || matching[1].Reason != "laptop" {
+		t.Errorf("unexpected matching entries %+v", matching)
+	}
+
+	// removing an entry moves the last one into its place, which must still be found
+	if err := handler.RemoveWhitelistIP("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if matching := handler.Matching("192.0.2.1"); len(matching) != 1 || matching[0].Reason != "home" {
+		t.Errorf("unexpected matching entries after removal %+v", matching)
+	}
+	if matching := handler.Matching("10.1.2.3"); len(matching) != 1 || matching[0].Reason != "laptop" {
+		t.Errorf("unexpected matching entries after removal %+v", matching)
+	}
+	if handler.IsWhitelisted("10.9.9.9") {
+		t.Error("expected the removed block not to match")
+	}
+	for _, ip := range []string{"10.1.2.3", "192.0.2.1"} {
+		if err := handler.RemoveWhitelistIP(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if handler.IsWhitelisted("192.0.2.1") || handler.GetWhitelistIPIndex("10.1.2.3") != -1 {
+		t.Error("expected an empty whitelist to match nothing")
+	}
+}
@@ -0,0 +1,74 @@
+package authentication
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// returns the IP address of the client which made a request - a request from
+// one of the TrustedProxies is followed back through its X-Forwarded-For or
+// Forwarded header to the first address which is not a trusted proxy, while
+// any other request is from the address it came from so that the headers
+// cannot be used to pretend to be someone else
+func (mfa *MultiFactorAuth) ClientIP(r *http.Request) string {
+	client := hostOf(r.RemoteAddr)
+	if mfa.TrustedProxies == nil || !mfa.TrustedProxies.Contains(client) {
+		return client
+	}
+
+	// the addresses are appended by each proxy in turn, so they are walked
+	// from the nearest proxy back towards the client - an address which cannot
+	// be parsed stops the walk, as everything before it is untrustworthy
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hostOf(hops[i]))
+		if hop == nil {
+			break
+		}
+		client = hop.String()
+		if !mfa.TrustedProxies.Contains(client) {
+			break
+		}
+	}
+	return client
+}
+
+// returns the addresses a request was forwarded for, from the client to the
+// nearest proxy - the standard Forwarded header is preferred over X-Forwarded-For
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		// e.g. Forwarded: for=203.0.113.7;proto=https, for="[2001:db8::1]:4711"
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				hop := ""
+				for _, pair := range strings.Split(element, ";") {
+					name := strings.TrimSpace(pair)
+					if len(name) > 4 && strings.EqualFold(name[:4], "for=") {
+						hop = strings.Trim(name[4:], `"`)
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	// e.g. X-Forwarded-For: 203.0.113.7, 10.0.0.2
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// returns the host of an address which may or may not have a port,
+// e.g. 203.0.113.7:4711 -> 203.0.113.7 and [2001:db8::1] -> 2001:db8::1
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+}
@@ -0,0 +1,70 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saifsuleman/gatekeeper/ipset"
+)
+
+func TestClientIP(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.TrustedProxies, _ = ipset.NewIPSet("127.0.0.1", "10.0.0.0/8")
+
+	cases := []struct {
+		remoteAddr string
+		header     string
+		value      string
+		expected   string
+	}{
+		// requests from anywhere but a trusted proxy cannot forward
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "X-Forwarded-For", "203.0.113.7", "192.0.2.1"},
+		// a trusted proxy's header is followed past other trusted proxies
+		{"127.0.0.1:1234", "X-Forwarded-For", "203.0.113.7", "203.0.113.7"},
+		{"127.0.0.1:1234", "X-Forwarded-For", "203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"127.0.0.1:1234", "X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"127.0.0.1:1234", "Forwarded", `for=203.0.113.7;proto=https, for="10.0.0.2:4711"`, "203.0.113.7"},
+		{"127.0.0.1:1234", "Forwarded", `For="[2001:db8::7]:4711"`, "2001:db8::7"},
+		// garbage stops the walk at the proxy which passed it on
+		{"127.0.0.1:1234", "X-Forwarded-For", "not-an-ip, 10.0.0.2", "10.0.0.2"},
+		{"127.0.0.1:1234", "Forwarded", "for=unknown", "127.0.0.1"},
+		{"127.0.0.1:1234", "", "", "127.0.0.1"},
+	}
+	for _, c := range cases {
+		request := apiRequest(c.remoteAddr, "")
+		if c.header != "" {
+			request.Header.Set(c.header, c.value)
+		}
+		if ip := mfa.ClientIP(request); ip != c.expected {
+			t.Errorf("%s %s: %q: expected %s, got %s", c.remoteAddr, c.header, c.value, c.expected, ip)
+		}
+	}
+}
+
+func TestForwardedClientNeedsApiAccess(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.ApiWhitelist = []string{"127.0.0.1"}
+	handler := mfa.wrapApiFunc("/api/log", ScopeReadLog, mfa.ViewLog)
+
+	// without trusted proxies the reverse proxy's address is checked
+	request := apiRequest("127.0.0.1:1234", "")
+	request.Header.Set("X-Forwarded-For", "203.0.113.7")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected 200 without trusted proxies, got %d", recorder.Code)
+	}
+
+	// once the reverse proxy is trusted the client it forwards for is checked
+	mfa.TrustedProxies, _ = ipset.NewIPSet("127.0.0.1")
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a forwarded client, got %d", recorder.Code)
+	}
+	if caller := mfa.ApiCaller(request); caller != "api (203.0.113.7)" {
+		t.Errorf("expected the forwarded client to be the caller, got %s", caller)
+	}
+}
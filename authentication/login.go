@@ -0,0 +1,100 @@
+package authentication
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the login page, a single form which posts back to itself - a code
+// self-authorizes the IP address while a name alone claims its pending
+// connection attempts so administrators know who they are approving
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Gatekeeper</title></head>
+<body>
+<h1>Sign in from {{.IP}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="post">
+<p><label>Name <input name="name" value="{{.Name}}" autocomplete="username" required></label></p>
+{{if .TOTP}}<p><label>Authenticator code <input name="code" inputmode="numeric" pattern="[0-9]{6}" autocomplete="one-time-code"></label>
+<br>Leave the code empty to ask an administrator to approve your connection instead.</p>{{end}}
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// handler function for our /api/login route - a GET shows the form and a
+// POST either self-authorizes the IP address of the request with a TOTP
+// code or ties its pending connection attempts to the user
+func (mfa *MultiFactorAuth) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	ip := mfa.ClientIP(r)
+	data := struct {
+		IP, Name, Message string
+		TOTP              bool
+	}{IP: ip, TOTP: mfa.TOTP}
+
+	// the content type is set first, as a POST writes its status before the page
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		data.Name = strings.TrimSpace(r.FormValue("name"))
+		code := strings.TrimSpace(r.FormValue("code"))
+		var status int
+		if code != "" && mfa.TOTP {
+			status, data.Message = mfa.authorizeTOTP(ip, data.Name, code)
+		} else {
+			status, data.Message = mfa.claimAttempts(ip, data.Name)
+		}
+		w.WriteHeader(status)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	_ = loginPage.Execute(w, data)
+}
+
+// ties the pending connection attempts of an IP address to a user who may
+// use their routes and be approved by email, then alerts the administrators
+// again so they know who they are approving - the claim is not proof of
+// who is at the IP address, so the alerts say so
+func (mfa *MultiFactorAuth) claimAttempts(ip string, name string) (int, string) {
+	user, registered := mfa.Users.Get(name)
+	if !registered || !user.AllowsMFA(MFAEmail) {
+		log.Printf("Claim of %s's connection attempts as %q refused - unknown user\n", ip, name)
+		return http.StatusNotFound, "There is no connection attempt from your IP address for you to claim."
+	}
+
+	mfa.mutex.Lock()
+	claimed := map[string]AuthRequest{}
+	now := time.Now()
+	for code, request := range mfa.AuthCodes {
+		if request.IP != ip || request.User != "" || mfa.isCodeExpired(request, now) || !user.AllowsRoute(request.Route) {
+			continue
+		}
+		request.User = user.Name
+		request.IdentifiedBy = IdentifiedByUsername
+		mfa.AuthCodes[code] = request
+		if access, found := mfa.accessRequests[request.AccessID]; found {
+			access.User = user.Name
+		}
+		claimed[code] = request
+	}
+	mfa.mutex.Unlock()
+
+	if len(claimed) == 0 {
+		log.Printf("Claim of %s's connection attempts as %s refused - no pending attempts\n", ip, name)
+		return http.StatusNotFound, "There is no connection attempt from your IP address for you to claim."
+	}
+	for code, request := range claimed {
+		log.Printf("[%s] Connection attempt from %s claimed by %s\n", request.Route, ip, name)
+		go mfa.sendAlert(request, code)
+	}
+	return http.StatusOK, "An administrator has been asked to approve your connection."
+}
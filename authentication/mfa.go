@@ -1,57 +1,132 @@
 package authentication
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/saifsuleman/gatekeeper/certs"
+	"github.com/saifsuleman/gatekeeper/ipset"
 	"github.com/saifsuleman/gatekeeper/logger"
-	gomail "gopkg.in/mail.v2"
+	"github.com/saifsuleman/gatekeeper/oidc"
 )
 
-// multi-factor authentication
+// multi-factor authentication - it is shared between the connection goroutines,
+// the alert goroutines and the API handlers, so its maps are guarded by a mutex
 type MultiFactorAuth struct {
-	ProxyAuthHandler ProxyAuthHandler  // instance of ProxyAuthHandler (Whitelist file storage handler)
-	Emails           []string          // list of administrator email addresses
-	AuthCodes        map[string]string // a map of authentication codes to the IP addresses they should whitelist
-	DefaultApiUrl    string            // the API URL to encode in the links sent to the email
-	ApiWhitelist     []string          // an IP address whitelist of the authenticated IP allowed to use administrator functions of the API
-	Router           *mux.Router       // a reference to our HTTP router handler
-	Logger           logger.Logger     // an instance of our custom logger
+	ProxyAuthHandler  *ProxyAuthHandler         // instance of ProxyAuthHandler (Whitelist file storage handler)
+	AuthCodes         map[string]AuthRequest    // a map of authentication codes to the requests they should approve, guarded by mutex
+	DefaultApiUrl     string                    // the API URL to encode in the links sent to the email
+	ApiWhitelist      []string                  // an IP address whitelist of the authenticated IP allowed to use administrator functions of the API
+	TrustedProxies    *ipset.IPSet              // reverse proxies whose X-Forwarded-For and Forwarded headers name the real client, nil to trust none
+	Tokens            []APIToken                // the bearer tokens allowed to use administrator functions of the API, set before Start is called
+	Router            *mux.Router               // a reference to our HTTP router handler
+	TLS               *certs.Reloader           // the certificate the API is served with over HTTPS, nil to serve plain HTTP
+	RedirectAddress   string                    // an optional address serving plain HTTP which redirects to the HTTPS API
+	Logger            *logger.Logger            // an instance of our custom logger
+	CodeTTL           time.Duration             // how long an authentication code stays valid after it is generated
+	DenyBlockTTL      time.Duration             // how long a denied IP is blocklisted by default, 0 to not blocklist
+	Blocklist         map[string]time.Time      // a map of blocklisted IP addresses to when their block ends, guarded by mutex
+	Notifier          Notifier                  // delivers alerts for connection attempts to administrators
+	Users             *UserRegistry             // the registered users, nil to serve no login page and tie no requests to users
+	TOTP              bool                      // whether or not users may authorize their own IP with TOTP codes on the login page
+	TOTPGrantTTL      time.Duration             // how long a self-authorized IP stays whitelisted, 0 for no expiry
+	TOTPRoutes        []string                  // the names of the routes users may authorize their IP on with TOTP codes
+	AccessRequests    bool                      // whether or not users may ask for access on the access request page
+	RequestRoutes     []string                  // the names of the routes access can be requested to
+	MaxRequestTTL     time.Duration             // the longest access which may be requested, 0 for no limit
+	OIDC              *oidc.Provider            // the OpenID Connect provider users may sign in through, nil to not offer OIDC sign in
+	OIDCRoutes        []OIDCRoute               // the routes users may authorize their IP address on by signing in through OIDC
+	OIDCUsernameClaim string                    // the ID token claim users are named by, falling back to their subject
+	OIDCGroupsClaim   string                    // the ID token claim listing the groups a user is in
+	Quorums           map[string]int            // how many administrators must approve a request on each route, routes missing from it need one
+	Approvers         []string                  // the administrators who each get a personal code for requests needing more than one approval
+	accessRequests    map[string]*AccessRequest // the access requests by their ID, guarded by mutex
+	oidcLogins        map[string]oidcLogin      // the OIDC sign ins which have been started but not finished by their state, guarded by mutex
+	approvals         map[string]*approval      // the approvals collected by requests needing more than one, by their approval ID, guarded by mutex
+	totpFailures      map[string]totpFailures   // the wrong TOTP codes submitted by each IP address, guarded by mutex
+	totpUserFailures  map[string]totpFailures   // the wrong TOTP codes submitted for each user name, guarded by mutex
+	totpLastStep      map[string]int64          // the period of the last TOTP code each user authorized with, guarded by mutex
+	mutex             sync.Mutex                // guards the AuthCodes, Blocklist, access request, OIDC, approval and TOTP maps and the server
+	server            *http.Server              // the HTTP server of the API, set once Start is called
+	redirectServer    *http.Server              // the HTTP server redirecting to the API, set once Start is called if there is one
+	done              chan struct{}             // closed when the API is shut down to stop the background cleanup
+}
+
+// the default lifetime of an authentication code
+const DefaultCodeTTL = 15 * time.Minute
+
+// how often expired authentication codes and blocks are cleaned up
+const codeCleanupInterval = time.Minute
+
+// a pending request for an IP address to be whitelisted
+type AuthRequest struct {
+	IP           string        // the IP address to whitelist once the request is approved
+	Route        string        // the name of the route the connection attempt was made on
+	GrantTTL     time.Duration // how long the whitelist grant should last by default, 0 for no expiry
+	Created      time.Time     // when the authentication code for this request was generated
+	User         string        // the registered user the request is tied to, empty if nobody is known
+	IdentifiedBy string        // how the request was tied to its user, e.g. IdentifiedByCertificate
+	Reason       string        // why the user asked for access, empty unless they asked on the access request page
+	AccessID     string        // the ID of the access request the requester watches, empty for connection attempts
+	Approver     string        // the only administrator who may use the code, empty if anyone alerted may
+	Quorum       int           // how many administrators must approve the request, 0 or 1 for any one
+	Approval     string        // the ID the approvals of the request's personal codes are collected under
 }
 
 // constructor for our MFA instance
-func NewMFA(handler ProxyAuthHandler, logger logger.Logger, apiWhitelist []string, defaultApiUrl string, emails ...string) MultiFactorAuth {
-	return MultiFactorAuth{
+func NewMFA(handler *ProxyAuthHandler, logger *logger.Logger, apiWhitelist []string, defaultApiUrl string, notifier Notifier) *MultiFactorAuth {
+	return &MultiFactorAuth{
 		ProxyAuthHandler: handler,
-		Emails:           emails,
-		AuthCodes:        map[string]string{},
+		Notifier:         notifier,
+		AuthCodes:        map[string]AuthRequest{},
 		ApiWhitelist:     apiWhitelist,
 		DefaultApiUrl:    defaultApiUrl,
 		Logger:           logger,
 		Router:           mux.NewRouter(),
+		CodeTTL:          DefaultCodeTTL,
+		Blocklist:        map[string]time.Time{},
+		totpFailures:     map[string]totpFailures{},
+		totpUserFailures: map[string]totpFailures{},
+		totpLastStep:     map[string]int64{},
+		accessRequests:   map[string]*AccessRequest{},
+		oidcLogins:       map[string]oidcLogin{},
+		approvals:        map[string]*approval{},
+		done:             make(chan struct{}),
 	}
 }
 
 // checks whether or not the cryptographically secure code for an IP exists
 func (mfa *MultiFactorAuth) DoesCodeExist(code string) bool {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
 	_, has := mfa.AuthCodes[code]
 	return has
 }
 
 // uses the 'rand' library to generate a 256-bit secure base64 unique code
-func (mfa *MultiFactorAuth) GenerateCode(ip string) (string, error) {
+func (mfa *MultiFactorAuth) GenerateCode(request AuthRequest) (string, error) {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+	return mfa.generateCode(request)
+}
+
+// generates a code for a request, the caller must hold the mutex
+func (mfa *MultiFactorAuth) generateCode(request AuthRequest) (string, error) {
 	// variable for our code to return later
 	key := ""
 
 	// while the key is empty or the key is already present in the map
-	for key == "" || mfa.DoesCodeExist(key) {
+	for key == "" || mfa.AuthCodes[key].IP != "" {
 		// creates a buffer of 32 bytes (32 * 8 = 256 bits)
 		buf := make([]byte, 32)
 
@@ -65,38 +140,230 @@ func (mfa *MultiFactorAuth) GenerateCode(ip string) (string, error) {
 		key = base64.RawURLEncoding.EncodeToString(buf)
 	}
 
-	// updates the AuthCodes map to include the key as the key and ip as the value
-	mfa.AuthCodes[key] = ip
+	// updates the AuthCodes map to include the key as the key and request as the value,
+	// stamping the request with its creation time so the code can expire
+	request.Created = time.Now()
+	mfa.AuthCodes[key] = request
 
 	// returns the key (secure code) with a nil error (represents success)
 	return key, nil
 }
 
-// function to get a code's IP and if it exists
-func (mfa *MultiFactorAuth) GetCodeIP(code string) (string, bool) {
+// function to get a code's request and if it exists and has not expired
+func (mfa *MultiFactorAuth) GetCodeRequest(code string) (AuthRequest, bool) {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
 	// searches the map
-	ip, has := mfa.AuthCodes[code]
-	if !has {
-		return "", false
+	request, has := mfa.AuthCodes[code]
+	if !has || mfa.isCodeExpired(request, time.Now()) {
+		return AuthRequest{}, false
 	}
-	return ip, true
+	return request, true
+}
+
+// function to delete a code from the map as it is being used, returning
+// false if the code was already used, expired or never existed - this is
+// what makes a code single-use when two clicks race each other
+func (mfa *MultiFactorAuth) takeCode(code string) bool {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	request, has := mfa.AuthCodes[code]
+	if !has || mfa.isCodeExpired(request, time.Now()) {
+		return false
+	}
+	delete(mfa.AuthCodes, code)
+	return true
+}
+
+// returns whether or not the code of a request has outlived the CodeTTL
+func (mfa *MultiFactorAuth) isCodeExpired(request AuthRequest, now time.Time) bool {
+	return !now.Before(request.Created.Add(mfa.CodeTTL))
+}
+
+// function to delete every expired code, every block that has ended,
+// every TOTP failure that has been forgotten, every access request
+// nobody can be watching any more, every abandoned OIDC sign in and
+// every approval whose codes have expired from their maps
+func (mfa *MultiFactorAuth) RemoveExpired() {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	now := time.Now()
+	for code, request := range mfa.AuthCodes {
+		if mfa.isCodeExpired(request, now) {
+			log.Printf("[%s] Authentication code for %s expired without a response\n", request.Route, request.IP)
+			delete(mfa.AuthCodes, code)
+		}
+	}
+	for ip, until := range mfa.Blocklist {
+		if !now.Before(until) {
+			delete(mfa.Blocklist, ip)
+		}
+	}
+	for ip, failures := range mfa.totpFailures {
+		if !now.Before(failures.until) && now.Sub(failures.last) > totpLockout {
+			delete(mfa.totpFailures, ip)
+		}
+	}
+	for name, failures := range mfa.totpUserFailures {
+		if !now.Before(failures.until) && now.Sub(failures.last) > totpLockout {
+			delete(mfa.totpUserFailures, name)
+		}
+	}
+	for id, request := range mfa.accessRequests {
+		if now.Sub(request.Updated) > accessRequestRetention && !now.Before(request.Deadline) {
+			delete(mfa.accessRequests, id)
+		}
+	}
+	for state, login := range mfa.oidcLogins {
+		if now.Sub(login.created) > oidcLoginTTL {
+			delete(mfa.oidcLogins, state)
+		}
+	}
+	for id, approval := range mfa.approvals {
+		if !now.Before(approval.created.Add(mfa.CodeTTL)) {
+			delete(mfa.approvals, id)
+		}
+	}
+}
+
+// loops until the API is shut down, cleaning up expired codes and blocks
+func (mfa *MultiFactorAuth) removeExpiredLoop() {
+	ticker := time.NewTicker(codeCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mfa.RemoveExpired()
+		case <-mfa.done:
+			return
+		}
+	}
+}
+
+// returns whether or not an IP address is currently blocklisted
+func (mfa *MultiFactorAuth) IsBlocked(ip string) bool {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+	return mfa.isBlocked(ip)
+}
+
+// checks the blocklist, the caller must hold the mutex
+func (mfa *MultiFactorAuth) isBlocked(ip string) bool {
+	until, has := mfa.Blocklist[ip]
+	return has && time.Now().Before(until)
 }
 
 // starts our HTTP server
 func (mfa *MultiFactorAuth) Start(address string) {
+	// in a goroutine clean up expired codes and blocks in the background
+	go mfa.removeExpiredLoop()
+
 	// declares HTTP routemap
 	mfa.Router.HandleFunc("/api/authenticate", mfa.HandleAuthenticate)
-	mfa.Router.HandleFunc("/api/log", mfa.wrapApiFunc("/api/log", mfa.ViewLog))
+	mfa.Router.HandleFunc("/api/deny", mfa.HandleDeny)
+	mfa.Router.HandleFunc("/api/log", mfa.wrapApiFunc("/api/log", ScopeReadLog, mfa.ViewLog))
+	if mfa.Users != nil {
+		mfa.Router.HandleFunc("/api/login", mfa.HandleLogin)
+	}
+	if mfa.AccessRequests {
+		mfa.Router.HandleFunc("/api/request", mfa.HandleAccessRequest)
+		mfa.Router.HandleFunc("/api/request/status", mfa.HandleAccessRequestStatus)
+	}
+	if mfa.OIDC != nil {
+		mfa.Router.HandleFunc("/api/oidc", mfa.HandleOIDC)
+		mfa.Router.HandleFunc("/api/oidc/login", mfa.HandleOIDCLogin)
+		mfa.Router.HandleFunc("/api/oidc/callback", mfa.HandleOIDCCallback)
+	}
+
+	// creates the HTTP server so that it can be shut down later, unless
+	// the API was already shut down before it had a chance to start
+	mfa.mutex.Lock()
+	select {
+	case <-mfa.done:
+		mfa.mutex.Unlock()
+		return
+	default:
+	}
+	mfa.server = &http.Server{Addr: address, Handler: mfa.Router}
+	server := mfa.server
+	if mfa.TLS != nil {
+		server.TLSConfig = mfa.TLS.TLSConfig()
+		if mfa.RedirectAddress != "" {
+			mfa.redirectServer = &http.Server{Addr: mfa.RedirectAddress, Handler: redirectToHTTPS(address)}
+		}
+	}
+	redirectServer := mfa.redirectServer
+	mfa.mutex.Unlock()
+
+	// in a goroutine serve the plain HTTP redirect to the API if there is one
+	if redirectServer != nil {
+		fmt.Printf("Redirecting to HTTPS from: %s\n", redirectServer.Addr)
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
 
 	// prints to the console window the address the API server is listening on
 	fmt.Printf("Listening on: %s\n", address)
 
-	// uses 'http' module to listen on the address with our router and handles error
-	if err := http.ListenAndServe(address, mfa.Router); err != nil {
+	// uses 'http' module to listen on the address with our router and handles error,
+	// the server being closed by Shutdown is not an error - the certificate comes
+	// from the TLS config so that it can be reloaded while serving
+	var err error
+	if mfa.TLS != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
 
+// returns a handler which redirects every request to the same
+// host and path over HTTPS on the port of the API's address
+func redirectToHTTPS(apiAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(apiAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// stops the API from accepting new requests and waits for in-flight
+// requests to finish until the context is done
+func (mfa *MultiFactorAuth) Shutdown(ctx context.Context) error {
+	mfa.mutex.Lock()
+	server := mfa.server
+	redirectServer := mfa.redirectServer
+	select {
+	case <-mfa.done:
+	default:
+		close(mfa.done)
+	}
+	mfa.mutex.Unlock()
+
+	if redirectServer != nil {
+		_ = redirectServer.Shutdown(ctx)
+	}
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
 // returns whether or not a certain IP address has access to the API
 func (mfa *MultiFactorAuth) HasApiAccess(r *http.Request) bool {
 	// if the ApiWhitelist is empty, return true as all IPs are allowed
@@ -104,13 +371,9 @@ func (mfa *MultiFactorAuth) HasApiAccess(r *http.Request) bool {
 		return true
 	}
 
-	// splits the address into its host and port and gets the address var
-	// the port is unused so we call it _, we also handle errors by silently
-	// returning false
-	address, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return false
-	}
+	// gets the address of the client, which is only taken from the
+	// forwarding headers if the request came through a trusted proxy
+	address := mfa.ClientIP(r)
 	// for every value in the ApiWhitelist
 	for _, v := range mfa.ApiWhitelist {
 		// if the value is equal to the address, return true
@@ -122,25 +385,62 @@ func (mfa *MultiFactorAuth) HasApiAccess(r *http.Request) bool {
 	return false
 }
 
+// registers a handler on the API router which is only reachable from an
+// API-allowed IP address with a token granting the scope, for routes
+// served outside this package
+func (mfa *MultiFactorAuth) HandleApiFunc(path string, scope string, f func(w http.ResponseWriter, r *http.Request)) {
+	mfa.Router.HandleFunc(path, mfa.wrapApiFunc(path, scope, f))
+}
+
 // this function is a generator function so that only requests that are from
 // an API-allowed IP address is able to be called - this utilises callbacks
-func (mfa *MultiFactorAuth) wrapApiFunc(path string, f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+func (mfa *MultiFactorAuth) wrapApiFunc(path string, scope string, f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !mfa.HasApiAccess(r) {
-			if address, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-				log.Printf("Unauthorized API attempt [%s] from: %s\n", path, address)
+		status, reason := mfa.checkApiAccess(r, scope)
+		if status != http.StatusOK {
+			log.Printf("Unauthorized API attempt [%s] from: %s - %s\n", path, mfa.ClientIP(r), reason)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gatekeeper"`)
 			}
-			_, _ = fmt.Fprint(w, "unauthorized")
+			http.Error(w, http.StatusText(status), status)
 			return
 		}
 		f(w, r)
 	}
 }
 
+// checks whether or not a request may use an API route needing a scope,
+// returning http.StatusOK if it may or the status to reject it with and why -
+// the IP address must be allowed by the ApiWhitelist and, once any tokens
+// are configured, the request must carry a token granting the scope
+func (mfa *MultiFactorAuth) checkApiAccess(r *http.Request, scope string) (int, string) {
+	if !mfa.HasApiAccess(r) {
+		return http.StatusForbidden, "IP address not allowed"
+	}
+
+	// without tokens only the IP address is checked, which is
+	// only allowed when the ApiWhitelist actually restricts it
+	if len(mfa.Tokens) == 0 {
+		if len(mfa.ApiWhitelist) == 0 {
+			return http.StatusForbidden, "no API tokens or API whitelist configured"
+		}
+		return http.StatusOK, ""
+	}
+
+	token := mfa.requestToken(r)
+	if token == nil {
+		return http.StatusUnauthorized, "missing or invalid token"
+	}
+	if !token.HasScope(scope) {
+		return http.StatusForbidden, fmt.Sprintf("token %s lacks scope %s", token.Name, scope)
+	}
+	return http.StatusOK, ""
+}
+
 // function to write the logger's cachedLog to a http response writer
 // all return values of the logger is ignored, so we name them '_'
 func (mfa *MultiFactorAuth) ViewLog(w http.ResponseWriter, _ *http.Request) {
-	_, _ = fmt.Fprintf(w, string(mfa.Logger.CachedLog))
+	_, _ = w.Write(mfa.Logger.Cached())
 }
 
 // handler function for our /api/authenticate route
@@ -152,20 +452,67 @@ func (mfa *MultiFactorAuth) HandleAuthenticate(w http.ResponseWriter, r *http.Re
 		_, _ = fmt.Fprint(w, "you must enter a code")
 		return
 	}
-	// gets the IP address of a certain secure code
+	// gets the request of a certain secure code
 	// from the map and checks if its a valid code
-	ip, valid := mfa.GetCodeIP(code)
+	request, valid := mfa.GetCodeRequest(code)
 	// if invalid, write an error back to the browser
 	if !valid {
 		_, _ = fmt.Fprint(w, "invalid code")
 		return
 	}
+
+	// the grant lasts for the route's default ttl unless the approver
+	// overrides it with the "ttl" form value, e.g. ttl=12h or ttl=0 for no expiry -
+	// a request needing several approvals always lasts for the ttl every approver
+	// was alerted with, so that no single approver can lengthen what the others approved
+	ttl := request.GrantTTL
+	if value := r.FormValue("ttl"); value != "" && request.Quorum <= 1 {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			_, _ = fmt.Fprint(w, "invalid ttl")
+			return
+		}
+		ttl = parsed
+	}
+
 	// delete the auth code from the map as its now being processed
 	// and we don't want to authenticate it twice
-	delete(mfa.AuthCodes, code)
+	if !mfa.takeCode(code) {
+		_, _ = fmt.Fprint(w, "invalid code")
+		return
+	}
 
-	// adds this IP address to the IP whitelist
-	err := mfa.ProxyAuthHandler.AddWhitelistIP(ip)
+	// a request needing several approvals is only granted once enough
+	// administrators have each used their personal code
+	var approvers []string
+	if request.Quorum > 1 {
+		var reached bool
+		approvers, reached = mfa.recordApproval(request)
+		if approvers == nil {
+			_, _ = fmt.Fprint(w, "invalid code")
+			return
+		}
+		if !reached {
+			log.Printf("[%s] %s approved %s from %s, %d of %d approvals\n", request.Route, request.Approver, DescribeClient(request.IP, request.User), mfa.ClientIP(r), len(approvers), request.Quorum)
+			_, _ = fmt.Fprint(w, describeQuorum(approvers, request.Quorum))
+			return
+		}
+	}
+
+	// adds this IP address to the IP whitelist for the grant's duration, only
+	// on the route it was approved for so that an approval on a route needing
+	// one administrator never lets it onto a route needing several
+	err := mfa.ProxyAuthHandler.GrantWhitelistEntry(WhitelistEntry{
+		Address: request.IP,
+		AddedBy: describeApprovers(approvers),
+		Reason:  fmt.Sprintf("approved access to route %s", request.Route),
+		User:    request.User,
+		Routes:  []string{request.Route},
+	}, ttl)
+	if err == nil {
+		log.Printf("[%s] Whitelisted %s for %s, %s from %s\n", request.Route, DescribeClient(request.IP, request.User), describeTTL(ttl), describeApprovers(approvers), mfa.ClientIP(r))
+		mfa.resolveAccessRequest(request, AccessApproved, ttl)
+	}
 
 	// calculates a response to send back to the browser
 	// if no error from adding IP to whitelist, return "success",
@@ -181,79 +528,192 @@ func (mfa *MultiFactorAuth) HandleAuthenticate(w http.ResponseWriter, r *http.Re
 	_, _ = fmt.Fprint(w, response)
 }
 
-// function to check if an IP is authenticated and send an email
-// alert if not
-func (mfa *MultiFactorAuth) IsAuthenticated(ip string) bool {
-	// uses the auth data handler and if whitelisted, return true
-	if mfa.ProxyAuthHandler.IsWhitelisted(ip) {
+// handler function for our /api/deny route
+func (mfa *MultiFactorAuth) HandleDeny(w http.ResponseWriter, r *http.Request) {
+	// gets the "code" form value
+	code := r.FormValue("code")
+	// if the code is empty, we return an error
+	if code == "" {
+		_, _ = fmt.Fprint(w, "you must enter a code")
+		return
+	}
+	// gets the request of a certain secure code and checks if its a valid code
+	request, valid := mfa.GetCodeRequest(code)
+	if !valid {
+		_, _ = fmt.Fprint(w, "invalid code")
+		return
+	}
+
+	// the IP is blocklisted for the default duration unless the approver
+	// overrides it with the "block" form value, e.g. block=24h or block=0 for no block
+	block := mfa.DenyBlockTTL
+	if value := r.FormValue("block"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			_, _ = fmt.Fprint(w, "invalid block duration")
+			return
+		}
+		block = parsed
+	}
+
+	// delete the auth code from the map so it cannot be used again
+	if !mfa.takeCode(code) {
+		_, _ = fmt.Fprint(w, "invalid code")
+		return
+	}
+
+	// a denial by any administrator stops the others approving the request
+	if request.Approval != "" {
+		mfa.mutex.Lock()
+		mfa.dropApproval(request.Approval)
+		mfa.mutex.Unlock()
+	}
+	mfa.resolveAccessRequest(request, AccessDenied, 0)
+
+	// blocklists the IP so no further alerts are sent for it until the block ends
+	if block > 0 {
+		mfa.mutex.Lock()
+		mfa.Blocklist[request.IP] = time.Now().Add(block)
+		mfa.mutex.Unlock()
+		log.Printf("[%s] Denied %s and blocklisted it for %s, denied from %s\n", request.Route, request.IP, block, mfa.ClientIP(r))
+	} else {
+		log.Printf("[%s] Denied %s from %s\n", request.Route, request.IP, mfa.ClientIP(r))
+	}
+
+	_, _ = fmt.Fprint(w, "denied")
+}
+
+// function to check if the IP of a request is authenticated for its route
+// and send an email alert if not
+func (mfa *MultiFactorAuth) IsAuthenticated(request AuthRequest) bool {
+	// uses the auth data handler and if whitelisted for the route, return true
+	if _, whitelisted := mfa.WhitelistedUser(request.IP, request.Route); whitelisted {
 		return true
 	}
 
-	// checks if ip has a code already generated
-	for _, v := range mfa.AuthCodes {
-		// if an IP has a code already generated
-		// (and not authenticated yet), just return false
-		if v == ip {
-			return false
+	// the pending codes are checked and a new code is generated under
+	// one lock, so simultaneous connection attempts send a single alert
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	// blocklisted IPs are rejected without sending another alert
+	if mfa.isBlocked(request.IP) {
+		return false
+	}
+
+	// checks if ip has a code already generated for this route, as an
+	// ignored alert for one route must not hold back alerts for another
+	now := time.Now()
+	pending := false
+	for code, v := range mfa.AuthCodes {
+		// if an IP has an unexpired code already generated
+		// (and not authenticated yet), just return false - tying
+		// it, and every personal code alongside it, to the user
+		// of this request if it has none yet
+		if v.IP == request.IP && v.Route == request.Route && !mfa.isCodeExpired(v, now) {
+			if v.User == "" && request.User != "" {
+				v.User, v.IdentifiedBy = request.User, request.IdentifiedBy
+				mfa.AuthCodes[code] = v
+			}
+			pending = true
 		}
 	}
+	if pending {
+		return false
+	}
+
+	// without a notifier nobody could ever approve the code,
+	// so one is not generated
+	if mfa.Notifier == nil {
+		log.Printf("[%s] No notifiers configured, cannot send alert for %s\n", request.Route, request.IP)
+		return false
+	}
 
-	// send the email alert in a subroutine and return false
-	go mfa.SendEmailAlerts(ip)
+	// generates the secure unique codes to identify the IP in the alerts
+	// and throws if the system's random source fails
+	codes, err := mfa.generateCodes(request)
+	if err != nil {
+		panic(err)
+	}
+
+	// send the alerts in subroutines and return false
+	for code, request := range codes {
+		go mfa.sendAlert(request, code)
+	}
 	return false
 }
 
-// function to send email alerts to all the administrators
-// for a connection attempt of a certain IP address
-func (mfa *MultiFactorAuth) SendEmailAlerts(ip string) {
-	// generates the secure unique code to identify
-	// the IP in the email
-	code, err := mfa.GenerateCode(ip)
+// function to send alerts to all the administrators through the
+// notifier for a connection attempt of a certain IP address
+func (mfa *MultiFactorAuth) SendAlerts(request AuthRequest) {
+	// without a notifier nobody could ever approve the code,
+	// so one is not generated
+	if mfa.Notifier == nil {
+		log.Printf("[%s] No notifiers configured, cannot send alert for %s\n", request.Route, request.IP)
+		return
+	}
+
+	// generates the secure unique codes to identify
+	// the IP in the alerts
+	mfa.mutex.Lock()
+	codes, err := mfa.generateCodes(request)
+	mfa.mutex.Unlock()
 
 	// if an error is returned, throw the error
 	if err != nil {
 		panic(err)
 	}
 
-	// uses the code to generate a link based off the DefaultApiUrl struct field
-	// and the secure code
-	link := fmt.Sprintf("%s/authenticate?code=%s", mfa.DefaultApiUrl, code)
+	for code, request := range codes {
+		mfa.sendAlert(request, code)
+	}
+}
 
-	// gets the OS hostname to use in the email
+// sends the alert for a request whose code has already been generated
+func (mfa *MultiFactorAuth) sendAlert(request AuthRequest, code string) {
+	// gets the OS hostname to use in the alert
 	// and handles errors by throwing
 	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
 
-	// generates the text body of the email alert
-	body := fmt.Sprintf("RDP Login Attempt from %s.\nClick below to verify this IP.\n\n%s", ip, link)
-
-	// uses the gomail library to generate a new SMTP dialer for the email
-	// and configures TLS to work appropriately
-	dialer := gomail.NewDialer("smtp.gmail.com", 587, "alerts@gatekeeper.io", "Password123")
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	// array of emails to send all at once as a batch request to limit
-	// network calls
-	var messages []*gomail.Message
+	// uses the code to generate the approve and deny links based off the
+	// DefaultApiUrl struct field and the secure code
+	alert := Alert{
+		Kind:         AlertAttempt,
+		IP:           request.IP,
+		User:         request.User,
+		IdentifiedBy: request.IdentifiedBy,
+		Route:        request.Route,
+		Reason:       request.Reason,
+		Hostname:     hostname,
+		ApproveURL:   fmt.Sprintf("%s/authenticate?code=%s", mfa.DefaultApiUrl, code),
+		DenyURL:      fmt.Sprintf("%s/deny?code=%s", mfa.DefaultApiUrl, code),
+		GrantTTL:     describeTTL(request.GrantTTL),
+		Expires:      time.Now().Add(mfa.CodeTTL),
+		Approver:     request.Approver,
+		Quorum:       request.Quorum,
+	}
 
-	// loops through all administrator email addresses
-	for _, email := range mfa.Emails {
-		// creates a new email message object and appends to the 'messages' array
-		m := gomail.NewMessage()
-		m.SetHeader("From", "RDP Gatekeeper <alerts@gatekeeper.io>")
-		m.SetHeader("To", email)
-		m.SetHeader("Subject", fmt.Sprintf("RDP Access Attempt on machine: %s", hostname))
-		m.SetBody("text/plain", body)
-		messages = append(messages, m)
+	if request.AccessID != "" {
+		alert.Kind = AlertAccessRequest
 	}
 
-	// uses the diailer to send the array of emails in one
-	// batch network call and handles errors
-	if err := dialer.DialAndSend(messages...); err != nil {
-		panic(err)
+	// a failure is logged rather than thrown so an outage of
+	// one notifier does not halt the proxy
+	if err := mfa.Notifier.Notify(alert); err != nil {
+		log.Printf("[%s] Error sending alert for %s: %s\n", request.Route, DescribeClient(request.IP, request.User), err)
+		return
 	}
 
-	fmt.Printf("sent email to %v\n", mfa.Emails)
+	log.Printf("[%s] Sent alert for %s\n", request.Route, DescribeClient(request.IP, request.User))
+}
+
+// function to describe a grant duration in emails and logs
+func describeTTL(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "an unlimited time"
+	}
+	return ttl.String()
 }
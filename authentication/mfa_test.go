@@ -0,0 +1,181 @@
+package authentication
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/certs"
+	"github.com/saifsuleman/gatekeeper/logger"
+)
+
+func newTestMFA(t *testing.T) *MultiFactorAuth {
+	handler, err := NewProxyAuthHandler(filepath.Join(t.TempDir(), "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMFA(handler, &logger.Logger{}, nil, "http://127.0.0.1/api", nil)
+}
+
+func TestExpiredCodeIsRejected(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.CodeTTL = time.Millisecond
+
+	code, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	mfa.HandleAuthenticate(recorder, httptest.NewRequest("GET", "/api/authenticate?code="+code, nil))
+	if recorder.Body.String() != "invalid code" {
+		t.Errorf("expected expired code to be rejected, got %q", recorder.Body.String())
+	}
+
+	mfa.RemoveExpired()
+	if len(mfa.AuthCodes) != 0 {
+		t.Error("expired code should have been removed")
+	}
+}
+
+func TestApproveCodeIsSingleUse(t *testing.T) {
+	mfa := newTestMFA(t)
+
+	code, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "rdp", GrantTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	mfa.HandleAuthenticate(recorder, httptest.NewRequest("GET", "/api/authenticate?code="+code+"&ttl=30m", nil))
+	if recorder.Body.String() != "success" {
+		t.Fatalf("expected success, got %q", recorder.Body.String())
+	}
+	if !mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Error("approved IP should be whitelisted")
+	}
+	if expires := mfa.ProxyAuthHandler.Whitelist[0].Expires; expires == nil || time.Until(*expires) > 31*time.Minute {
+		t.Error("ttl query parameter should override the route's grant ttl")
+	}
+
+	recorder = httptest.NewRecorder()
+	mfa.HandleDeny(recorder, httptest.NewRequest("GET", "/api/deny?code="+code, nil))
+	if recorder.Body.String() != "invalid code" {
+		t.Error("a used code should not be accepted again")
+	}
+}
+
+func TestPendingCodePerRoute(t *testing.T) {
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 3)
+	mfa.Notifier = alerts
+
+	// a second attempt on the same route waits on the first alert
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if alert, _ := alertCode(t, alerts); alert.Route != "rdp" {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+
+	// while an attempt on another route from the same IP is alerted on its own
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "ssh"})
+	if alert, _ := alertCode(t, alerts); alert.Route != "ssh" {
+		t.Errorf("expected an alert for ssh, got %+v", alert)
+	}
+	if len(mfa.AuthCodes) != 2 {
+		t.Errorf("expected a code for each route, got %v", mfa.AuthCodes)
+	}
+}
+
+func TestDenyBlocklistsIP(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.DenyBlockTTL = time.Hour
+
+	code, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	mfa.HandleDeny(recorder, httptest.NewRequest("GET", "/api/deny?code="+code, nil))
+	if recorder.Body.String() != "denied" {
+		t.Fatalf("expected denied, got %q", recorder.Body.String())
+	}
+	if !mfa.IsBlocked("192.0.2.1") {
+		t.Error("denied IP should be blocklisted")
+	}
+	if mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "rdp"}) {
+		t.Error("blocklisted IP should not be authenticated")
+	}
+	if len(mfa.AuthCodes) != 0 {
+		t.Error("no new alert should be sent for a blocklisted IP")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	handler := redirectToHTTPS(":8182")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://rdp.example.com:8080/api/authenticate?code=abc", nil))
+	if recorder.Code != 301 {
+		t.Errorf("expected 301, got %d", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "https://rdp.example.com:8182/api/authenticate?code=abc" {
+		t.Errorf("unexpected redirect to %s", location)
+	}
+
+	// the default HTTPS port is left out of the redirect
+	recorder = httptest.NewRecorder()
+	redirectToHTTPS(":443").ServeHTTP(recorder, httptest.NewRequest("GET", "http://rdp.example.com/api/log", nil))
+	if location := recorder.Header().Get("Location"); location != "https://rdp.example.com/api/log" {
+		t.Errorf("unexpected redirect to %s", location)
+	}
+}
+
+func TestStartServesHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	if err := certs.GenerateSelfSigned(certFile, keyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// finds a free port for the API to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	mfa := newTestMFA(t)
+	mfa.TLS = reloader
+	go mfa.Start(address)
+	defer mfa.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		response, err := client.Get("https://" + address + "/api/authenticate")
+		if err == nil {
+			response.Body.Close()
+			if response.TLS == nil {
+				t.Error("expected the API to be served over TLS")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
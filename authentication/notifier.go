@@ -0,0 +1,207 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+// the kinds of alert sent to administrators
+const (
+	AlertAttempt        = "attempt"         // a connection attempt which can be approved or denied
+	AlertSelfAuthorized = "self-authorized" // a user whitelisted their own IP address with a TOTP code or by signing in through OIDC
+	AlertAccessRequest  = "request"         // a user asked for access on the access request page, which can be approved or denied
+)
+
+// an alert for a connection attempt from an IP address which is not
+// whitelisted, sent to administrators so they can approve or deny it,
+// or for a user who whitelisted their own IP address
+type Alert struct {
+	Kind         string    `json:"kind"`                   // what the alert is about, an attempt if empty
+	IP           string    `json:"ip"`                     // the IP address the connection attempt came from
+	User         string    `json:"user,omitempty"`         // the registered user the attempt is tied to or who self-authorized the IP address
+	IdentifiedBy string    `json:"identifiedBy,omitempty"` // how an attempt was tied to its user, e.g. "certificate" or "username"
+	Route        string    `json:"route"`                  // the name of the route the connection attempt was made on
+	Reason       string    `json:"reason,omitempty"`       // why the user asked for access, or how they authorized their own IP address
+	Hostname     string    `json:"hostname"`               // the hostname of the machine gatekeeper is running on
+	ApproveURL   string    `json:"approveUrl"`             // the link which whitelists the IP address
+	DenyURL      string    `json:"denyUrl"`                // the link which denies the request
+	GrantTTL     string    `json:"grantTTL"`               // how long the IP address will be whitelisted for if approved
+	Expires      time.Time `json:"expires"`                // when the approve and deny links stop working
+	Approver     string    `json:"approver,omitempty"`     // the only administrator whose approval the links record, empty if anyone alerted may use them
+	Quorum       int       `json:"quorum,omitempty"`       // how many administrators must approve before the IP address is whitelisted, empty for one
+}
+
+// something which can deliver alerts to administrators
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// a notifier which sends every alert to several notifiers,
+// so one attempt can reach email and a chat bridge at once
+type MultiNotifier []Notifier
+
+// sends the alert to every notifier, continuing past failures and
+// returning an error describing every notifier that failed
+func (m MultiNotifier) Notify(alert Alert) error {
+	var failures []string
+	for _, notifier := range m {
+		if err := notifier.Notify(alert); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d notifiers failed: %s", len(failures), len(m), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// a notifier which emails alerts to administrators through an SMTP server
+type EmailNotifier struct {
+	Emails []string     // list of administrator email addresses
+	SMTP   SMTPSettings // the SMTP server the emails are sent through
+}
+
+// emails the alert to every administrator, or only to its approver, in one batch
+func (e *EmailNotifier) Notify(alert Alert) error {
+	dialer, err := e.SMTP.Dialer()
+	if err != nil {
+		return err
+	}
+
+	// generates the subject and text body of the email alert
+	subject := fmt.Sprintf("RDP Access Attempt on machine: %s", alert.Hostname)
+	body := fmt.Sprintf(
+		"RDP Login Attempt from %s on route %s.\nClick below to verify this IP for %s.\n\n%s\n\n"+
+			"If you do not recognise this attempt, click below to deny it.\n\n%s\n\nThese links expire at %s.",
+		alert.IP, alert.Route, alert.GrantTTL, alert.ApproveURL, alert.DenyURL, alert.Expires.Format(time.RFC1123),
+	)
+	if alert.Kind == AlertAccessRequest {
+		subject = fmt.Sprintf("RDP Access Request on machine: %s", alert.Hostname)
+		body = fmt.Sprintf(
+			"Access requested from %s on route %s for %s.\nReason given: %s\n\nClick below to approve it.\n\n%s\n\n"+
+				"If you do not recognise this request, click below to deny it.\n\n%s\n\nThese links expire at %s.",
+			alert.IP, alert.Route, alert.GrantTTL, alert.Reason, alert.ApproveURL, alert.DenyURL, alert.Expires.Format(time.RFC1123),
+		)
+	}
+	if alert.User != "" {
+		body = fmt.Sprintf("The attempt is from user %s, identified by their %s%s.\n\n%s",
+			alert.User, alert.IdentifiedBy, describeIdentification(alert.IdentifiedBy), body)
+	}
+	if alert.Kind == AlertSelfAuthorized {
+		subject = fmt.Sprintf("RDP Self-Authorization on machine: %s", alert.Hostname)
+		route := "every route"
+		if alert.Route != "" {
+			route = "route " + alert.Route
+		}
+		body = fmt.Sprintf(
+			"User %s authorized %s on %s for %s %s.\n\n"+
+				"If this was not them, remove the IP from the whitelist and secure the user's account.",
+			alert.User, alert.IP, route, alert.GrantTTL, alert.Reason,
+		)
+	}
+
+	if alert.Quorum > 1 {
+		body += fmt.Sprintf("\n\nThese links are personal to %s, and %d administrators must approve before the IP is whitelisted.",
+			alert.Approver, alert.Quorum)
+	}
+
+	// a personal alert only goes to its approver, as anyone
+	// else using its links would approve in their name
+	emails := e.Emails
+	if alert.Approver != "" {
+		emails = []string{alert.Approver}
+	}
+
+	// array of emails to send all at once as a batch request to limit
+	// network calls
+	var messages []*gomail.Message
+
+	// loops through all administrator email addresses
+	for _, email := range emails {
+		// creates a new email message object and appends to the 'messages' array
+		m := gomail.NewMessage()
+		m.SetHeader("From", e.SMTP.From)
+		m.SetHeader("To", email)
+		m.SetHeader("Subject", subject)
+		m.SetBody("text/plain", body)
+		messages = append(messages, m)
+	}
+
+	// uses the dialer to send the array of emails in one batch network call
+	if err := dialer.DialAndSend(messages...); err != nil {
+		return fmt.Errorf("email: %s", err)
+	}
+	return nil
+}
+
+// warns administrators that a username claimed on the login page is not proof
+func describeIdentification(identifiedBy string) string {
+	if identifiedBy == IdentifiedByUsername {
+		return " - anyone at the IP address could have claimed it, so check with them before approving"
+	}
+	return ""
+}
+
+// the header holding the HMAC-SHA256 signature of a webhook's body
+const WebhookSignatureHeader = "X-Gatekeeper-Signature"
+
+// a notifier which posts alerts as JSON to an HTTP endpoint
+type WebhookNotifier struct {
+	URL    string       // the endpoint the alerts are posted to
+	Secret string       // the key used to sign the body with HMAC-SHA256
+	Client *http.Client // the client used to send requests, http.DefaultClient if nil
+}
+
+// posts the alert as JSON, signed with the webhook's secret - personal
+// alerts are left out, as anyone reading the webhook could otherwise use
+// every administrator's links and meet a quorum alone
+func (w *WebhookNotifier) Notify(alert Alert) error {
+	if alert.Approver != "" {
+		return nil
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(w.Secret, body))
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %s", w.URL, err)
+	}
+	defer response.Body.Close()
+
+	// anything other than a 2xx status is treated as a failed delivery
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: unexpected status %s", w.URL, response.Status)
+	}
+	return nil
+}
+
+// returns the hex encoded HMAC-SHA256 of a webhook body, receivers
+// compute the same value to check an alert really came from gatekeeper
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,104 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a notifier which records every alert it is given
+type recordingNotifier struct {
+	alerts []Alert
+	err    error
+}
+
+func (r *recordingNotifier) Notify(alert Alert) error {
+	r.alerts = append(r.alerts, alert)
+	return r.err
+}
+
+func TestWebhookNotifierSignsPayload(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+SignWebhook("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var alert Alert
+		if err := json.Unmarshal(body, &alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	webhook := &WebhookNotifier{URL: server.URL, Secret: "secret"}
+	if err := webhook.Notify(Alert{IP: "192.0.2.1", Route: "rdp", ApproveURL: "approve", DenyURL: "deny"}); err != nil {
+		t.Fatal(err)
+	}
+
+	alert := <-received
+	if alert.IP != "192.0.2.1" || alert.Route != "rdp" || alert.ApproveURL != "approve" || alert.DenyURL != "deny" {
+		t.Errorf("unexpected alert received: %+v", alert)
+	}
+
+	// a webhook signed with the wrong secret is rejected by the receiver
+	wrong := &WebhookNotifier{URL: server.URL, Secret: "wrong"}
+	if err := wrong.Notify(Alert{IP: "192.0.2.1"}); err == nil {
+		t.Error("expected a non-2xx response to be reported as an error")
+	}
+}
+
+func TestWebhookNotifierSkipsPersonalAlerts(t *testing.T) {
+	posted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = true
+	}))
+	defer server.Close()
+
+	webhook := &WebhookNotifier{URL: server.URL, Secret: "secret"}
+	alert := Alert{IP: "192.0.2.1", Route: "rdp", ApproveURL: "approve", DenyURL: "deny", Approver: "alice@example.com", Quorum: 2}
+	if err := webhook.Notify(alert); err != nil {
+		t.Fatal(err)
+	}
+	if posted {
+		t.Error("expected an administrator's personal links not to be posted to the webhook")
+	}
+}
+
+func TestMultiNotifierReachesEveryNotifier(t *testing.T) {
+	failing := &recordingNotifier{err: errors.New("chat bridge down")}
+	working := &recordingNotifier{}
+
+	err := MultiNotifier{failing, working}.Notify(Alert{IP: "192.0.2.1"})
+	if err == nil || !strings.Contains(err.Error(), "chat bridge down") {
+		t.Errorf("expected the failure to be reported, got %v", err)
+	}
+	if len(failing.alerts) != 1 || len(working.alerts) != 1 {
+		t.Error("every notifier should receive the alert even if one fails")
+	}
+}
+
+func TestSendAlertsBuildsLinks(t *testing.T) {
+	notifier := &recordingNotifier{}
+	mfa := newTestMFA(t)
+	mfa.Notifier = notifier
+
+	mfa.SendAlerts(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+
+	if len(notifier.alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(notifier.alerts))
+	}
+	for code := range mfa.AuthCodes {
+		alert := notifier.alerts[0]
+		if !strings.HasSuffix(alert.ApproveURL, "/authenticate?code="+code) || !strings.HasSuffix(alert.DenyURL, "/deny?code="+code) {
+			t.Errorf("alert links do not carry the code: %+v", alert)
+		}
+	}
+}
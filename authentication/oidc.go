@@ -0,0 +1,212 @@
+package authentication
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/oidc"
+)
+
+// the groups value which lets everyone the OIDC provider signs in use a route
+const OIDCAnyGroup = "*"
+
+// how long a user has to finish signing in at the OIDC provider
+const oidcLoginTTL = 10 * time.Minute
+
+// the cookie holding the state of a sign in, which ties the callback to the
+// browser which started it so nobody can be signed in as someone else
+const oidcStateCookie = "gatekeeper_oidc_state"
+
+// a route users may authorize their IP address on by signing in through OIDC
+type OIDCRoute struct {
+	Name     string        // the name of the route
+	Groups   []string      // the groups whose members may use the route, OIDCAnyGroup for everyone the provider signs in
+	GrantTTL time.Duration // how long a signed in user's IP address is whitelisted for, 0 for no expiry
+}
+
+// returns whether or not a user in some groups may use the route
+func (r *OIDCRoute) AllowsGroups(groups []string) bool {
+	for _, allowed := range r.Groups {
+		if allowed == OIDCAnyGroup {
+			return true
+		}
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// a sign in through OIDC which has been started but not finished
+type oidcLogin struct {
+	ip       string    // the IP address which started the sign in
+	route    string    // the name of the route the sign in is for
+	verifier string    // the PKCE code verifier of the sign in
+	nonce    string    // the nonce the ID token must carry
+	created  time.Time // when the sign in was started
+}
+
+// the OIDC page, which lists the routes a user can sign in for
+var oidcPage = template.Must(template.New("oidc").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Gatekeeper</title></head>
+<body>
+<h1>Sign in from {{.IP}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Routes}}<ul>
+{{range .Routes}}<li><a href="/api/oidc/login?route={{.Name}}">Sign in for {{.Name}}</a></li>
+{{end}}</ul>{{end}}
+</body>
+</html>
+`))
+
+// writes the OIDC page with a status and message
+func (mfa *MultiFactorAuth) writeOIDCPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = oidcPage.Execute(w, struct {
+		IP, Message string
+		Routes      []OIDCRoute
+	}{mfa.ClientIP(r), message, mfa.OIDCRoutes})
+}
+
+// handler function for our /api/oidc route, which lists the routes to sign in for
+func (mfa *MultiFactorAuth) HandleOIDC(w http.ResponseWriter, r *http.Request) {
+	mfa.writeOIDCPage(w, r, http.StatusOK, "")
+}
+
+// returns the route users may sign in through OIDC for with a name
+func (mfa *MultiFactorAuth) oidcRoute(name string) (OIDCRoute, bool) {
+	for _, route := range mfa.OIDCRoutes {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	return OIDCRoute{}, false
+}
+
+// handler function for our /api/oidc/login route, which sends the user to the
+// OIDC provider to sign in for the route with the "route" form value
+func (mfa *MultiFactorAuth) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	route, found := mfa.oidcRoute(r.FormValue("route"))
+	if !found {
+		mfa.writeOIDCPage(w, r, http.StatusNotFound, "Choose a route to sign in for.")
+		return
+	}
+
+	// the state, nonce and verifier are each random so that none of them
+	// can be guessed from the others
+	var login oidcLogin
+	state, err := oidc.RandomValue()
+	if err == nil {
+		login.nonce, err = oidc.RandomValue()
+	}
+	if err == nil {
+		login.verifier, err = oidc.RandomValue()
+	}
+	if err != nil {
+		panic(err)
+	}
+	login.ip, login.route, login.created = mfa.ClientIP(r), route.Name, time.Now()
+
+	authURL, err := mfa.OIDC.AuthCodeURL(r.Context(), state, login.nonce, login.verifier)
+	if err != nil {
+		log.Printf("[%s] Error starting OIDC sign in for %s: %s\n", route.Name, login.ip, err)
+		mfa.writeOIDCPage(w, r, http.StatusBadGateway, "The sign in provider could not be reached, try again later.")
+		return
+	}
+
+	mfa.mutex.Lock()
+	mfa.oidcLogins[state] = login
+	mfa.mutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handler function for our /api/oidc/callback route, which the OIDC provider
+// sends the user back to - once the sign in is verified and the user's groups
+// allow the route, their IP address is whitelisted for the route's grant ttl
+func (mfa *MultiFactorAuth) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ip := mfa.ClientIP(r)
+	state := r.FormValue("state")
+
+	// a sign in can only be finished once, by the browser which started it
+	mfa.mutex.Lock()
+	login, found := mfa.oidcLogins[state]
+	delete(mfa.oidcLogins, state)
+	mfa.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1})
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if !found || err != nil || cookie.Value != state || time.Since(login.created) > oidcLoginTTL {
+		log.Printf("OIDC sign in from %s refused - unknown or expired state\n", ip)
+		mfa.writeOIDCPage(w, r, http.StatusBadRequest, "Your sign in has expired, start again.")
+		return
+	}
+	if login.ip != ip {
+		log.Printf("[%s] OIDC sign in from %s refused - it was started from %s\n", login.route, ip, login.ip)
+		mfa.writeOIDCPage(w, r, http.StatusBadRequest, "Your IP address changed while signing in, start again.")
+		return
+	}
+	if reason := r.FormValue("error"); reason != "" {
+		log.Printf("[%s] OIDC sign in from %s failed - %s %s\n", login.route, ip, reason, r.FormValue("error_description"))
+		mfa.writeOIDCPage(w, r, http.StatusUnauthorized, "You were not signed in.")
+		return
+	}
+
+	claims, err := mfa.OIDC.Exchange(r.Context(), r.FormValue("code"), login.verifier, login.nonce)
+	if err != nil {
+		log.Printf("[%s] OIDC sign in from %s failed - %s\n", login.route, ip, err)
+		mfa.writeOIDCPage(w, r, http.StatusUnauthorized, "You were not signed in.")
+		return
+	}
+
+	// users are named by their username claim where the provider sends one
+	name := claims.String(mfa.OIDCUsernameClaim)
+	if name == "" {
+		name = claims.String("sub")
+	}
+
+	// the route may have been removed while the user was signing in
+	route, found := mfa.oidcRoute(login.route)
+	if !found || !route.AllowsGroups(claims.Strings(mfa.OIDCGroupsClaim)) {
+		log.Printf("[%s] OIDC sign in of %s refused - not in a group allowed on the route\n", login.route, DescribeClient(ip, name))
+		mfa.writeOIDCPage(w, r, http.StatusForbidden, fmt.Sprintf("You are signed in as %s, but may not use %s.", name, login.route))
+		return
+	}
+
+	err = mfa.ProxyAuthHandler.GrantWhitelistEntry(WhitelistEntry{
+		Address: ip,
+		AddedBy: "oidc " + name,
+		Reason:  fmt.Sprintf("signed in through OIDC for route %s", route.Name),
+		User:    name,
+		Routes:  []string{route.Name},
+		Issuer:  mfa.OIDC.Issuer,
+	}, route.GrantTTL)
+	if err != nil {
+		log.Printf("[%s] Error whitelisting %s for OIDC user %s: %s\n", route.Name, ip, name, err)
+		mfa.writeOIDCPage(w, r, http.StatusInternalServerError, "Your IP address could not be authorized.")
+		return
+	}
+
+	// administrators are told about every sign in, as they
+	// would otherwise never see it happen
+	log.Printf("[%s] Whitelisted %s for %s, signed in through OIDC\n", route.Name, DescribeClient(ip, name), describeTTL(route.GrantTTL))
+	go mfa.sendSelfAuthorizedAlert(ip, name, route.Name, route.GrantTTL, "by signing in through OIDC")
+
+	mfa.writeOIDCPage(w, r, http.StatusOK, fmt.Sprintf("Signed in as %s - %s is authorized on %s for %s.", name, ip, route.Name, describeTTL(route.GrantTTL)))
+}
@@ -0,0 +1,159 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/oidc"
+	"github.com/saifsuleman/gatekeeper/oidc/oidctest"
+)
+
+// returns an MFA whose users sign in through a mock issuer, ops members on
+// rdp and everyone on ssh
+func newTestOIDCMFA(t *testing.T) (*MultiFactorAuth, *oidctest.Issuer, channelNotifier) {
+	issuer := oidctest.NewIssuer("gatekeeper", "")
+	t.Cleanup(issuer.Close)
+
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 1)
+	mfa.Notifier = alerts
+	mfa.OIDC = &oidc.Provider{
+		Issuer:      issuer.URL,
+		ClientID:    "gatekeeper",
+		RedirectURL: "https://gatekeeper.example.com/api/oidc/callback",
+		Scopes:      []string{"profile", "groups"},
+	}
+	mfa.OIDCUsernameClaim = "preferred_username"
+	mfa.OIDCGroupsClaim = "groups"
+	mfa.OIDCRoutes = []OIDCRoute{
+		{Name: "rdp", Groups: []string{"ops"}, GrantTTL: 2 * time.Hour},
+		{Name: "ssh", Groups: []string{OIDCAnyGroup}},
+	}
+	return mfa, issuer, alerts
+}
+
+// starts signing in for a route from an address, returning the callback
+// request the issuer sends the browser back with
+func startOIDCSignIn(t *testing.T, mfa *MultiFactorAuth, route string, remoteAddr string) *http.Request {
+	request := httptest.NewRequest("GET", "/api/oidc/login?route="+route, nil)
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	mfa.HandleOIDCLogin(recorder, request)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected to be sent to the issuer, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || response.StatusCode != http.StatusFound {
+		t.Fatalf("expected the issuer to send the browser back, got %s", response.Status)
+	}
+
+	request = httptest.NewRequest("GET", callback.RequestURI(), nil)
+	request.RemoteAddr = remoteAddr
+	for _, cookie := range recorder.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+// finishes signing in with the callback request
+func finishOIDCSignIn(mfa *MultiFactorAuth, callback *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	mfa.HandleOIDCCallback(recorder, callback)
+	return recorder
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	mfa, issuer, alerts := newTestOIDCMFA(t)
+	issuer.SetClaims(map[string]interface{}{"sub": "1234", "preferred_username": "alice", "groups": []string{"ops"}})
+
+	recorder := finishOIDCSignIn(mfa, startOIDCSignIn(t, mfa, "rdp", "192.0.2.1:1234"))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected to be signed in, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	// the grant is only for the route signed in for, for its grant ttl
+	entries := mfa.ProxyAuthHandler.Entries()
+	if len(entries) != 1 || entries[0].Address != "192.0.2.1" || entries[0].User != "alice" || entries[0].Expires == nil || time.Until(*entries[0].Expires) > 2*time.Hour {
+		t.Errorf("unexpected whitelist %+v", entries)
+	}
+	if user, whitelisted := mfa.WhitelistedUser("192.0.2.1", "rdp"); !whitelisted || user != "alice" {
+		t.Errorf("expected alice to be whitelisted on rdp, got %q %v", user, whitelisted)
+	}
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "ssh"); whitelisted {
+		t.Error("expected alice not to be whitelisted on ssh without signing in for it")
+	}
+
+	select {
+	case alert := <-alerts:
+		if alert.Kind != AlertSelfAuthorized || alert.User != "alice" || alert.Route != "rdp" || alert.GrantTTL != "2h0m0s" {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the administrators to be alerted")
+	}
+}
+
+func TestOIDCGroupsLimitRoutes(t *testing.T) {
+	mfa, issuer, _ := newTestOIDCMFA(t)
+	issuer.SetClaims(map[string]interface{}{"sub": "5678", "groups": "dev"})
+
+	if recorder := finishOIDCSignIn(mfa, startOIDCSignIn(t, mfa, "rdp", "192.0.2.1:1234")); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected a user outside ops to be refused on rdp, got %d", recorder.Code)
+	}
+	if mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Fatal("a refused user should not have been whitelisted")
+	}
+
+	// everyone may use ssh, and a user without a username claim is named by their subject
+	if recorder := finishOIDCSignIn(mfa, startOIDCSignIn(t, mfa, "ssh", "192.0.2.1:1234")); recorder.Code != http.StatusOK {
+		t.Fatalf("expected anyone to be allowed on ssh, got %d", recorder.Code)
+	}
+	if user, whitelisted := mfa.WhitelistedUser("192.0.2.1", "ssh"); !whitelisted || user != "5678" {
+		t.Errorf("expected the user to be whitelisted on ssh by their subject, got %q %v", user, whitelisted)
+	}
+
+	// routes which do not allow OIDC cannot be signed in for
+	request := httptest.NewRequest("GET", "/api/oidc/login?route=web", nil)
+	recorder := httptest.NewRecorder()
+	mfa.HandleOIDCLogin(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a route without OIDC, got %d", recorder.Code)
+	}
+}
+
+func TestOIDCCallbackNeedsTheBrowserWhichStarted(t *testing.T) {
+	mfa, _, _ := newTestOIDCMFA(t)
+
+	// a callback without the state cookie could be someone else's sign in
+	callback := startOIDCSignIn(t, mfa, "ssh", "192.0.2.1:1234")
+	callback.Header.Del("Cookie")
+	if recorder := finishOIDCSignIn(mfa, callback); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without the state cookie, got %d", recorder.Code)
+	}
+
+	// as could one from another IP address
+	callback = startOIDCSignIn(t, mfa, "ssh", "192.0.2.1:1234")
+	callback.RemoteAddr = "192.0.2.2:1234"
+	if recorder := finishOIDCSignIn(mfa, callback); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 from another IP address, got %d", recorder.Code)
+	}
+
+	// and a sign in can only be finished once
+	callback = startOIDCSignIn(t, mfa, "ssh", "192.0.2.1:1234")
+	if recorder := finishOIDCSignIn(mfa, callback); recorder.Code != http.StatusOK {
+		t.Fatalf("expected to be signed in, got %d", recorder.Code)
+	}
+	if recorder := finishOIDCSignIn(mfa, callback); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a replayed callback, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,119 @@
+package authentication
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// the approvals a request needing a quorum of administrators has collected
+type approval struct {
+	approvedBy []string  // the administrators who have approved the request so far
+	created    time.Time // when the personal codes of the request were generated, so the approval expires with them
+}
+
+// generates the codes of a request, the caller must hold the mutex - a request
+// on a route needing more than one approval gets a personal code for every
+// administrator, so that each approval is recorded against whoever gave it,
+// while any other request gets a single code anyone alerted can use
+func (mfa *MultiFactorAuth) generateCodes(request AuthRequest) (map[string]AuthRequest, error) {
+	quorum := mfa.Quorums[request.Route]
+	if quorum <= 1 {
+		code, err := mfa.generateCode(request)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]AuthRequest{code: mfa.AuthCodes[code]}, nil
+	}
+
+	approvers := distinct(mfa.Approvers)
+	if len(approvers) < quorum {
+		log.Printf("[%s] Only %d administrators to approve %s, but %d approvals are needed\n", request.Route, len(approvers), request.IP, quorum)
+		return nil, nil
+	}
+
+	// the personal codes share an approval ID, which their approvals are collected under
+	id, err := generateAccessID()
+	if err != nil {
+		return nil, err
+	}
+	request.Quorum, request.Approval = quorum, id
+
+	codes := map[string]AuthRequest{}
+	for _, approver := range approvers {
+		request.Approver = approver
+		code, err := mfa.generateCode(request)
+		if err != nil {
+			return nil, err
+		}
+		codes[code] = mfa.AuthCodes[code]
+	}
+	mfa.approvals[id] = &approval{created: time.Now()}
+	return codes, nil
+}
+
+// records the approval of a personal code whose code has already been taken,
+// returning the administrators who have approved its request so far and
+// whether or not they are enough - once they are, the personal codes of the
+// other administrators stop working
+func (mfa *MultiFactorAuth) recordApproval(request AuthRequest) ([]string, bool) {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	a, found := mfa.approvals[request.Approval]
+	if !found {
+		// the request has expired or been denied since the code was taken
+		return nil, false
+	}
+	a.approvedBy = append(a.approvedBy, request.Approver)
+	approvedBy := append([]string{}, a.approvedBy...)
+	if len(approvedBy) < request.Quorum {
+		return approvedBy, false
+	}
+	mfa.dropApproval(request.Approval)
+	return approvedBy, true
+}
+
+// removes the approvals of a request and the personal codes which have not
+// been used yet, so that nobody else can approve it - the caller must hold the mutex
+func (mfa *MultiFactorAuth) dropApproval(id string) {
+	delete(mfa.approvals, id)
+	for code, request := range mfa.AuthCodes {
+		if request.Approval == id {
+			delete(mfa.AuthCodes, code)
+		}
+	}
+}
+
+// describes who approved a request for the whitelist and logs
+func describeApprovers(approvers []string) string {
+	if len(approvers) == 0 {
+		return "email approval"
+	}
+	description := "approved by "
+	for i, approver := range approvers {
+		if i > 0 {
+			description += ", "
+		}
+		description += approver
+	}
+	return description
+}
+
+// returns the values of a list without repeats, in their first order
+func distinct(values []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// describes how far a request needing a quorum has got, for the approver
+func describeQuorum(approvers []string, quorum int) string {
+	return fmt.Sprintf("approval recorded, %d of %d administrators have approved", len(approvers), quorum)
+}
@@ -0,0 +1,181 @@
+package authentication
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns an MFA whose rdp route needs two of three administrators to approve
+func newTestQuorumMFA(t *testing.T) (*MultiFactorAuth, channelNotifier) {
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 3)
+	mfa.Notifier = alerts
+	mfa.Approvers = []string{"alice@example.com", "bob@example.com", "carol@example.com", "alice@example.com"}
+	mfa.Quorums = map[string]int{"rdp": 2}
+	return mfa, alerts
+}
+
+// makes a connection attempt, returning the personal code of every administrator
+func personalCodes(t *testing.T, mfa *MultiFactorAuth, alerts channelNotifier, request AuthRequest) map[string]string {
+	if mfa.IsAuthenticated(request) {
+		t.Fatal("expected the attempt not to be authenticated")
+	}
+	codes := map[string]string{}
+	for i := 0; i < 3; i++ {
+		alert, code := alertCode(t, alerts)
+		if alert.Quorum != 2 || alert.Approver == "" || codes[alert.Approver] != "" {
+			t.Fatalf("unexpected alert %+v", alert)
+		}
+		codes[alert.Approver] = code
+	}
+	return codes
+}
+
+// uses a code on the approve or deny route, returning the response
+func useCode(mfa *MultiFactorAuth, path string, code string) string {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", path+"?code="+code, nil)
+	if path == "/api/deny" {
+		mfa.HandleDeny(recorder, request)
+	} else {
+		mfa.HandleAuthenticate(recorder, request)
+	}
+	return recorder.Body.String()
+}
+
+func TestQuorumNeedsDistinctApprovers(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+	codes := personalCodes(t, mfa, alerts, AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if len(codes) != 3 {
+		t.Fatalf("expected a personal code for each administrator, got %v", codes)
+	}
+
+	// one approval is not enough, and cannot be given twice
+	if response := useCode(mfa, "/api/authenticate", codes["alice@example.com"]); !strings.Contains(response, "1 of 2") {
+		t.Errorf("expected the approval to be recorded, got %q", response)
+	}
+	if mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Fatal("expected one approval not to whitelist the IP")
+	}
+	if response := useCode(mfa, "/api/authenticate", codes["alice@example.com"]); response != "invalid code" {
+		t.Errorf("expected a personal code to be single-use, got %q", response)
+	}
+
+	// a second administrator reaches the quorum, after which the last code stops working
+	if response := useCode(mfa, "/api/authenticate", codes["bob@example.com"]); response != "success" {
+		t.Fatalf("expected the quorum to whitelist the IP, got %q", response)
+	}
+	entries := mfa.ProxyAuthHandler.Entries()
+	if len(entries) != 1 || entries[0].AddedBy != "approved by alice@example.com, bob@example.com" {
+		t.Errorf("expected the approvers to be recorded, got %+v", entries)
+	}
+	if response := useCode(mfa, "/api/authenticate", codes["carol@example.com"]); response != "invalid code" {
+		t.Errorf("expected the remaining code to stop working, got %q", response)
+	}
+
+	// routes without a quorum still send a single code anyone can use
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.2", Route: "ssh"})
+	if alert, _ := alertCode(t, alerts); alert.Approver != "" || alert.Quorum != 0 {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+}
+
+func TestApprovalDoesNotSkipQuorum(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+
+	// one administrator approving the IP on ssh, which needs one approval
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "ssh"})
+	_, code := alertCode(t, alerts)
+	if response := useCode(mfa, "/api/authenticate", code); response != "success" {
+		t.Fatalf("expected the IP to be whitelisted on ssh, got %q", response)
+	}
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "ssh"); !whitelisted {
+		t.Fatal("expected the IP to be whitelisted on ssh")
+	}
+
+	// does not let it onto rdp, which still needs two
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "rdp"); whitelisted {
+		t.Error("expected an approval on ssh not to whitelist the IP on rdp")
+	}
+	codes := personalCodes(t, mfa, alerts, AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	useCode(mfa, "/api/authenticate", codes["alice@example.com"])
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "rdp"); whitelisted {
+		t.Error("expected one approval not to whitelist the IP on rdp")
+	}
+	useCode(mfa, "/api/authenticate", codes["carol@example.com"])
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "rdp"); !whitelisted {
+		t.Error("expected the quorum to whitelist the IP on rdp")
+	}
+}
+
+func TestQuorumIgnoresApproverTTL(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+	codes := personalCodes(t, mfa, alerts, AuthRequest{IP: "192.0.2.1", Route: "rdp", GrantTTL: time.Hour})
+
+	// the approver completing the quorum cannot make the grant permanent
+	useCode(mfa, "/api/authenticate", codes["alice@example.com"])
+	if response := useCode(mfa, "/api/authenticate", codes["bob@example.com"]+"&ttl=0"); response != "success" {
+		t.Fatalf("expected the quorum to whitelist the IP, got %q", response)
+	}
+	entries := mfa.ProxyAuthHandler.Entries()
+	if len(entries) != 1 || entries[0].Expires == nil || time.Until(*entries[0].Expires) > time.Hour {
+		t.Errorf("expected the grant to last for the alerted ttl, got %+v", entries)
+	}
+}
+
+func TestQuorumDenied(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+	codes := personalCodes(t, mfa, alerts, AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+
+	useCode(mfa, "/api/authenticate", codes["alice@example.com"])
+	if response := useCode(mfa, "/api/deny", codes["bob@example.com"]); response != "denied" {
+		t.Fatalf("expected the request to be denied, got %q", response)
+	}
+
+	// nobody else can approve a denied request
+	if response := useCode(mfa, "/api/authenticate", codes["carol@example.com"]); response != "invalid code" {
+		t.Errorf("expected the remaining code to stop working, got %q", response)
+	}
+	if mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Error("expected a denied request not to be whitelisted")
+	}
+}
+
+func TestQuorumExpires(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+	mfa.CodeTTL = 50 * time.Millisecond
+	codes := personalCodes(t, mfa, alerts, AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+
+	// approvals must all be given within the code ttl
+	useCode(mfa, "/api/authenticate", codes["alice@example.com"])
+	time.Sleep(60 * time.Millisecond)
+	if response := useCode(mfa, "/api/authenticate", codes["bob@example.com"]); response != "invalid code" {
+		t.Errorf("expected an approval after the code ttl to be rejected, got %q", response)
+	}
+	if mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Error("expected an expired quorum not to whitelist the IP")
+	}
+
+	mfa.RemoveExpired()
+	if len(mfa.approvals) != 0 || len(mfa.AuthCodes) != 0 {
+		t.Errorf("expected the expired approval to be removed, got %v %v", mfa.approvals, mfa.AuthCodes)
+	}
+}
+
+func TestQuorumNeedsEnoughApprovers(t *testing.T) {
+	mfa, alerts := newTestQuorumMFA(t)
+	mfa.Quorums["rdp"] = 4
+
+	// with too few administrators to ever reach the quorum no codes are sent
+	mfa.IsAuthenticated(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if len(mfa.AuthCodes) != 0 {
+		t.Errorf("expected no codes, got %v", mfa.AuthCodes)
+	}
+	select {
+	case alert := <-alerts:
+		t.Errorf("unexpected alert %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
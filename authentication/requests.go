@@ -0,0 +1,328 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the states an access request goes through
+const (
+	AccessPending  = "pending"  // waiting for an administrator to approve or deny it
+	AccessApproved = "approved" // an administrator approved it and the IP address is whitelisted
+	AccessDenied   = "denied"   // an administrator denied it
+	AccessExpired  = "expired"  // nobody answered it before its code expired
+)
+
+// how long an answered access request can still be watched
+const accessRequestRetention = time.Hour
+
+// the longest reason an access request may give, so the alerts stay readable
+const maxAccessReasonLength = 500
+
+// a request for access made on the access request page, which the
+// requester watches until an administrator approves or denies it
+type AccessRequest struct {
+	ID       string     `json:"id"`                // the random ID the requester watches the request by
+	IP       string     `json:"ip"`                // the IP address access was requested for
+	Route    string     `json:"route"`             // the name of the route access was requested to
+	User     string     `json:"user,omitempty"`    // the registered user who asked, empty if they gave no name
+	Reason   string     `json:"reason"`            // why the user asked for access
+	GrantTTL string     `json:"grantTTL"`          // how long access was requested for
+	Status   string     `json:"status"`            // the state of the request, e.g. AccessPending
+	Created  time.Time  `json:"created"`           // when the request was made
+	Updated  time.Time  `json:"updated"`           // when the request last changed state
+	Deadline time.Time  `json:"deadline"`          // when the request expires if nobody answers it
+	Expires  *time.Time `json:"expires,omitempty"` // when the approved access ends, nil if it does not or was not approved
+}
+
+// the access request page, a form which posts back to itself and a status
+// view which polls for the request's status until it has been answered
+var accessRequestPage = template.Must(template.New("request").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Gatekeeper</title>
+{{if .Request}}{{if eq .Request.Status "pending"}}<noscript><meta http-equiv="refresh" content="5"></noscript>{{end}}{{end}}</head>
+<body>
+{{with .Request}}
+<h1>Access to {{.Route}} from {{.IP}}</h1>
+<p id="status">{{$.Message}}</p>
+<p>Requested for {{.GrantTTL}} because: {{.Reason}}</p>
+{{if eq .Status "pending"}}<script>
+(function poll() {
+	setTimeout(function () {
+		fetch("request/status?id={{.ID}}").then(function (response) {
+			return response.json();
+		}).then(function (request) {
+			document.getElementById("status").textContent = request.message;
+			if (request.status === "pending") {
+				poll();
+			}
+		}, poll);
+	}, 2000);
+})();
+</script>{{end}}
+{{else}}
+<h1>Request access from {{.IP}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="post">
+<p><label>Route <select name="route">{{range .Routes}}<option{{if eq . $.Route}} selected{{end}}>{{.}}</option>{{end}}</select></label></p>
+{{if .Users}}<p><label>Name <input name="name" value="{{.Name}}" autocomplete="username"></label> (optional)</p>{{end}}
+<p><label>Reason <textarea name="reason" maxlength="500" required>{{.Reason}}</textarea></label></p>
+<p><label>For <input name="ttl" value="{{.TTL}}" placeholder="e.g. 2h" required></label></p>
+<p><button type="submit">Request access</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// the data the access request page is rendered with
+type accessRequestPageData struct {
+	IP, Route, Name, Reason, TTL, Message string
+	Routes                                []string
+	Users                                 bool
+	Request                               *AccessRequest
+}
+
+// handler function for our /api/request route - a GET shows the form, or the
+// status of the request with the "id" form value, and a POST asks the
+// administrators for access for the IP address of the request
+func (mfa *MultiFactorAuth) HandleAccessRequest(w http.ResponseWriter, r *http.Request) {
+	data := accessRequestPageData{
+		IP:     mfa.ClientIP(r),
+		Routes: mfa.RequestRoutes,
+		Users:  mfa.Users != nil,
+		TTL:    "1h",
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.FormValue("id"); id != "" {
+			request, found := mfa.AccessRequestStatus(id)
+			if !found {
+				http.Error(w, "unknown access request", http.StatusNotFound)
+				return
+			}
+			data.Request, data.Message = &request, describeAccessRequest(request)
+		}
+	case http.MethodPost:
+		data.Route = r.FormValue("route")
+		data.Name = strings.TrimSpace(r.FormValue("name"))
+		data.Reason = strings.TrimSpace(r.FormValue("reason"))
+		data.TTL = strings.TrimSpace(r.FormValue("ttl"))
+		id, status, message := mfa.requestAccess(data.IP, data.Route, data.Name, data.Reason, data.TTL)
+		if id != "" {
+			// the requester is sent on to the status of their request, so
+			// refreshing the page does not ask for access a second time
+			http.Redirect(w, r, "request?id="+url.QueryEscape(id), http.StatusSeeOther)
+			return
+		}
+		data.Message = message
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_ = accessRequestPage.Execute(w, data)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = accessRequestPage.Execute(w, data)
+}
+
+// handler function for our /api/request/status route, which the status
+// page polls - it writes the request with the "id" form value as JSON
+func (mfa *MultiFactorAuth) HandleAccessRequestStatus(w http.ResponseWriter, r *http.Request) {
+	request, found := mfa.AccessRequestStatus(r.FormValue("id"))
+	if !found {
+		http.Error(w, "unknown access request", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(struct {
+		AccessRequest
+		Message string `json:"message"`
+	}{request, describeAccessRequest(request)})
+}
+
+// asks the administrators for access to a route for an IP address, returning
+// the ID of the access request to watch, or the status and message to answer
+// the requester with if access could not be requested
+func (mfa *MultiFactorAuth) requestAccess(ip string, route string, name string, reason string, value string) (string, int, string) {
+	known := false
+	for _, r := range mfa.RequestRoutes {
+		known = known || r == route
+	}
+	if !known {
+		return "", http.StatusBadRequest, "Choose a route to request access to."
+	}
+	if reason == "" || len(reason) > maxAccessReasonLength {
+		return "", http.StatusBadRequest, fmt.Sprintf("Give a reason of at most %d characters.", maxAccessReasonLength)
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return "", http.StatusBadRequest, "Give how long you need access for, e.g. 2h."
+	}
+	if mfa.MaxRequestTTL > 0 && ttl > mfa.MaxRequestTTL {
+		return "", http.StatusBadRequest, fmt.Sprintf("Access can be requested for at most %s.", mfa.MaxRequestTTL)
+	}
+
+	// a name is only taken from users who could have been approved by email
+	// for the route anyway, and is not proof of who is asking
+	request := AuthRequest{IP: ip, Route: route, GrantTTL: ttl, Reason: reason}
+	if name != "" && mfa.Users != nil {
+		user, registered := mfa.Users.Get(name)
+		if !registered || !user.AllowsRoute(route) || !user.AllowsMFA(MFAEmail) {
+			return "", http.StatusBadRequest, "There is no such user who may request access to this route."
+		}
+		request.User, request.IdentifiedBy = user.Name, IdentifiedByUsername
+	}
+
+	// without a notifier nobody could ever approve the request
+	if mfa.Notifier == nil {
+		log.Printf("[%s] No notifiers configured, cannot send alert for %s\n", route, ip)
+		return "", http.StatusServiceUnavailable, "Nobody can be asked for access right now."
+	}
+
+	mfa.mutex.Lock()
+	if mfa.isBlocked(ip) {
+		mfa.mutex.Unlock()
+		log.Printf("[%s] Access request from %s refused - IP address is blocklisted\n", route, ip)
+		return "", http.StatusForbidden, "Access from your IP address has been denied."
+	}
+
+	// a pending request for the route is watched rather than asked again, while
+	// a pending connection attempt for it becomes this request so the
+	// administrators get the reason with it
+	now := time.Now()
+	codes := map[string]AuthRequest{}
+	for c, pending := range mfa.AuthCodes {
+		if pending.IP != ip || pending.Route != route || mfa.isCodeExpired(pending, now) {
+			continue
+		}
+		if pending.AccessID != "" {
+			mfa.mutex.Unlock()
+			return pending.AccessID, http.StatusOK, ""
+		}
+		if request.User == "" {
+			request.User, request.IdentifiedBy = pending.User, pending.IdentifiedBy
+		}
+		codes[c] = pending
+	}
+
+	request.AccessID, err = generateAccessID()
+	if err != nil {
+		panic(err)
+	}
+	if len(codes) == 0 {
+		if codes, err = mfa.generateCodes(request); err != nil {
+			panic(err)
+		}
+		if len(codes) == 0 {
+			mfa.mutex.Unlock()
+			return "", http.StatusServiceUnavailable, "Nobody can be asked for access right now."
+		}
+	}
+
+	// every personal code of a route needing several approvals
+	// carries the request, keeping who it belongs to
+	for c, pending := range codes {
+		pending.GrantTTL, pending.Reason, pending.AccessID = ttl, reason, request.AccessID
+		pending.User, pending.IdentifiedBy = request.User, request.IdentifiedBy
+		mfa.AuthCodes[c], codes[c] = pending, pending
+		request.Created = pending.Created
+	}
+	mfa.accessRequests[request.AccessID] = &AccessRequest{
+		ID:       request.AccessID,
+		IP:       ip,
+		Route:    route,
+		User:     request.User,
+		Reason:   reason,
+		GrantTTL: describeTTL(ttl),
+		Status:   AccessPending,
+		Created:  now,
+		Updated:  now,
+		Deadline: request.Created.Add(mfa.CodeTTL),
+	}
+	mfa.mutex.Unlock()
+
+	log.Printf("[%s] Access requested from %s for %s\n", route, DescribeClient(ip, request.User), describeTTL(ttl))
+	for code, pending := range codes {
+		go mfa.sendAlert(pending, code)
+	}
+	return request.AccessID, http.StatusOK, ""
+}
+
+// returns the access request with an ID as it stands now
+func (mfa *MultiFactorAuth) AccessRequestStatus(id string) (AccessRequest, bool) {
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	request, found := mfa.accessRequests[id]
+	if !found {
+		return AccessRequest{}, false
+	}
+	if request.Status == AccessPending && !time.Now().Before(request.Deadline) {
+		request.Status, request.Updated = AccessExpired, request.Deadline
+	}
+	return *request, true
+}
+
+// records the answer to the access request of an approved or denied code
+func (mfa *MultiFactorAuth) resolveAccessRequest(request AuthRequest, status string, ttl time.Duration) {
+	if request.AccessID == "" {
+		return
+	}
+	mfa.mutex.Lock()
+	defer mfa.mutex.Unlock()
+
+	access, found := mfa.accessRequests[request.AccessID]
+	if !found {
+		return
+	}
+	now := time.Now()
+	access.Status, access.Updated = status, now
+	if status == AccessApproved {
+		access.GrantTTL = describeTTL(ttl)
+		if ttl > 0 {
+			expires := now.Add(ttl)
+			access.Expires = &expires
+		}
+	}
+}
+
+// describes the status of an access request to the requester
+func describeAccessRequest(request AccessRequest) string {
+	switch request.Status {
+	case AccessApproved:
+		if request.Expires == nil {
+			return fmt.Sprintf("Approved - you can now connect to %s.", request.Route)
+		}
+		return fmt.Sprintf("Approved - you can now connect to %s until %s.", request.Route, request.Expires.Format(time.RFC1123))
+	case AccessDenied:
+		return "Your request was denied."
+	case AccessExpired:
+		return "Nobody answered your request in time, you can make a new one."
+	}
+	return fmt.Sprintf("Waiting for an administrator to answer your request, which expires at %s.", request.Deadline.Format(time.RFC1123))
+}
+
+// generates the random 128 bit ID an access request is watched by, which is
+// separate from its code so that watching a request cannot approve it
+func generateAccessID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,203 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns an MFA serving the access request page for the rdp and ssh routes
+func newTestAccessMFA(t *testing.T) (*MultiFactorAuth, channelNotifier) {
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 1)
+	mfa.Notifier = alerts
+	mfa.AccessRequests = true
+	mfa.RequestRoutes = []string{"rdp", "ssh"}
+	mfa.MaxRequestTTL = 24 * time.Hour
+	return mfa, alerts
+}
+
+// submits the access request page from an address, returning the
+// response and the ID of the access request it was sent on to watch
+func submitAccessRequest(mfa *MultiFactorAuth, remoteAddr string, form url.Values) (*httptest.ResponseRecorder, string) {
+	request := httptest.NewRequest("POST", "/api/request", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	mfa.HandleAccessRequest(recorder, request)
+
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	if location == nil {
+		return recorder, ""
+	}
+	return recorder, location.Query().Get("id")
+}
+
+// returns the status of an access request as the status page sees it
+func accessRequestStatus(t *testing.T, mfa *MultiFactorAuth, id string) string {
+	recorder := httptest.NewRecorder()
+	mfa.HandleAccessRequestStatus(recorder, httptest.NewRequest("GET", "/api/request/status?id="+url.QueryEscape(id), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the status of %s, got %d", id, recorder.Code)
+	}
+	var status struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status.Status
+}
+
+// returns the code of the approve link of an alert
+func alertCode(t *testing.T, alerts channelNotifier) (Alert, string) {
+	select {
+	case alert := <-alerts:
+		link, err := url.Parse(alert.ApproveURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return alert, link.Query().Get("code")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the administrators to be alerted")
+	}
+	return Alert{}, ""
+}
+
+func TestAccessRequestApproved(t *testing.T) {
+	mfa, alerts := newTestAccessMFA(t)
+
+	// the form offers every route
+	recorder := httptest.NewRecorder()
+	mfa.HandleAccessRequest(recorder, httptest.NewRequest("GET", "/api/request", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "<option>ssh</option>") {
+		t.Errorf("expected the form, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	form := url.Values{"route": {"rdp"}, "reason": {"fixing the build server"}, "ttl": {"2h"}}
+	recorder, id := submitAccessRequest(mfa, "192.0.2.1:1234", form)
+	if recorder.Code != http.StatusSeeOther || id == "" {
+		t.Fatalf("expected to be sent on to the request's status, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	alert, code := alertCode(t, alerts)
+	if alert.Kind != AlertAccessRequest || alert.IP != "192.0.2.1" || alert.Route != "rdp" || alert.Reason != "fixing the build server" || alert.GrantTTL != "2h0m0s" {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+	if code == id || code == "" {
+		t.Error("expected the request to be watched by something other than its code")
+	}
+	if status := accessRequestStatus(t, mfa, id); status != AccessPending {
+		t.Errorf("expected the request to be pending, got %s", status)
+	}
+
+	// asking again while the request is pending watches the same request
+	if _, again := submitAccessRequest(mfa, "192.0.2.1:1234", form); again != id {
+		t.Errorf("expected the pending request %s to be watched, got %s", id, again)
+	}
+
+	recorder = httptest.NewRecorder()
+	mfa.HandleAuthenticate(recorder, httptest.NewRequest("GET", "/api/authenticate?code="+code, nil))
+	if recorder.Body.String() != "success" {
+		t.Fatalf("expected the request to be approved, got %q", recorder.Body.String())
+	}
+	if status := accessRequestStatus(t, mfa, id); status != AccessApproved {
+		t.Errorf("expected the request to be approved, got %s", status)
+	}
+	entries := mfa.ProxyAuthHandler.Entries()
+	if len(entries) != 1 || entries[0].Address != "192.0.2.1" || entries[0].Expires == nil || time.Until(*entries[0].Expires) > 2*time.Hour {
+		t.Errorf("expected the IP address to be whitelisted for the requested 2h, got %+v", entries)
+	}
+
+	// the approval only opens the route access was requested to
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "rdp"); !whitelisted {
+		t.Error("expected the IP address to be whitelisted on rdp")
+	}
+	if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", "ssh"); whitelisted {
+		t.Error("expected a request for rdp not to whitelist the IP address on ssh")
+	}
+
+	// the status page shows the answer
+	recorder = httptest.NewRecorder()
+	mfa.HandleAccessRequest(recorder, httptest.NewRequest("GET", "/api/request?id="+url.QueryEscape(id), nil))
+	if !strings.Contains(recorder.Body.String(), "Approved") {
+		t.Errorf("expected the status page to show the approval, got %q", recorder.Body.String())
+	}
+}
+
+func TestAccessRequestDenied(t *testing.T) {
+	mfa, alerts := newTestAccessMFA(t)
+	mfa.DenyBlockTTL = time.Hour
+
+	// a connection attempt is pending when the user asks for access, so
+	// the attempt becomes the request rather than alerting twice
+	attempt, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "ssh", GrantTTL: 12 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, id := submitAccessRequest(mfa, "192.0.2.1:1234", url.Values{"route": {"ssh"}, "reason": {"on call"}, "ttl": {"30m"}})
+	if id == "" {
+		t.Fatal("expected the access request to be made")
+	}
+	if _, code := alertCode(t, alerts); code != attempt {
+		t.Errorf("expected the pending attempt's code to be sent again, got %s", code)
+	}
+	if request, _ := mfa.GetCodeRequest(attempt); request.Reason != "on call" || request.GrantTTL != 30*time.Minute {
+		t.Errorf("expected the attempt to carry the request, got %+v", request)
+	}
+
+	recorder := httptest.NewRecorder()
+	mfa.HandleDeny(recorder, httptest.NewRequest("GET", "/api/deny?code="+attempt, nil))
+	if recorder.Body.String() != "denied" {
+		t.Fatalf("expected the request to be denied, got %q", recorder.Body.String())
+	}
+	if status := accessRequestStatus(t, mfa, id); status != AccessDenied {
+		t.Errorf("expected the request to be denied, got %s", status)
+	}
+
+	// the blocklisted IP address cannot ask again
+	if recorder, _ := submitAccessRequest(mfa, "192.0.2.1:1234", url.Values{"route": {"ssh"}, "reason": {"on call"}, "ttl": {"30m"}}); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 once blocklisted, got %d", recorder.Code)
+	}
+}
+
+func TestAccessRequestExpires(t *testing.T) {
+	mfa, alerts := newTestAccessMFA(t)
+	mfa.CodeTTL = 50 * time.Millisecond
+
+	_, id := submitAccessRequest(mfa, "192.0.2.1:1234", url.Values{"route": {"rdp"}, "reason": {"testing"}, "ttl": {"1h"}})
+	alertCode(t, alerts)
+	time.Sleep(100 * time.Millisecond)
+	if status := accessRequestStatus(t, mfa, id); status != AccessExpired {
+		t.Errorf("expected the unanswered request to expire, got %s", status)
+	}
+}
+
+func TestInvalidAccessRequests(t *testing.T) {
+	mfa, _ := newTestAccessMFA(t)
+	registerTestUsers(t, mfa, User{Name: "alice", Routes: []string{"ssh"}})
+
+	for _, form := range []url.Values{
+		{"route": {"web"}, "reason": {"testing"}, "ttl": {"1h"}},                    // not a route access can be requested to
+		{"route": {"rdp"}, "reason": {""}, "ttl": {"1h"}},                           // no reason
+		{"route": {"rdp"}, "reason": {strings.Repeat("a", 501)}, "ttl": {"1h"}},     // too long a reason
+		{"route": {"rdp"}, "reason": {"testing"}, "ttl": {"forever"}},               // not a duration
+		{"route": {"rdp"}, "reason": {"testing"}, "ttl": {"48h"}},                   // longer than the MaxRequestTTL
+		{"route": {"rdp"}, "reason": {"testing"}, "ttl": {"1h"}, "name": {"alice"}}, // alice may not use rdp
+	} {
+		if recorder, id := submitAccessRequest(mfa, "192.0.2.1:1234", form); recorder.Code != http.StatusBadRequest || id != "" {
+			t.Errorf("expected %v to be rejected, got %d", form, recorder.Code)
+		}
+	}
+
+	// nobody can watch a request which does not exist
+	recorder := httptest.NewRecorder()
+	mfa.HandleAccessRequestStatus(recorder, httptest.NewRequest("GET", "/api/request/status?id=unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown request, got %d", recorder.Code)
+	}
+}
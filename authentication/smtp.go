@@ -0,0 +1,73 @@
+package authentication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+// the TLS modes an SMTP connection can use
+const (
+	SMTPStartTLS = "starttls" // upgrade a plain connection with STARTTLS, failing if unsupported
+	SMTPImplicit = "tls"      // connect over TLS from the start, usually on port 465
+	SMTPNoTLS    = "none"     // send in plain text, only for local relays and testing
+)
+
+// settings used to send alert emails through an SMTP server
+type SMTPSettings struct {
+	Host               string // the hostname of the SMTP server
+	Port               int    // the port of the SMTP server
+	Username           string // the username to authenticate with, empty to not authenticate
+	Password           string // the password to authenticate with
+	From               string // the sender of alert emails
+	TLSMode            string // one of SMTPStartTLS, SMTPImplicit or SMTPNoTLS
+	CAFile             string // optional path to a PEM bundle of CAs to verify the server with
+	InsecureSkipVerify bool   // disables verification of the server's certificate
+}
+
+// builds a gomail dialer from the settings, loading the CA bundle if one is configured
+func (s *SMTPSettings) Dialer() (*gomail.Dialer, error) {
+	if s.Host == "" {
+		return nil, fmt.Errorf("no SMTP host configured")
+	}
+
+	// the server's certificate is verified against its hostname
+	// and either the system pool or the configured CA bundle
+	tlsConfig := &tls.Config{
+		ServerName:         s.Host,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := gomail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	dialer.TLSConfig = tlsConfig
+
+	// configures how the connection is encrypted
+	switch s.TLSMode {
+	case SMTPStartTLS, "":
+		dialer.SSL = false
+		dialer.StartTLSPolicy = gomail.MandatoryStartTLS
+	case SMTPImplicit:
+		dialer.SSL = true
+	case SMTPNoTLS:
+		dialer.SSL = false
+		dialer.StartTLSPolicy = gomail.NoStartTLS
+	default:
+		return nil, fmt.Errorf("unknown SMTP tls mode %q", s.TLSMode)
+	}
+
+	return dialer, nil
+}
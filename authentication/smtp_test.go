@@ -0,0 +1,148 @@
+package authentication
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a minimal SMTP stand-in server which accepts every message
+// and sends the DATA of each one down a channel
+type fakeSMTPServer struct {
+	listener net.Listener
+	messages chan string
+	startTLS bool // whether or not STARTTLS is advertised
+}
+
+func newFakeSMTPServer(t *testing.T, startTLS bool) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTPServer{listener: listener, messages: make(chan string, 16), startTLS: startTLS}
+	go server.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return server
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP fake")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			if s.startTLS {
+				reply("250-localhost")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 localhost")
+			}
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.messages <- data.String()
+			reply("250 queued")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSendEmailAlertsThroughLocalServer(t *testing.T) {
+	server := newFakeSMTPServer(t, false)
+
+	mfa := newTestMFA(t)
+	mfa.Notifier = &EmailNotifier{
+		Emails: []string{"admin@example.com"},
+		SMTP: SMTPSettings{
+			Host:    "127.0.0.1",
+			Port:    server.port(),
+			From:    "Gatekeeper <alerts@example.com>",
+			TLSMode: SMTPNoTLS,
+		},
+	}
+
+	mfa.SendAlerts(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+
+	select {
+	case message := <-server.messages:
+		if !strings.Contains(message, "192.0.2.1") {
+			t.Errorf("alert does not mention the IP address:\n%s", message)
+		}
+		if !strings.Contains(message, "alerts@example.com") {
+			t.Errorf("alert is not sent from the configured sender:\n%s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received by the SMTP server")
+	}
+
+	if len(mfa.AuthCodes) != 1 {
+		t.Errorf("expected 1 pending code, got %d", len(mfa.AuthCodes))
+	}
+}
+
+func TestMandatoryStartTLS(t *testing.T) {
+	server := newFakeSMTPServer(t, false)
+
+	settings := SMTPSettings{
+		Host:    "127.0.0.1",
+		Port:    server.port(),
+		From:    "alerts@example.com",
+		TLSMode: SMTPStartTLS,
+	}
+	dialer, err := settings.Dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server does not advertise STARTTLS so the dial must fail
+	// rather than sending credentials in plain text
+	if closer, err := dialer.Dial(); err == nil {
+		_ = closer.Close()
+		t.Error("expected dial to fail when STARTTLS is unsupported")
+	}
+}
+
+func TestUnknownTLSMode(t *testing.T) {
+	settings := SMTPSettings{Host: "127.0.0.1", Port: 25, TLSMode: "ssl3"}
+	if _, err := settings.Dialer(); err == nil {
+		t.Error("expected unknown tls mode to be rejected")
+	}
+}
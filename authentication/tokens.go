@@ -0,0 +1,184 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the scopes an API token can be given
+const (
+	ScopeReadLog         = "read-log"         // reading the log, sessions, connections and backends
+	ScopeManageWhitelist = "manage-whitelist" // listing, adding and removing whitelist entries
+	ScopeKillSessions    = "kill-sessions"    // killing live connections
+)
+
+// every scope an API token can be given
+var Scopes = []string{ScopeReadLog, ScopeManageWhitelist, ScopeKillSessions}
+
+// the prefix of a token hash, naming the algorithm it was hashed with
+const tokenHashPrefix = "sha256:"
+
+// a bearer token which grants access to the API - only the hash of the
+// token is kept so that the token itself is never written to disk
+type APIToken struct {
+	Name   string   `json:"name"`   // a human readable name of who or what uses the token
+	Hash   string   `json:"hash"`   // the hash of the token, e.g. "sha256:<hex>"
+	Scopes []string `json:"scopes"` // the scopes the token grants
+}
+
+// returns whether or not a token is the one this API token was created from,
+// comparing in constant time so the hash cannot be guessed a byte at a time
+func (t *APIToken) Matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(t.Hash)) == 1
+}
+
+// returns whether or not this API token grants a scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the hash of a token in the form it is stored in
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// checks that a token hash is in the form HashToken returns
+func ValidateTokenHash(hash string) error {
+	if !strings.HasPrefix(hash, tokenHashPrefix) {
+		return fmt.Errorf("token hash must start with %q", tokenHashPrefix)
+	}
+	if sum, err := hex.DecodeString(strings.TrimPrefix(hash, tokenHashPrefix)); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("token hash must be %d hex encoded bytes", sha256.Size)
+	}
+	return nil
+}
+
+// checks that a scope is one an API token can be given
+func ValidateScope(scope string) error {
+	for _, s := range Scopes {
+		if s == scope {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown scope %q", scope)
+}
+
+// generates a new random token along with the API token storing its hash
+func GenerateAPIToken(name string, scopes []string) (string, APIToken, error) {
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return "", APIToken{}, err
+		}
+	}
+
+	// 256 random bits, the same as the authentication codes
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIToken{}, err
+	}
+	token := "gk_" + base64.RawURLEncoding.EncodeToString(b)
+
+	return token, APIToken{Name: name, Hash: HashToken(token), Scopes: scopes}, nil
+}
+
+// loads the API tokens from a file, a missing file holds no tokens
+func LoadAPITokens(filepath string) ([]APIToken, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath, err)
+	}
+	for _, token := range tokens {
+		if err := ValidateTokenHash(token.Hash); err != nil {
+			return nil, fmt.Errorf("%s: token %s: %s", filepath, token.Name, err)
+		}
+	}
+	return tokens, nil
+}
+
+// saves the API tokens to a file, replacing it in one step
+// in the same way as the whitelist is saved
+func SaveAPITokens(filepath string, tokens []APIToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath, data)
+}
+
+// writes data to a temporary file only readable by its owner and then swaps
+// it into place, so the file is never left half written
+func writeFileAtomically(filepath string, data []byte) error {
+	temporary := filepath + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filepath)
+}
+
+// returns the bearer token of a request, or an empty string if it has none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// finds the API token a request was made with, or nil if it was made
+// without one or the token does not match any API token
+func (mfa *MultiFactorAuth) requestToken(r *http.Request) *APIToken {
+	token := bearerToken(r)
+	if token == "" {
+		return nil
+	}
+	for i := range mfa.Tokens {
+		if mfa.Tokens[i].Matches(token) {
+			return &mfa.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// describes who made an API request for the records, by the name of its
+// token if it has one, otherwise by its IP address
+func (mfa *MultiFactorAuth) ApiCaller(r *http.Request) string {
+	if token := mfa.requestToken(r); token != nil {
+		return fmt.Sprintf("token %s", token.Name)
+	}
+	return fmt.Sprintf("api (%s)", mfa.ClientIP(r))
+}
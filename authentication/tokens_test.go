@@ -0,0 +1,122 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// makes an API request from an address with an optional bearer token
+func apiRequest(remoteAddr string, token string) *http.Request {
+	request := httptest.NewRequest("GET", "/api/log", nil)
+	request.RemoteAddr = remoteAddr
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request
+}
+
+func TestApiAccessWithoutTokens(t *testing.T) {
+	mfa := newTestMFA(t)
+	handler := mfa.wrapApiFunc("/api/log", ScopeReadLog, mfa.ViewLog)
+
+	// with neither tokens nor a whitelist the API is closed
+	recorder := httptest.NewRecorder()
+	handler(recorder, apiRequest("192.0.2.1:1234", ""))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with no tokens or whitelist, got %d", recorder.Code)
+	}
+
+	// with only a whitelist the IP address alone is checked
+	mfa.ApiWhitelist = []string{"127.0.0.1"}
+	recorder = httptest.NewRecorder()
+	handler(recorder, apiRequest("127.0.0.1:1234", ""))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected 200 from a whitelisted IP, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	handler(recorder, apiRequest("192.0.2.1:1234", ""))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 from another IP, got %d", recorder.Code)
+	}
+}
+
+func TestApiAccessWithTokens(t *testing.T) {
+	mfa := newTestMFA(t)
+	reader, readerToken, err := GenerateAPIToken("reader", []string{ScopeReadLog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	killer, killerToken, err := GenerateAPIToken("killer", []string{ScopeKillSessions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa.Tokens = []APIToken{readerToken, killerToken}
+	handler := mfa.wrapApiFunc("/api/log", ScopeReadLog, mfa.ViewLog)
+
+	cases := []struct {
+		remoteAddr string
+		token      string
+		expected   int
+	}{
+		{"192.0.2.1:1234", "", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "gk_wrong", http.StatusUnauthorized},
+		{"192.0.2.1:1234", killer, http.StatusForbidden},
+		{"192.0.2.1:1234", reader, http.StatusOK},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		handler(recorder, apiRequest(c.remoteAddr, c.token))
+		if recorder.Code != c.expected {
+			t.Errorf("token %q: expected %d, got %d", c.token, c.expected, recorder.Code)
+		}
+		if c.expected == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: expected a WWW-Authenticate header", c.token)
+		}
+	}
+
+	// the whitelist still applies to requests with a valid token
+	mfa.ApiWhitelist = []string{"127.0.0.1"}
+	recorder := httptest.NewRecorder()
+	handler(recorder, apiRequest("192.0.2.1:1234", reader))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 from a non-whitelisted IP, got %d", recorder.Code)
+	}
+
+	if caller := mfa.ApiCaller(apiRequest("127.0.0.1:1234", reader)); caller != "token reader" {
+		t.Errorf("expected the caller to be named by its token, got %q", caller)
+	}
+}
+
+func TestAPITokensFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	tokens, err := LoadAPITokens(path)
+	if err != nil || len(tokens) != 0 {
+		t.Fatalf("expected a missing file to hold no tokens, got %v, %v", tokens, err)
+	}
+
+	token, apiToken, err := GenerateAPIToken("ci", []string{ScopeManageWhitelist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAPITokens(path, []APIToken{apiToken}); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = LoadAPITokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || !tokens[0].Matches(token) || !tokens[0].HasScope(ScopeManageWhitelist) {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+	if tokens[0].Hash == token {
+		t.Error("the token itself must not be stored")
+	}
+
+	if _, _, err := GenerateAPIToken("bad", []string{"everything"}); err == nil {
+		t.Error("expected an unknown scope to be rejected")
+	}
+}
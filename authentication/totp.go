@@ -0,0 +1,213 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// the parameters of the TOTP codes - these are the RFC 6238 defaults,
+// which are the only ones every authenticator app supports
+const (
+	totpPeriod = 30 // how many seconds each code is valid for
+	totpDigits = 6  // how many digits each code has
+	totpSkew   = 1  // how many periods either side of now are accepted, to allow for clock drift
+)
+
+// how many wrong codes an IP address may submit, or may be submitted for a
+// user from any IP address, before it is locked out of self-authorization,
+// and how long the lockout lasts
+const (
+	totpMaxFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+// the secrets are base32 encoded without padding, as authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generates a new random 160 bit TOTP secret, the size RFC 4226 recommends
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// returns the otpauth URI of a user's TOTP secret, which authenticator
+// apps import the secret from - it can be pasted in or scanned as a QR code
+func TOTPURI(issuer string, user string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(user)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, values.Encode())
+}
+
+// returns the code of a secret for the period a time falls in
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %s", err)
+	}
+	return hotp(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// returns the RFC 4226 HOTP code of a key for a counter
+func hotp(key []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation picks 31 bits of the MAC from an offset given by its last nibble
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// checks a code against the periods around a time, returning the period it
+// matched so the same code can be refused if it is submitted again
+func verifyTOTP(secret string, code string, t time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	now := t.Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// the failed self-authorizations of an IP address or a user
+type totpFailures struct {
+	count int       // the number of wrong codes submitted since the last success or lockout
+	last  time.Time // when the last wrong code was submitted
+	until time.Time // when the lockout ends, zero if the IP address is not locked out
+}
+
+// counts a wrong code against an IP address or user, locking it out once
+// it reaches totpMaxFailures - the caller must hold the mutex
+func recordTOTPFailure(failures map[string]totpFailures, key string, now time.Time) {
+	f := failures[key]
+	f.count++
+	f.last = now
+	if f.count >= totpMaxFailures {
+		f = totpFailures{last: now, until: now.Add(totpLockout)}
+	}
+	failures[key] = f
+}
+
+// whitelists an IP address for the TOTPGrantTTL on the TOTPRoutes the user
+// may use if the code is the user's current one, returning the status and
+// message to answer with
+func (mfa *MultiFactorAuth) authorizeTOTP(ip string, name string, code string) (int, string) {
+	now := time.Now()
+
+	// wrong codes lock out both the IP address and the user, so guesses
+	// spread across many IP addresses are limited as well - names nobody
+	// is registered with are counted too, so a lockout gives nothing away
+	mfa.mutex.Lock()
+	locked := now.Before(mfa.totpFailures[ip].until) || now.Before(mfa.totpUserFailures[name].until)
+	mfa.mutex.Unlock()
+	if locked {
+		log.Printf("TOTP self-authorization of %s as %q refused - locked out\n", ip, name)
+		return http.StatusTooManyRequests, "Too many wrong codes, try again later."
+	}
+
+	// an unknown user or one who may not use TOTP is answered the same
+	// as a wrong code, so the form cannot be used to find out who is enrolled
+	step, valid := int64(0), false
+	user, registered := mfa.Users.Get(name)
+	if registered && user.AllowsMFA(MFATOTP) {
+		step, valid = verifyTOTP(user.TOTPSecret, code, now)
+	}
+
+	mfa.mutex.Lock()
+	if valid && mfa.totpLastStep[name] >= step {
+		// a code may only be used once, even within its period
+		valid = false
+	}
+	if !valid {
+		recordTOTPFailure(mfa.totpFailures, ip, now)
+		recordTOTPFailure(mfa.totpUserFailures, name, now)
+		mfa.mutex.Unlock()
+		log.Printf("TOTP self-authorization of %s as %q failed - invalid code\n", ip, name)
+		return http.StatusUnauthorized, "Invalid name or code."
+	}
+	mfa.totpLastStep[name] = step
+	delete(mfa.totpFailures, ip)
+	delete(mfa.totpUserFailures, name)
+	mfa.mutex.Unlock()
+
+	// the grant only covers the routes TOTP may be used on which the user may
+	// use, so it never lets the IP address onto a route needing approvals
+	var routes []string
+	for _, route := range mfa.TOTPRoutes {
+		if user.AllowsRoute(route) {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == 0 {
+		log.Printf("TOTP self-authorization of %s as %s refused - no routes allow TOTP for the user\n", ip, name)
+		return http.StatusForbidden, "You may not use any route with a TOTP code."
+	}
+
+	err := mfa.ProxyAuthHandler.GrantWhitelistEntry(WhitelistEntry{
+		Address: ip,
+		AddedBy: "totp " + name,
+		Reason:  "self-authorized with a TOTP code",
+		User:    name,
+		Routes:  routes,
+	}, mfa.TOTPGrantTTL)
+	if err != nil {
+		log.Printf("Error whitelisting %s for TOTP user %s: %s\n", ip, name, err)
+		return http.StatusInternalServerError, "Your IP address could not be authorized."
+	}
+
+	// administrators are told about every self-authorization,
+	// as they would otherwise never see it happen
+	described := strings.Join(routes, ", ")
+	log.Printf("Whitelisted %s on %s for %s, self-authorized by TOTP user %s\n", ip, described, describeTTL(mfa.TOTPGrantTTL), name)
+	go mfa.sendSelfAuthorizedAlert(ip, name, described, mfa.TOTPGrantTTL, "with a TOTP code")
+
+	return http.StatusOK, fmt.Sprintf("%s is authorized on %s for %s.", ip, described, describeTTL(mfa.TOTPGrantTTL))
+}
+
+// tells the administrators that a user authorized their own IP address for
+// some routes, or for every route if there are none, describing how they did it
+func (mfa *MultiFactorAuth) sendSelfAuthorizedAlert(ip string, user string, route string, ttl time.Duration, how string) {
+	if mfa.Notifier == nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	alert := Alert{
+		Kind:     AlertSelfAuthorized,
+		IP:       ip,
+		User:     user,
+		Route:    route,
+		Reason:   how,
+		Hostname: hostname,
+		GrantTTL: describeTTL(ttl),
+	}
+	if err := mfa.Notifier.Notify(alert); err != nil {
+		log.Printf("Error sending self-authorization alert for %s: %s\n", ip, err)
+	}
+}
@@ -0,0 +1,178 @@
+package authentication
+
+import (
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a notifier which passes every alert on to a channel
+type channelNotifier chan Alert
+
+func (c channelNotifier) Notify(alert Alert) error {
+	c <- alert
+	return nil
+}
+
+func TestTOTPCodeVectors(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for seconds, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := TOTPCode(secret, time.Unix(seconds, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("T=%d: expected %s, got %s", seconds, expected, code)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	uri, err := url.Parse(TOTPURI("Gatekeeper", "alice smith", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Gatekeeper:alice smith" {
+		t.Errorf("unexpected URI %s", uri)
+	}
+	if uri.Query().Get("secret") != secret || uri.Query().Get("issuer") != "Gatekeeper" {
+		t.Errorf("unexpected URI parameters %s", uri.RawQuery)
+	}
+}
+
+// registers users with the MFA from a users file in a temporary directory
+func registerTestUsers(t *testing.T, mfa *MultiFactorAuth, users ...User) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := SaveUsers(path, users); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewUserRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa.Users = registry
+}
+
+// submits the login page from an address
+func submitLogin(mfa *MultiFactorAuth, remoteAddr string, name string, code string) *httptest.ResponseRecorder {
+	form := url.Values{"name": {name}, "code": {code}}
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	mfa.HandleLogin(recorder, request)
+	return recorder
+}
+
+func TestTOTPSelfAuthorization(t *testing.T) {
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 1)
+	mfa.Notifier = alerts
+	mfa.TOTP = true
+	mfa.TOTPGrantTTL = time.Hour
+	mfa.TOTPRoutes = []string{"ssh", "web"}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerTestUsers(t, mfa, User{Name: "alice", Routes: []string{"ssh", "rdp"}, TOTPSecret: secret}, User{Name: "bob", MFA: []string{MFAEmail}, TOTPSecret: secret})
+	code, _ := TOTPCode(secret, time.Now())
+
+	// the form is shown to anyone
+	recorder := httptest.NewRecorder()
+	mfa.HandleLogin(recorder, httptest.NewRequest("GET", "/api/login", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `name="code"`) {
+		t.Errorf("expected the form, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	// an unknown user, or one who may not use TOTP, is refused like a wrong code
+	for _, name := range []string{"mallory", "bob"} {
+		if recorder := submitLogin(mfa, "192.0.2.1:1234", name, code); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for %s, got %d", name, recorder.Code)
+		}
+	}
+
+	// the right code whitelists the address the request came from for the user,
+	// only on the routes TOTP may be used on which the user may use
+	if recorder := submitLogin(mfa, "192.0.2.1:1234", "alice", code); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the right code, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	entries := mfa.ProxyAuthHandler.Entries()
+	if len(entries) != 1 || entries[0].Address != "192.0.2.1" || entries[0].User != "alice" || entries[0].AddedBy != "totp alice" || entries[0].Expires == nil {
+		t.Errorf("unexpected whitelist %+v", entries)
+	}
+	for route, allowed := range map[string]bool{"ssh": true, "rdp": false, "web": false} {
+		if _, whitelisted := mfa.WhitelistedUser("192.0.2.1", route); whitelisted != allowed {
+			t.Errorf("expected the grant on %s to be %v, got %v", route, allowed, whitelisted)
+		}
+	}
+	select {
+	case alert := <-alerts:
+		if alert.Kind != AlertSelfAuthorized || alert.IP != "192.0.2.1" || alert.User != "alice" || alert.Route != "ssh" {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the administrators to be alerted")
+	}
+
+	// the same code cannot be used twice
+	if recorder := submitLogin(mfa, "192.0.2.2:1234", "alice", code); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a reused code, got %d", recorder.Code)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.TOTP = true
+	secret, _ := GenerateTOTPSecret()
+	registerTestUsers(t, mfa, User{Name: "alice", TOTPSecret: secret})
+
+	for i := 0; i < totpMaxFailures; i++ {
+		submitLogin(mfa, "192.0.2.1:1234", "alice", "not-a-code")
+	}
+
+	// once locked out even the right code is refused
+	code, _ := TOTPCode(secret, time.Now())
+	if recorder := submitLogin(mfa, "192.0.2.1:1234", "alice", code); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 once locked out, got %d", recorder.Code)
+	}
+	if mfa.ProxyAuthHandler.IsWhitelisted("192.0.2.1") {
+		t.Error("a locked out address should not have been whitelisted")
+	}
+}
+
+func TestTOTPLockoutPerUser(t *testing.T) {
+	mfa := newTestMFA(t)
+	mfa.TOTP = true
+	mfa.TOTPRoutes = []string{"ssh"}
+	secret, _ := GenerateTOTPSecret()
+	registerTestUsers(t, mfa, User{Name: "alice", TOTPSecret: secret}, User{Name: "bob", TOTPSecret: secret})
+
+	// wrong codes for alice from many IP addresses lock her out everywhere
+	for i := 0; i < totpMaxFailures; i++ {
+		submitLogin(mfa, fmt.Sprintf("192.0.2.%d:1234", i+1), "alice", "not-a-code")
+	}
+	code, _ := TOTPCode(secret, time.Now())
+	if recorder := submitLogin(mfa, "198.51.100.1:1234", "alice", code); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for alice from a new IP address, got %d", recorder.Code)
+	}
+
+	// while other users can still authorize
+	if recorder := submitLogin(mfa, "198.51.100.1:1234", "bob", code); recorder.Code != http.StatusOK {
+		t.Errorf("expected bob to be unaffected, got %d", recorder.Code)
+	}
+}
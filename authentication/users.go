@@ -0,0 +1,266 @@
+package authentication
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the methods a user can authorize their IP address with
+const (
+	MFAEmail      = "email"       // an administrator approves a connection attempt the user claimed
+	MFATOTP       = "totp"        // the user authorizes their own IP address with a TOTP code
+	MFAClientCert = "client-cert" // the user's client certificate lets them in on routes which allow it
+)
+
+// every method a user can authorize their IP address with
+var MFAMethods = []string{MFAEmail, MFATOTP, MFAClientCert}
+
+// how a pending connection attempt was tied to a user
+const (
+	IdentifiedByCertificate = "certificate" // the client presented a verified certificate of the user
+	IdentifiedByUsername    = "username"    // someone at the IP address claimed to be the user on the login page, which is not proof
+)
+
+// a registered user of the proxy
+type User struct {
+	Name       string    `json:"name"`                 // the name the user signs in with, also matched against the common name of client certificates
+	Email      string    `json:"email,omitempty"`      // the user's email address, also matched against the email addresses of client certificates
+	Routes     []string  `json:"routes,omitempty"`     // the names of the routes the user may use, empty for every route
+	MFA        []string  `json:"mfa,omitempty"`        // the methods the user may authorize with, empty for every method
+	TOTPSecret string    `json:"totpSecret,omitempty"` // the base32 encoded TOTP secret, empty if the user has not enrolled an authenticator app
+	Created    time.Time `json:"created"`              // when the user was registered
+}
+
+// returns whether or not the user may use a route
+func (u *User) AllowsRoute(route string) bool {
+	if len(u.Routes) == 0 {
+		return true
+	}
+	for _, r := range u.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether or not the user may authorize with a method,
+// TOTP codes also need the user to have enrolled a secret
+func (u *User) AllowsMFA(method string) bool {
+	if method == MFATOTP && u.TOTPSecret == "" {
+		return false
+	}
+	if len(u.MFA) == 0 {
+		return true
+	}
+	for _, m := range u.MFA {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that a user is complete and only uses known methods
+func ValidateUser(user User) error {
+	if user.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	for _, method := range user.MFA {
+		known := false
+		for _, m := range MFAMethods {
+			known = known || m == method
+		}
+		if !known {
+			return fmt.Errorf("user %s: unknown mfa method %q", user.Name, method)
+		}
+	}
+	if user.TOTPSecret != "" {
+		if _, err := totpEncoding.DecodeString(strings.ToUpper(user.TOTPSecret)); err != nil {
+			return fmt.Errorf("user %s: invalid totpSecret: %s", user.Name, err)
+		}
+	}
+	return nil
+}
+
+// loads the registered users from a file, a missing file holds no users
+func LoadUsers(filepath string) ([]User, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath, err)
+	}
+	names := map[string]bool{}
+	for _, user := range users {
+		if err := ValidateUser(user); err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath, err)
+		}
+		if names[user.Name] {
+			return nil, fmt.Errorf("%s: duplicate user %s", filepath, user.Name)
+		}
+		names[user.Name] = true
+	}
+	return users, nil
+}
+
+// saves the registered users to a file only readable by its owner,
+// as the TOTP secrets are needed in the clear to check codes
+func SaveUsers(filepath string, users []User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath, data)
+}
+
+// how often the users file is checked for changes by default
+const usersCheckInterval = time.Second
+
+// the registered users, loaded from a file which is reloaded whenever it
+// changes so users managed with the user command take effect without a
+// restart - it is safe for concurrent use
+type UserRegistry struct {
+	Filepath      string        // the path to the users file
+	CheckInterval time.Duration // how long the file is left unchecked for changes between lookups, 0 to check on every lookup
+	users         []User        // the loaded users, guarded by mutex
+	modified      time.Time     // the modification time of the file when it was loaded, guarded by mutex
+	checked       time.Time     // when the file was last checked for changes, guarded by mutex
+	mutex         sync.Mutex    // guards the users, modified and checked fields
+}
+
+// constructor for the user registry, it loads the users straight
+// away so that a bad users file is reported before anything is served
+func NewUserRegistry(filepath string) (*UserRegistry, error) {
+	r := &UserRegistry{Filepath: filepath, CheckInterval: usersCheckInterval}
+	users, err := LoadUsers(filepath)
+	if err != nil {
+		return nil, err
+	}
+	r.users = users
+	r.checked = time.Now()
+	if info, err := os.Stat(filepath); err == nil {
+		r.modified = info.ModTime()
+	}
+	return r, nil
+}
+
+// returns the registered users, reloading them first if the file has
+// changed - a file which no longer loads keeps the previous users. Users are
+// looked up for every connection, so the file is only checked for changes
+// once every CheckInterval rather than on every lookup
+func (r *UserRegistry) Users() []User {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < r.CheckInterval {
+		return r.users
+	}
+	r.checked = now
+
+	var modified time.Time
+	if info, err := os.Stat(r.Filepath); err == nil {
+		modified = info.ModTime()
+	}
+	if !modified.Equal(r.modified) {
+		users, err := LoadUsers(r.Filepath)
+		if err != nil {
+			log.Printf("Error reloading users: %s\n", err)
+		} else {
+			r.users = users
+			r.modified = modified
+		}
+	}
+	return r.users
+}
+
+// returns the user with a name
+func (r *UserRegistry) Get(name string) (User, bool) {
+	for _, user := range r.Users() {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// returns the user a verified client certificate belongs to, matched
+// by the certificate's common name or one of its email addresses
+func (r *UserRegistry) ForCertificate(certificate *x509.Certificate) (User, bool) {
+	for _, user := range r.Users() {
+		if certificate.Subject.CommonName == user.Name {
+			return user, true
+		}
+		for _, email := range certificate.EmailAddresses {
+			if user.Email != "" && strings.EqualFold(email, user.Email) {
+				return user, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// returns the name of the user a verified client certificate
+// belongs to, or an empty string if it belongs to no user
+func (mfa *MultiFactorAuth) CertificateUser(certificate *x509.Certificate) string {
+	if certificate == nil || mfa.Users == nil {
+		return ""
+	}
+	user, _ := mfa.Users.ForCertificate(certificate)
+	return user.Name
+}
+
+// returns whether or not a verified client certificate may skip MFA on a
+// route - the certificate of a user only may if the user may use the route
+// and authorize with their certificate, while certificates of nobody in the
+// registry may as they did before users were registered
+func (mfa *MultiFactorAuth) CertificateAllows(certificate *x509.Certificate, route string) bool {
+	if mfa.Users == nil {
+		return true
+	}
+	user, registered := mfa.Users.ForCertificate(certificate)
+	return !registered || (user.AllowsRoute(route) && user.AllowsMFA(MFAClientCert))
+}
+
+// returns whether or not an IP address is whitelisted for a route, and the
+// user it was whitelisted for if any - an entry granted to a registered user
+// only lets them onto the routes they may use, and stops working if they are
+// removed, while an entry for a user named by an OIDC issuer was granted after
+// the issuer's groups were checked, so it needs no registered user - each
+// grant is an entry of its own, so an entry is only ever checked for its own user
+func (mfa *MultiFactorAuth) WhitelistedUser(ip string, route string) (string, bool) {
+	for _, entry := range mfa.ProxyAuthHandler.Matching(ip) {
+		if !entry.AllowsRoute(route) {
+			continue
+		}
+		if entry.User == "" || mfa.Users == nil || entry.Issuer != "" {
+			return entry.User, true
+		}
+		if user, registered := mfa.Users.Get(entry.User); registered && user.AllowsRoute(route) {
+			return entry.User, true
+		}
+	}
+	return "", false
+}
+
+// describes a client for the logs by its IP address and user
+func DescribeClient(ip string, user string) string {
+	if user == "" {
+		return ip
+	}
+	return fmt.Sprintf("%s (%s)", ip, user)
+}
@@ -0,0 +1,200 @@
+package authentication
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"unknown-method.json": `[{"name": "alice", "mfa": ["sms"]}]`,
+		"duplicate.json":      `[{"name": "alice"}, {"name": "alice"}]`,
+		"no-name.json":        `[{"email": "alice@example.com"}]`,
+		"bad-secret.json":     `[{"name": "alice", "totpSecret": "not base32!"}]`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUsers(path); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+
+	// a missing file holds no users
+	if users, err := LoadUsers(filepath.Join(dir, "missing.json")); err != nil || len(users) != 0 {
+		t.Errorf("expected no users from a missing file, got %v %v", users, err)
+	}
+}
+
+func TestUserRegistryReloads(t *testing.T) {
+	mfa := newTestMFA(t)
+	registerTestUsers(t, mfa, User{Name: "alice"})
+	mfa.Users.CheckInterval = 50 * time.Millisecond
+
+	if _, registered := mfa.Users.Get("bob"); registered {
+		t.Fatal("bob should not be registered yet")
+	}
+
+	// the file is changed behind the registry's back, as the user command does
+	if err := SaveUsers(mfa.Users.Filepath, []User{{Name: "alice"}, {Name: "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(mfa.Users.Filepath, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	// which is only noticed once the check interval has passed
+	if _, registered := mfa.Users.Get("bob"); registered {
+		t.Error("expected the file not to be checked again within the check interval")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, registered := mfa.Users.Get("bob"); !registered {
+		t.Error("expected bob to be registered once the file changed")
+	}
+
+	// a file which no longer loads keeps the previous users
+	if err := os.WriteFile(mfa.Users.Filepath, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	if err := os.Chtimes(mfa.Users.Filepath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, registered := mfa.Users.Get("bob"); !registered {
+		t.Error("expected bob to stay registered when the file is broken")
+	}
+}
+
+func TestWhitelistedUser(t *testing.T) {
+	mfa := newTestMFA(t)
+	registerTestUsers(t, mfa, User{Name: "alice", Routes: []string{"ssh"}})
+
+	for _, entry := range []WhitelistEntry{
+		{Address: "192.0.2.1", User: "alice"},
+		{Address: "192.0.2.2", User: "removed"},
+		{Address: "192.0.2.3"},
+		{Address: "192.0.2.4", User: "bob", Routes: []string{"rdp"}, Issuer: "https://login.example.com"},
+		{Address: "192.0.2.5", User: "removed", Routes: []string{"rdp"}},
+		{Address: "192.0.2.6", User: "alice", Routes: []string{"ssh", "rdp"}},
+	} {
+		if _, err := mfa.ProxyAuthHandler.AddWhitelistEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a grant for alice on the address bob signed in from through OIDC
+	grant := WhitelistEntry{Address: "192.0.2.4", User: "alice", Routes: []string{"web"}}
+	if err := mfa.ProxyAuthHandler.GrantWhitelistEntry(grant, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ip, route, user string
+		whitelisted     bool
+	}{
+		{"192.0.2.1", "ssh", "alice", true},
+		{"192.0.2.1", "rdp", "", false},   // alice may not use rdp
+		{"192.0.2.2", "ssh", "", false},   // the user was removed from the registry
+		{"192.0.2.3", "rdp", "", true},    // entries for nobody allow every route
+		{"192.0.2.4", "rdp", "bob", true}, // users named by an OIDC issuer need not be registered
+		{"192.0.2.4", "ssh", "", false},
+		{"192.0.2.4", "web", "", false}, // alice may not use web, whoever else the address was granted to
+		{"192.0.2.5", "rdp", "", false}, // limiting an entry to routes does not outlive its user
+		{"192.0.2.6", "ssh", "alice", true},
+		{"192.0.2.6", "rdp", "", false}, // nor let its user onto a route they may not use
+	} {
+		user, whitelisted := mfa.WhitelistedUser(test.ip, test.route)
+		if user != test.user || whitelisted != test.whitelisted {
+			t.Errorf("%s on %s: expected %q %v, got %q %v", test.ip, test.route, test.user, test.whitelisted, user, whitelisted)
+		}
+	}
+}
+
+func TestCertificateUsers(t *testing.T) {
+	mfa := newTestMFA(t)
+	registerTestUsers(t, mfa,
+		User{Name: "alice", Email: "alice@example.com", Routes: []string{"ssh"}},
+		User{Name: "bob", MFA: []string{MFAEmail}},
+	)
+
+	byEmail := &x509.Certificate{Subject: pkix.Name{CommonName: "Alice Smith"}, EmailAddresses: []string{"Alice@example.com"}}
+	if user := mfa.CertificateUser(byEmail); user != "alice" {
+		t.Errorf("expected the certificate to belong to alice, got %q", user)
+	}
+	if !mfa.CertificateAllows(byEmail, "ssh") || mfa.CertificateAllows(byEmail, "rdp") {
+		t.Error("expected alice's certificate to only skip MFA on ssh")
+	}
+
+	bob := &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}
+	if mfa.CertificateAllows(bob, "ssh") {
+		t.Error("expected bob's certificate not to skip MFA, as bob may only be approved by email")
+	}
+
+	nobody := &x509.Certificate{Subject: pkix.Name{CommonName: "build-server"}}
+	if mfa.CertificateUser(nobody) != "" || !mfa.CertificateAllows(nobody, "rdp") {
+		t.Error("expected a certificate of nobody to skip MFA without a user")
+	}
+}
+
+func TestClaimAttempts(t *testing.T) {
+	mfa := newTestMFA(t)
+	alerts := make(channelNotifier, 1)
+	mfa.Notifier = alerts
+	registerTestUsers(t, mfa,
+		User{Name: "alice", Routes: []string{"ssh"}},
+		User{Name: "bob", MFA: []string{MFATOTP}},
+	)
+
+	code, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mfa.GenerateCode(AuthRequest{IP: "192.0.2.1", Route: "rdp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// users who are not approved by email, and unknown users, cannot claim attempts
+	for _, name := range []string{"bob", "mallory"} {
+		if recorder := submitLogin(mfa, "192.0.2.1:1234", name, ""); recorder.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", name, recorder.Code)
+		}
+	}
+	// nor can anyone claim attempts from another address
+	if recorder := submitLogin(mfa, "192.0.2.2:1234", "alice", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another address, got %d", recorder.Code)
+	}
+
+	recorder := submitLogin(mfa, "192.0.2.1:1234", "alice", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 for alice, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Result().Header.Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("expected the page to be served as html, got %q", contentType)
+	}
+	if request, _ := mfa.GetCodeRequest(code); request.User != "alice" || request.IdentifiedBy != IdentifiedByUsername {
+		t.Errorf("expected the ssh attempt to be claimed by alice, got %+v", request)
+	}
+	if request, _ := mfa.GetCodeRequest(other); request.User != "" {
+		t.Errorf("expected the rdp attempt not to be claimed, as alice may not use rdp, got %+v", request)
+	}
+
+	select {
+	case alert := <-alerts:
+		if !strings.Contains(alert.ApproveURL, code) || alert.User != "alice" || alert.IdentifiedBy != IdentifiedByUsername {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the administrators to be alerted again")
+	}
+}
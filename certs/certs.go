@@ -0,0 +1,202 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// a certificate and key pair loaded from files, which can be reloaded while
+// TLS listeners are serving it - it is safe for concurrent use
+type Reloader struct {
+	CertFile    string           // the path to the PEM encoded certificate chain
+	KeyFile     string           // the path to the PEM encoded private key
+	certificate *tls.Certificate // the loaded certificate, guarded by mutex
+	modified    time.Time        // the latest modification time of the files when they were loaded, guarded by mutex
+	mutex       sync.RWMutex     // guards the certificate and modified fields
+}
+
+// constructor for a reloader, it loads the certificate straight away
+// so that a bad certificate is reported before anything is served
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// loads the certificate and key from their files again, keeping
+// the previously loaded certificate if they cannot be loaded
+func (r *Reloader) Reload() error {
+	modified, err := r.latestModification()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = &certificate
+	r.modified = modified
+	return nil
+}
+
+// returns the loaded certificate, it is used as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// returns a TLS config serving the loaded certificate
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// loops until done is closed, reloading the certificate whenever
+// either of its files has been modified since it was last loaded
+func (r *Reloader) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		modified, err := r.latestModification()
+		if err != nil {
+			continue
+		}
+		r.mutex.RLock()
+		changed := modified.After(r.modified)
+		r.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			log.Printf("Error reloading certificate %s: %s\n", r.CertFile, err)
+		} else {
+			log.Printf("Reloaded certificate %s\n", r.CertFile)
+		}
+	}
+}
+
+// returns the later modification time of the certificate and key files
+func (r *Reloader) latestModification() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// loads a PEM bundle of CA certificates into a pool
+func LoadCertPool(filepath string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath)
+	}
+	return pool, nil
+}
+
+// writes a self-signed certificate and key for the hosts to the files,
+// unless the certificate file already exists - it is meant for development
+// only as clients cannot verify it without trusting it by hand
+func GenerateSelfSigned(certFile string, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Gatekeeper self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// the key is written first and only readable by its owner
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return fmt.Errorf("writing key: %s", err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return fmt.Errorf("writing certificate: %s", err)
+	}
+	return nil
+}
+
+// writes a single PEM block to a file
+func writePEM(filepath string, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
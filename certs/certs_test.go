@@ -0,0 +1,118 @@
+package certs
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// returns the leaf certificate the reloader is serving
+func servedCertificate(t *testing.T, r *Reloader) *x509.Certificate {
+	certificate, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"rdp.example.com", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to only be readable by its owner, got %s", info.Mode().Perm())
+	}
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := servedCertificate(t, r)
+	if err := leaf.VerifyHostname("rdp.example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	// an existing certificate is kept rather than regenerated
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"other.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if servedCertificate(t, r).SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("expected the existing certificate to be kept")
+	}
+}
+
+func TestWatchReloadsChangedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"old.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.Watch(10*time.Millisecond, done)
+
+	// replaces the certificate, making sure its modification time moves on
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"new.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(certFile, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if servedCertificate(t, r).VerifyHostname("new.example.com") == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the changed certificate to be reloaded")
+}
+
+func TestReloadKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"api.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected an invalid certificate to fail to reload")
+	}
+	if servedCertificate(t, r).VerifyHostname("api.example.com") != nil {
+		t.Error("expected the previous certificate to still be served")
+	}
+}
@@ -3,21 +3,699 @@ package config
 import (
 	_ "embed"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/ipset"
 )
 
 //go:embed config.json
 var defaultConfig string
 
 type ApplicationConfig struct {
-	ProxyAddress    string   `json:"proxyAddress"`    // the address the tcp proxy server is listening on
-	RedirectAddress string   `json:"redirectAddress"` // the address the tcp proxy server will use as its target service to piping
-	ApiAddress      string   `json:"apiAddress"`      // the address the REST API will be listening on
-	LoggerPath      string   `json:"loggerPath"`      // the path to the output file of the program's log
-	DefaultApiUrl   string   `json:"defaultApiUrl"`   // the publicly accessible link to the REST API to be used in embedded in the email links
-	ApiWhitelist    []string `json:"apiWhitelist"`    // the IP address whitelist to access sensitive information from the REST API such as the log
-	Emails          []string `json:"emails"`          // the list of administrator email addresses that the program should email alerts to
+	ProxyAddress     string               `json:"proxyAddress"`     // legacy: the address the tcp proxy server is listening on when no routes are configured
+	RedirectAddress  string               `json:"redirectAddress"`  // legacy: the target service of the tcp proxy server when no routes are configured
+	Routes           []RouteConfig        `json:"routes"`           // the list of listener-to-backend routes the tcp proxy server should serve
+	ApiAddress       string               `json:"apiAddress"`       // the address the REST API will be listening on
+	ApiTLS           APITLSConfig         `json:"apiTLS"`           // serves the REST API over HTTPS when a certificate is configured
+	LoggerPath       string               `json:"loggerPath"`       // the path to the output file of the program's log
+	DefaultApiUrl    string               `json:"defaultApiUrl"`    // the publicly accessible link to the REST API to be used in embedded in the email links
+	ApiWhitelist     []string             `json:"apiWhitelist"`     // the IP address whitelist to access sensitive information from the REST API such as the log
+	TrustedProxies   []string             `json:"trustedProxies"`   // IP addresses and CIDR blocks of reverse proxies in front of the REST API whose X-Forwarded-For and Forwarded headers are believed
+	ApiTokens        []APITokenConfig     `json:"apiTokens"`        // bearer tokens allowed to use the REST API, once any exist every request needs one
+	ApiTokensPath    string               `json:"apiTokensPath"`    // the path to the file of API tokens created with the token command, defaults to "tokens.json"
+	Emails           []string             `json:"emails"`           // the list of administrator email addresses that the program should email alerts to
+	CodeTTL          string               `json:"codeTTL"`          // how long an emailed authentication code stays valid, e.g. "15m"
+	DenyBlockTTL     string               `json:"denyBlockTTL"`     // how long a denied IP is blocklisted by default, e.g. "1h" - empty means no block
+	SMTP             SMTPConfig           `json:"smtp"`             // the SMTP server alert emails are sent through
+	Webhooks         []WebhookConfig      `json:"webhooks"`         // HTTP endpoints alerts are posted to as signed JSON
+	DrainTimeout     string               `json:"drainTimeout"`     // how long to wait for live connections to finish on shutdown, e.g. "30s"
+	BufferSize       int                  `json:"bufferSize"`       // the size in bytes of the buffers used to copy proxied data, defaults to 32768
+	HalfCloseTimeout string               `json:"halfCloseTimeout"` // how long one direction of a connection may run on after the other has closed, defaults to "30s"
+	SessionsPath     string               `json:"sessionsPath"`     // the path to the session history file, defaults to "sessions.jsonl"
+	UsersPath        string               `json:"usersPath"`        // the path to the file of registered users managed with the user command, defaults to "users.json"
+	TOTP             TOTPConfig           `json:"totp"`             // lets enrolled users authorize their own IP with TOTP codes instead of email approval
+	AccessRequests   AccessRequestsConfig `json:"accessRequests"`   // lets users ask administrators for access on a web page before connecting
+	OIDC             OIDCConfig           `json:"oidc"`             // lets users authorize their own IP on routes with oidcGroups by signing in through an OpenID Connect provider
+}
+
+// configuration for signing in through an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer           string   `json:"issuer"`           // the issuer URL of the provider, empty to not offer OIDC sign in
+	ClientID         string   `json:"clientID"`         // the client ID gatekeeper is registered with at the provider
+	ClientSecretEnv  string   `json:"clientSecretEnv"`  // the name of an environment variable holding the client secret
+	ClientSecretFile string   `json:"clientSecretFile"` // the path to a file holding the client secret, used if clientSecretEnv is empty - neither is needed for a public client
+	RedirectURL      string   `json:"redirectURL"`      // the callback URL registered with the provider, defaults to the defaultApiUrl followed by "/oidc/callback"
+	Scopes           []string `json:"scopes"`           // the scopes requested besides openid, defaults to profile and email - some providers need "groups" to send the groups claim
+	UsernameClaim    string   `json:"usernameClaim"`    // the ID token claim users are named by, defaults to "preferred_username"
+	GroupsClaim      string   `json:"groupsClaim"`      // the ID token claim listing the user's groups, defaults to "groups"
+}
+
+// returns whether or not OIDC sign in is configured
+func (o *OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// returns the client secret from its environment variable or file,
+// or an empty string for a public client
+func (o *OIDCConfig) GetClientSecret() (string, error) {
+	return readSecret(o.ClientSecretEnv, o.ClientSecretFile)
+}
+
+// returns the callback URL, defaulting to the callback of the API's public URL
+func (c *ApplicationConfig) GetOIDCRedirectURL() string {
+	if c.OIDC.RedirectURL == "" {
+		return strings.TrimSuffix(c.DefaultApiUrl, "/") + "/oidc/callback"
+	}
+	return c.OIDC.RedirectURL
+}
+
+// returns the administrators who can each approve with their own personal
+// link, which are the emails with any repeats removed
+func (c *ApplicationConfig) GetApprovers() []string {
+	seen := map[string]bool{}
+	var approvers []string
+	for _, email := range c.Emails {
+		if email != "" && !seen[email] {
+			seen[email] = true
+			approvers = append(approvers, email)
+		}
+	}
+	return approvers
+}
+
+// returns the scopes requested besides openid, defaulting to profile and email
+func (o *OIDCConfig) GetScopes() []string {
+	if len(o.Scopes) == 0 {
+		return []string{"profile", "email"}
+	}
+	return o.Scopes
+}
+
+// returns the claim users are named by, defaulting to preferred_username
+func (o *OIDCConfig) GetUsernameClaim() string {
+	if o.UsernameClaim == "" {
+		return "preferred_username"
+	}
+	return o.UsernameClaim
+}
+
+// returns the claim listing the user's groups, defaulting to groups
+func (o *OIDCConfig) GetGroupsClaim() string {
+	if o.GroupsClaim == "" {
+		return "groups"
+	}
+	return o.GroupsClaim
+}
+
+// configuration for the access request page
+type AccessRequestsConfig struct {
+	Enabled bool   `json:"enabled"` // serves the access request page at /api/request
+	MaxTTL  string `json:"maxTTL"`  // the longest access which may be requested, defaults to "24h" - "0s" means no limit
+}
+
+// parses the longest access which may be requested, defaulting to 24 hours
+func (a *AccessRequestsConfig) GetMaxTTL() (time.Duration, error) {
+	return parseOptionalDuration(a.MaxTTL, 24*time.Hour)
+}
+
+// configuration for TOTP self-authorization
+type TOTPConfig struct {
+	Enabled  bool   `json:"enabled"`  // accepts TOTP codes of enrolled users on the login page at /api/login
+	Issuer   string `json:"issuer"`   // the name authenticator apps show the codes under, defaults to "Gatekeeper"
+	GrantTTL string `json:"grantTTL"` // how long a self-authorized IP stays whitelisted, defaults to "12h" - "0s" means no expiry
+}
+
+// returns the issuer, defaulting to Gatekeeper
+func (t *TOTPConfig) GetIssuer() string {
+	if t.Issuer == "" {
+		return "Gatekeeper"
+	}
+	return t.Issuer
+}
+
+// parses the grant ttl, defaulting to 12 hours
+func (t *TOTPConfig) GetGrantTTL() (time.Duration, error) {
+	return parseOptionalDuration(t.GrantTTL, 12*time.Hour)
+}
+
+// configuration for serving the REST API over HTTPS
+type APITLSConfig struct {
+	CertFile        string `json:"certFile"`        // the path to the PEM encoded certificate chain, empty to serve plain HTTP
+	KeyFile         string `json:"keyFile"`         // the path to the PEM encoded private key
+	SelfSigned      bool   `json:"selfSigned"`      // generates a self-signed certificate on first run if the files do not exist - for development only
+	RedirectAddress string `json:"redirectAddress"` // an optional address to serve plain HTTP on which redirects every request to HTTPS
+	ReloadInterval  string `json:"reloadInterval"`  // how often the files are checked for changes and reloaded, defaults to "1m" - "0s" disables it
+}
+
+// returns whether or not the REST API should be served over HTTPS
+func (t *APITLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+// returns the certificate file, defaulting to gatekeeper.crt for a self-signed certificate
+func (t *APITLSConfig) GetCertFile() string {
+	if t.CertFile == "" && t.SelfSigned {
+		return "gatekeeper.crt"
+	}
+	return t.CertFile
+}
+
+// returns the key file, defaulting to gatekeeper.key for a self-signed certificate
+func (t *APITLSConfig) GetKeyFile() string {
+	if t.KeyFile == "" && t.SelfSigned {
+		return "gatekeeper.key"
+	}
+	return t.KeyFile
+}
+
+// parses the reload interval, returning the default if none is configured
+func (t *APITLSConfig) GetReloadInterval() (time.Duration, error) {
+	return parseOptionalDuration(t.ReloadInterval, time.Minute)
+}
+
+// configuration for a bearer token allowed to use the REST API
+type APITokenConfig struct {
+	Name   string   `json:"name"`   // a human readable name of who or what uses the token
+	Hash   string   `json:"hash"`   // the SHA-256 hash of the token as printed by the token command, e.g. "sha256:<hex>"
+	Scopes []string `json:"scopes"` // the scopes the token grants, any of authentication.Scopes: "read-log", "manage-whitelist" and "kill-sessions"
+}
+
+// configuration for an HTTP webhook alerts are posted to
+type WebhookConfig struct {
+	URL        string `json:"url"`        // the endpoint the alerts are posted to
+	SecretEnv  string `json:"secretEnv"`  // the name of an environment variable holding the HMAC signing secret
+	SecretFile string `json:"secretFile"` // the path to a file holding the HMAC signing secret, used if secretEnv is empty
+}
+
+// returns the webhook's signing secret from its environment variable or file
+func (w *WebhookConfig) GetSecret() (string, error) {
+	return readSecret(w.SecretEnv, w.SecretFile)
+}
+
+// configuration for the SMTP server alert emails are sent through
+type SMTPConfig struct {
+	Host               string `json:"host"`               // the hostname of the SMTP server
+	Port               int    `json:"port"`               // the port of the SMTP server, usually 587 for STARTTLS or 465 for implicit TLS
+	Username           string `json:"username"`           // the username to authenticate with, empty to not authenticate
+	PasswordEnv        string `json:"passwordEnv"`        // the name of an environment variable holding the password
+	PasswordFile       string `json:"passwordFile"`       // the path to a file holding the password, used if passwordEnv is empty
+	From               string `json:"from"`               // the sender of alert emails, e.g. "RDP Gatekeeper <alerts@gatekeeper.io>"
+	TLSMode            string `json:"tlsMode"`            // one of the authentication.SMTP* modes, "starttls" (the default), "tls" for implicit TLS or "none"
+	CAFile             string `json:"caFile"`             // optional path to a PEM bundle of CAs to verify the server with instead of the system pool
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // disables verification of the server's certificate - only for testing
+}
+
+// returns the SMTP password from the configured environment
+// variable or file, or an empty string if neither is configured
+func (s *SMTPConfig) GetPassword() (string, error) {
+	return readSecret(s.PasswordEnv, s.PasswordFile)
+}
+
+// reads a secret from an environment variable, or from a file if no
+// variable is named, so secrets never have to be written into the config
+func readSecret(env string, filepath string) (string, error) {
+	if env != "" {
+		secret, has := os.LookupEnv(env)
+		if !has {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return secret, nil
+	}
+	if filepath != "" {
+		data, err := ioutil.ReadFile(filepath)
+		if err != nil {
+			return "", err
+		}
+		// trailing newlines are trimmed as most editors add one
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// returns the TLS mode, defaulting to STARTTLS if none is configured
+func (s *SMTPConfig) GetTLSMode() string {
+	if s.TLSMode == "" {
+		return authentication.SMTPStartTLS
+	}
+	return strings.ToLower(s.TLSMode)
+}
+
+// configuration for a single listener-to-backend route of the proxy
+type RouteConfig struct {
+	Name              string              `json:"name"`              // a human readable name of the route used in logs and alerts
+	ListenAddress     string              `json:"listenAddress"`     // the address this route's tcp listener accepts incoming connections on
+	Backend           string              `json:"backend"`           // the address of the target service incoming connections are piped to
+	Backends          []string            `json:"backends"`          // several target services to balance connections across, used instead of backend
+	Balance           string              `json:"balance"`           // how a backend is picked: "round-robin" (the default), "least-connections" or "source-ip"
+	HealthCheck       HealthCheckConfig   `json:"healthCheck"`       // active TCP health checks of the route's backends
+	Whitelist         []string            `json:"whitelist"`         // optional IP addresses that are always allowed on this route without MFA
+	GrantTTL          string              `json:"grantTTL"`          // how long an approved IP stays whitelisted by default, e.g. "12h" - empty means no expiry
+	FallbackBackends  []string            `json:"fallbackBackends"`  // optional backends tried in order when the backend cannot be reached
+	DialTimeout       string              `json:"dialTimeout"`       // how long a single dial to a backend may take, defaults to "5s"
+	DialRetries       int                 `json:"dialRetries"`       // how many more times the backends are tried after the first attempt fails
+	DialBackoff       string              `json:"dialBackoff"`       // the wait before the first retry, doubled for every retry after, defaults to "250ms"
+	TLS               RouteTLSConfig      `json:"tls"`               // optional TLS termination of incoming connections and re-encryption to the backends
+	ServerNames       []string            `json:"serverNames"`       // TLS server names this route serves, letting routes share a listenAddress - e.g. "rdp.example.com" or "*.example.com"
+	SNIDefault        bool                `json:"sniDefault"`        // serves clients on the listenAddress asking for a server name no route serves, otherwise they are rejected
+	ProxyProtocol     ProxyProtocolConfig `json:"proxyProtocol"`     // PROXY protocol headers read from upstream load balancers and sent to the backends
+	OIDCGroups        []string            `json:"oidcGroups"`        // groups whose members may authorize their own IP on this route for its grantTTL by signing in through OIDC, "*" for everyone - empty to not allow it
+	RequiredApprovals int                 `json:"requiredApprovals"` // how many administrators in emails must each approve with their personal link before an IP is whitelisted, defaults to 1
+}
+
+// configuration for the HAProxy PROXY protocol on a route
+type ProxyProtocolConfig struct {
+	TrustedUpstreams []string `json:"trustedUpstreams"` // IP addresses and CIDR blocks of load balancers whose connections must start with a PROXY header naming the real client
+	Send             string   `json:"send"`             // sends a PROXY header to the backends: "v1", "v2" or empty for none
+}
+
+// the accepted values of ProxyProtocolConfig.Send
+const (
+	ProxyProtocolNone = ""
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+)
+
+// configuration for terminating TLS on a route - when a certificate is
+// configured clients connect with TLS and their plaintext is piped on
+type RouteTLSConfig struct {
+	CertFile           string           `json:"certFile"`           // the path to the PEM encoded certificate chain, empty to pass bytes through untouched
+	KeyFile            string           `json:"keyFile"`            // the path to the PEM encoded private key
+	ClientCAFile       string           `json:"clientCAFile"`       // optional path to a PEM bundle of CAs client certificates are verified against
+	RequireClientCert  bool             `json:"requireClientCert"`  // rejects clients without a certificate from the client CAs
+	ClientCertSkipsMFA bool             `json:"clientCertSkipsMFA"` // lets clients with a certificate from the client CAs in without email MFA
+	Backend            BackendTLSConfig `json:"backend"`            // re-encrypts the piped connection to the backends
+}
+
+// returns whether or not TLS is terminated on the route
+func (t *RouteTLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// configuration for re-encrypting connections to a route's backends with TLS
+type BackendTLSConfig struct {
+	Enabled            bool   `json:"enabled"`            // connects to the backends with TLS instead of plaintext
+	ServerName         string `json:"serverName"`         // the name the backends' certificates are verified against, defaults to each backend's host
+	CAFile             string `json:"caFile"`             // optional path to a PEM bundle of CAs to verify the backends with instead of the system pool
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // disables verification of the backends' certificates - only for testing
+}
+
+// the accepted values of RouteConfig.Balance
+const (
+	BalanceRoundRobin       = "round-robin"       // each connection goes to the next backend in turn
+	BalanceLeastConnections = "least-connections" // each connection goes to the backend with the fewest live connections
+	BalanceSourceIP         = "source-ip"         // connections from the same IP always go to the same backend while it is healthy
+)
+
+// configuration for the active TCP health checks of a route's backends
+type HealthCheckConfig struct {
+	Interval          string `json:"interval"`          // how often every backend is checked, defaults to "10s" - "0s" disables checks
+	Timeout           string `json:"timeout"`           // how long a check may take to connect, defaults to "2s"
+	FailureThreshold  int    `json:"failureThreshold"`  // consecutive failures before a backend is taken out of rotation, defaults to 3
+	RecoveryThreshold int    `json:"recoveryThreshold"` // consecutive successes before a backend is put back in rotation, defaults to 2
+}
+
+// parses the health check interval, returning the default if none is configured
+func (h *HealthCheckConfig) GetInterval() (time.Duration, error) {
+	return parseOptionalDuration(h.Interval, 10*time.Second)
+}
+
+// parses the health check timeout, returning the default if none is configured
+func (h *HealthCheckConfig) GetTimeout() (time.Duration, error) {
+	return parseOptionalDuration(h.Timeout, 2*time.Second)
+}
+
+// returns the failure threshold, or the default if none is configured
+func (h *HealthCheckConfig) GetFailureThreshold() int {
+	if h.FailureThreshold <= 0 {
+		return 3
+	}
+	return h.FailureThreshold
+}
+
+// returns the recovery threshold, or the default if none is configured
+func (h *HealthCheckConfig) GetRecoveryThreshold() int {
+	if h.RecoveryThreshold <= 0 {
+		return 2
+	}
+	return h.RecoveryThreshold
+}
+
+// returns the backends of the route, which is either the backends
+// list or the single backend for older configuration files
+func (r *RouteConfig) GetBackends() []string {
+	if len(r.Backends) > 0 {
+		return r.Backends
+	}
+	if r.Backend == "" {
+		return nil
+	}
+	return []string{r.Backend}
+}
+
+// returns the balancing strategy, defaulting to round-robin if none is configured
+func (r *RouteConfig) GetBalance() string {
+	if r.Balance == "" {
+		return BalanceRoundRobin
+	}
+	return r.Balance
+}
+
+// parses the route's grant ttl, returning 0 if none is configured
+func (r *RouteConfig) GetGrantTTL() (time.Duration, error) {
+	return parseOptionalDuration(r.GrantTTL, 0)
+}
+
+// returns how many administrators must approve an IP on the route, defaulting to 1
+func (r *RouteConfig) GetRequiredApprovals() int {
+	if r.RequiredApprovals < 1 {
+		return 1
+	}
+	return r.RequiredApprovals
+}
+
+// parses the route's dial timeout, returning the default if none is configured
+func (r *RouteConfig) GetDialTimeout() (time.Duration, error) {
+	return parseOptionalDuration(r.DialTimeout, 5*time.Second)
+}
+
+// parses the route's dial backoff, returning the default if none is configured
+func (r *RouteConfig) GetDialBackoff() (time.Duration, error) {
+	return parseOptionalDuration(r.DialBackoff, 250*time.Millisecond)
+}
+
+// parses the authentication code ttl, returning the default if none is configured
+func (c *ApplicationConfig) GetCodeTTL() (time.Duration, error) {
+	return parseOptionalDuration(c.CodeTTL, 15*time.Minute)
+}
+
+// parses the shutdown drain timeout, returning the default if none is configured
+func (c *ApplicationConfig) GetDrainTimeout() (time.Duration, error) {
+	return parseOptionalDuration(c.DrainTimeout, 30*time.Second)
+}
+
+// parses the half-close timeout, returning the default if none is configured
+func (c *ApplicationConfig) GetHalfCloseTimeout() (time.Duration, error) {
+	return parseOptionalDuration(c.HalfCloseTimeout, 30*time.Second)
+}
+
+// returns the copy buffer size, defaulting to 32 KB if none is configured
+func (c *ApplicationConfig) GetBufferSize() int {
+	if c.BufferSize == 0 {
+		return 32 * 1024
+	}
+	return c.BufferSize
+}
+
+// returns the path to the API token file, defaulting
+// to tokens.json if none is configured
+func (c *ApplicationConfig) GetApiTokensPath() string {
+	if c.ApiTokensPath == "" {
+		return "tokens.json"
+	}
+	return c.ApiTokensPath
+}
+
+// returns the path to the registered users file, defaulting to users.json
+func (c *ApplicationConfig) GetUsersPath() string {
+	if c.UsersPath == "" {
+		return "users.json"
+	}
+	return c.UsersPath
+}
+
+// returns the path to the session history file, defaulting
+// to sessions.jsonl if none is configured
+func (c *ApplicationConfig) GetSessionsPath() string {
+	if c.SessionsPath == "" {
+		return "sessions.jsonl"
+	}
+	return c.SessionsPath
+}
+
+// parses the deny block ttl, returning 0 if none is configured
+func (c *ApplicationConfig) GetDenyBlockTTL() (time.Duration, error) {
+	return parseOptionalDuration(c.DenyBlockTTL, 0)
+}
+
+// parses an optional, non-negative duration such as "12h",
+// returning the fallback if the value is empty
+func parseOptionalDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("duration must not be negative")
+	}
+	return duration, nil
+}
+
+// returns the routes the proxy server should serve - if no routes are
+// configured, a single route is built from the legacy proxyAddress and
+// redirectAddress fields so that older configuration files still work
+func (c *ApplicationConfig) GetRoutes() []RouteConfig {
+	if len(c.Routes) > 0 {
+		return c.Routes
+	}
+	return []RouteConfig{{
+		Name:          "default",
+		ListenAddress: c.ProxyAddress,
+		Backend:       c.RedirectAddress,
+	}}
+}
+
+// checks that the configuration is usable, returning an error
+// describing the first problem found
+func (c *ApplicationConfig) Validate() error {
+	if ttl, err := c.GetCodeTTL(); err != nil || ttl == 0 {
+		return fmt.Errorf("codeTTL must be a positive duration")
+	}
+	if _, err := c.GetDenyBlockTTL(); err != nil {
+		return fmt.Errorf("invalid denyBlockTTL: %s", err)
+	}
+	if _, err := c.GetDrainTimeout(); err != nil {
+		return fmt.Errorf("invalid drainTimeout: %s", err)
+	}
+	if timeout, err := c.GetHalfCloseTimeout(); err != nil || timeout == 0 {
+		return fmt.Errorf("halfCloseTimeout must be a positive duration")
+	}
+	if c.BufferSize < 0 || c.BufferSize > 16*1024*1024 {
+		return fmt.Errorf("bufferSize must be between 0 and 16777216 bytes")
+	}
+
+	// the SMTP section is only checked when a server is configured,
+	// which it must be for alerts to be emailed
+	if len(c.Emails) > 0 && c.SMTP.Host == "" {
+		return fmt.Errorf("smtp: host must be set to email alerts to emails")
+	}
+	if c.SMTP.Host != "" {
+		if c.SMTP.Port <= 0 || c.SMTP.Port > 65535 {
+			return fmt.Errorf("smtp: invalid port %d", c.SMTP.Port)
+		}
+		switch c.SMTP.GetTLSMode() {
+		case authentication.SMTPStartTLS, authentication.SMTPImplicit, authentication.SMTPNoTLS:
+		default:
+			return fmt.Errorf("smtp: unknown tlsMode %q", c.SMTP.TLSMode)
+		}
+		if c.SMTP.From == "" {
+			return fmt.Errorf("smtp: from must not be empty")
+		}
+	}
+
+	if c.ApiTLS.Enabled() && !c.ApiTLS.SelfSigned && (c.ApiTLS.CertFile == "" || c.ApiTLS.KeyFile == "") {
+		return fmt.Errorf("apiTLS: certFile and keyFile must both be set")
+	}
+	if c.ApiTLS.RedirectAddress != "" && !c.ApiTLS.Enabled() {
+		return fmt.Errorf("apiTLS: redirectAddress needs a certificate to redirect to")
+	}
+	if _, err := c.ApiTLS.GetReloadInterval(); err != nil {
+		return fmt.Errorf("apiTLS: invalid reloadInterval: %s", err)
+	}
+
+	if _, err := c.TOTP.GetGrantTTL(); err != nil {
+		return fmt.Errorf("totp: invalid grantTTL: %s", err)
+	}
+	if _, err := c.AccessRequests.GetMaxTTL(); err != nil {
+		return fmt.Errorf("accessRequests: invalid maxTTL: %s", err)
+	}
+	if c.OIDC.Enabled() {
+		if issuer, err := url.Parse(c.OIDC.Issuer); err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+			return fmt.Errorf("oidc: issuer must be an http or https URL")
+		}
+		if c.OIDC.ClientID == "" {
+			return fmt.Errorf("oidc: clientID must not be empty")
+		}
+		if redirect, err := url.Parse(c.GetOIDCRedirectURL()); err != nil || !redirect.IsAbs() {
+			return fmt.Errorf("oidc: redirectURL must be an absolute URL")
+		}
+	}
+	if _, err := ipset.NewIPSet(c.TrustedProxies...); err != nil {
+		return fmt.Errorf("trustedProxies: %s", err)
+	}
+
+	for i, token := range c.ApiTokens {
+		if token.Name == "" {
+			return fmt.Errorf("api token %d: name must not be empty", i)
+		}
+		if err := authentication.ValidateTokenHash(token.Hash); err != nil {
+			return fmt.Errorf("api token %s: %s", token.Name, err)
+		}
+		for _, scope := range token.Scopes {
+			if err := authentication.ValidateScope(scope); err != nil {
+				return fmt.Errorf("api token %s: %s", token.Name, err)
+			}
+		}
+	}
+
+	for i, webhook := range c.Webhooks {
+		if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+			return fmt.Errorf("webhook %d: url must be an http or https URL", i)
+		}
+		if webhook.SecretEnv == "" && webhook.SecretFile == "" {
+			return fmt.Errorf("webhook %d: a secretEnv or secretFile is required to sign alerts", i)
+		}
+	}
+
+	// map of route names already seen so duplicates can be detected
+	names := map[string]bool{}
+
+	// maps of listen addresses to their routes and to the server names
+	// already served on them, so shared addresses can be checked
+	addresses := map[string][]RouteConfig{}
+	serverNames := map[string]map[string]string{}
+
+	for i, route := range c.GetRoutes() {
+		if route.Name == "" {
+			return fmt.Errorf("route %d: name must not be empty", i)
+		}
+		if names[route.Name] {
+			return fmt.Errorf("route %s: duplicate route name", route.Name)
+		}
+		names[route.Name] = true
+
+		if route.ListenAddress == "" {
+			return fmt.Errorf("route %s: listenAddress must not be empty", route.Name)
+		}
+		addresses[route.ListenAddress] = append(addresses[route.ListenAddress], route)
+		if serverNames[route.ListenAddress] == nil {
+			serverNames[route.ListenAddress] = map[string]string{}
+		}
+		for _, name := range route.ServerNames {
+			name = strings.ToLower(name)
+			if name == "" || strings.Contains(name[1:], "*") || (strings.HasPrefix(name, "*") && !strings.HasPrefix(name, "*.")) {
+				return fmt.Errorf("route %s: invalid server name %q", route.Name, name)
+			}
+			if other, has := serverNames[route.ListenAddress][name]; has {
+				return fmt.Errorf("route %s: server name %s is already served by route %s", route.Name, name, other)
+			}
+			serverNames[route.ListenAddress][name] = route.Name
+		}
+		if len(route.GetBackends()) == 0 {
+			return fmt.Errorf("route %s: backend or backends must be set", route.Name)
+		}
+		for _, backend := range route.GetBackends() {
+			if backend == "" {
+				return fmt.Errorf("route %s: backends must not contain empty addresses", route.Name)
+			}
+		}
+		switch route.GetBalance() {
+		case BalanceRoundRobin, BalanceLeastConnections, BalanceSourceIP:
+		default:
+			return fmt.Errorf("route %s: unknown balance %q", route.Name, route.Balance)
+		}
+		if _, err := route.HealthCheck.GetInterval(); err != nil {
+			return fmt.Errorf("route %s: invalid healthCheck interval: %s", route.Name, err)
+		}
+		if timeout, err := route.HealthCheck.GetTimeout(); err != nil || timeout == 0 {
+			return fmt.Errorf("route %s: healthCheck timeout must be a positive duration", route.Name)
+		}
+		if _, err := ipset.NewIPSet(route.Whitelist...); err != nil {
+			return fmt.Errorf("route %s: %s", route.Name, err)
+		}
+		if _, err := route.GetGrantTTL(); err != nil {
+			return fmt.Errorf("route %s: invalid grantTTL: %s", route.Name, err)
+		}
+		if timeout, err := route.GetDialTimeout(); err != nil || timeout == 0 {
+			return fmt.Errorf("route %s: dialTimeout must be a positive duration", route.Name)
+		}
+		if _, err := route.GetDialBackoff(); err != nil {
+			return fmt.Errorf("route %s: invalid dialBackoff: %s", route.Name, err)
+		}
+		if route.DialRetries < 0 {
+			return fmt.Errorf("route %s: dialRetries must not be negative", route.Name)
+		}
+		for _, fallback := range route.FallbackBackends {
+			if fallback == "" {
+				return fmt.Errorf("route %s: fallbackBackends must not contain empty addresses", route.Name)
+			}
+		}
+		if route.TLS.Enabled() && route.TLS.KeyFile == "" {
+			return fmt.Errorf("route %s: tls keyFile must be set", route.Name)
+		}
+		if !route.TLS.Enabled() && (route.TLS.ClientCAFile != "" || route.TLS.RequireClientCert || route.TLS.ClientCertSkipsMFA) {
+			return fmt.Errorf("route %s: client certificates need a tls certFile to be set", route.Name)
+		}
+		if (route.TLS.RequireClientCert || route.TLS.ClientCertSkipsMFA) && route.TLS.ClientCAFile == "" {
+			return fmt.Errorf("route %s: client certificates need a tls clientCAFile to verify them", route.Name)
+		}
+		if _, err := ipset.NewIPSet(route.ProxyProtocol.TrustedUpstreams...); err != nil {
+			return fmt.Errorf("route %s: proxyProtocol trustedUpstreams: %s", route.Name, err)
+		}
+		switch route.ProxyProtocol.Send {
+		case ProxyProtocolNone, ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			return fmt.Errorf("route %s: unknown proxyProtocol send %q", route.Name, route.ProxyProtocol.Send)
+		}
+		if len(route.OIDCGroups) > 0 && !c.OIDC.Enabled() {
+			return fmt.Errorf("route %s: oidcGroups need an oidc issuer to be configured", route.Name)
+		}
+		if route.RequiredApprovals < 0 {
+			return fmt.Errorf("route %s: requiredApprovals must not be negative", route.Name)
+		}
+		if route.RequiredApprovals > 1 && route.RequiredApprovals > len(c.GetApprovers()) {
+			return fmt.Errorf("route %s: requiredApprovals of %d needs at least as many different emails", route.Name, route.RequiredApprovals)
+		}
+		if route.RequiredApprovals > 1 && c.SMTP.Host == "" {
+			// personal approval links are only sent by email, so without it nobody could approve
+			return fmt.Errorf("route %s: requiredApprovals of %d needs smtp.host to send personal approval links", route.Name, route.RequiredApprovals)
+		}
+		if route.RequiredApprovals > 1 && len(route.OIDCGroups) > 0 {
+			return fmt.Errorf("route %s: oidcGroups cannot be used on a route needing several approvals", route.Name)
+		}
+	}
+
+	// routes may only share a listen address if they are picked between
+	// by server name, with at most one serving every other server name,
+	// and they must trust the same upstreams as the PROXY header is read
+	// before the server name is
+	for address, routes := range addresses {
+		defaults := 0
+		upstreams := strings.Join(routes[0].ProxyProtocol.TrustedUpstreams, ",")
+		for _, route := range routes {
+			if strings.Join(route.ProxyProtocol.TrustedUpstreams, ",") != upstreams {
+				return fmt.Errorf("route %s: routes sharing listenAddress %s must have the same proxyProtocol trustedUpstreams", route.Name, address)
+			}
+			if route.SNIDefault {
+				defaults++
+			}
+			if len(routes) > 1 && len(route.ServerNames) == 0 && !route.SNIDefault {
+				return fmt.Errorf("route %s: routes sharing listenAddress %s must set serverNames or sniDefault", route.Name, address)
+			}
+		}
+		if defaults > 1 {
+			return fmt.Errorf("only one route on listenAddress %s may set sniDefault", address)
+		}
+	}
+	return nil
 }
 
 // determines whether or not a text string is a
@@ -65,6 +743,12 @@ func NewApplicationConfig(filepath string) (ApplicationConfig, error) {
 		return config, err
 	}
 
+	// validates the decoded configuration so mistakes are
+	// reported at startup rather than when a connection arrives
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+
 	// returns our newly defined config
 	return config, nil
 }
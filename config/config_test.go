@@ -1,7 +1,11 @@
 package config
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
 )
 
 func TestConfigurationSystem(t *testing.T) {
@@ -14,12 +18,215 @@ func TestConfigurationSystem(t *testing.T) {
 	t.Logf(
 		`
 		LOADED TEST CONFIGURATION:
-		ProxyAddress: %s,
-		RedirectAddress: %s,
+		Routes: %+v,
 		ApiAddress: %s,
 		LoggerPath: %s,
 		DefaultApiUrl: %s,
 		ApiWhitelist: %v,
 		Emails: %v
-	`, config.ProxyAddress, config.RedirectAddress, config.ApiAddress, config.LoggerPath, config.DefaultApiUrl, config.ApiWhitelist, config.Emails)
+	`, config.GetRoutes(), config.ApiAddress, config.LoggerPath, config.DefaultApiUrl, config.ApiWhitelist, config.Emails)
+}
+
+func TestLegacyRouteFallback(t *testing.T) {
+	config := ApplicationConfig{
+		ProxyAddress:    ":7777",
+		RedirectAddress: "127.0.0.1:3389",
+	}
+
+	routes := config.GetRoutes()
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+	if routes[0].ListenAddress != ":7777" || routes[0].Backend != "127.0.0.1:3389" {
+		t.Errorf("legacy fields not mapped to route: %+v", routes[0])
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDefaultConfigRoutes(t *testing.T) {
+	var config ApplicationConfig
+	if err := json.Unmarshal([]byte(defaultConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+	if len(config.Routes) == 0 {
+		t.Error("default configuration should declare at least one route")
+	}
+}
+
+func TestDuplicateRouteNames(t *testing.T) {
+	config := ApplicationConfig{
+		Routes: []RouteConfig{
+			{Name: "rdp", ListenAddress: ":7777", Backend: "127.0.0.1:3389"},
+			{Name: "rdp", ListenAddress: ":7778", Backend: "127.0.0.1:22"},
+		},
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("expected duplicate route names to be rejected")
+	}
+}
+
+func TestInvalidApiTokens(t *testing.T) {
+	hash := "sha256:" + strings.Repeat("ab", 32)
+	for _, token := range []APITokenConfig{
+		{Name: "", Hash: hash},
+		{Name: "ci", Hash: "plaintext-token"},
+		{Name: "ci", Hash: "sha256:" + strings.Repeat("zz", 32)}, // the right length, but not hex
+		{Name: "ci", Hash: hash, Scopes: []string{"everything"}},
+	} {
+		config := ApplicationConfig{
+			ProxyAddress:    ":7777",
+			RedirectAddress: "127.0.0.1:3389",
+			ApiTokens:       []APITokenConfig{token},
+		}
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected token %+v to be rejected", token)
+		}
+	}
+
+	valid := APITokenConfig{Name: "ci", Hash: hash, Scopes: []string{authentication.ScopeReadLog}}
+	if err := (&ApplicationConfig{ProxyAddress: ":7777", RedirectAddress: "127.0.0.1:3389", ApiTokens: []APITokenConfig{valid}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSharedListenAddress(t *testing.T) {
+	valid := []RouteConfig{
+		{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389", ServerNames: []string{"rdp.example.com"}},
+		{Name: "web", ListenAddress: ":443", Backend: "127.0.0.1:8443", ServerNames: []string{"*.example.com"}, SNIDefault: true},
+	}
+	if err := (&ApplicationConfig{Routes: valid}).Validate(); err != nil {
+		t.Error(err)
+	}
+
+	for _, routes := range [][]RouteConfig{
+		{
+			{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389"},
+			{Name: "web", ListenAddress: ":443", Backend: "127.0.0.1:8443"},
+		},
+		{
+			{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389", SNIDefault: true},
+			{Name: "web", ListenAddress: ":443", Backend: "127.0.0.1:8443", SNIDefault: true},
+		},
+		{
+			{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389", ServerNames: []string{"example.com"}},
+			{Name: "web", ListenAddress: ":443", Backend: "127.0.0.1:8443", ServerNames: []string{"Example.com"}},
+		},
+		{
+			{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389", ServerNames: []string{"rdp*.example.com"}},
+		},
+	} {
+		if err := (&ApplicationConfig{Routes: routes}).Validate(); err == nil {
+			t.Errorf("expected routes %+v to be rejected", routes)
+		}
+	}
+}
+
+func TestEmailsNeedSMTP(t *testing.T) {
+	config := ApplicationConfig{
+		ProxyAddress:    ":7777",
+		RedirectAddress: "127.0.0.1:3389",
+		Emails:          []string{"admin@example.com"},
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("expected emails without an SMTP server to be rejected")
+	}
+	config.SMTP = SMTPConfig{Host: "smtp.example.com", Port: 587, From: "alerts@example.com"}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalidProxyProtocol(t *testing.T) {
+	for _, routes := range [][]RouteConfig{
+		{{Name: "rdp", ListenAddress: ":7777", Backend: "127.0.0.1:3389", ProxyProtocol: ProxyProtocolConfig{TrustedUpstreams: []string{"not-a-cidr"}}}},
+		{{Name: "rdp", ListenAddress: ":7777", Backend: "127.0.0.1:3389", ProxyProtocol: ProxyProtocolConfig{Send: "v3"}}},
+		{
+			{Name: "rdp", ListenAddress: ":443", Backend: "127.0.0.1:3389", ServerNames: []string{"rdp.example.com"}, ProxyProtocol: ProxyProtocolConfig{TrustedUpstreams: []string{"10.0.0.0/8"}}},
+			{Name: "web", ListenAddress: ":443", Backend: "127.0.0.1:8443", SNIDefault: true},
+		},
+	} {
+		if err := (&ApplicationConfig{Routes: routes}).Validate(); err == nil {
+			t.Errorf("expected routes %+v to be rejected", routes)
+		}
+	}
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	config := ApplicationConfig{
+		ProxyAddress:    ":7777",
+		RedirectAddress: "127.0.0.1:3389",
+		TrustedProxies:  []string{"10.0.0.0/8", "proxy.internal"},
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("expected a trusted proxy which is not an address or CIDR to be rejected")
+	}
+}
+
+func TestInvalidOIDC(t *testing.T) {
+	route := RouteConfig{Name: "rdp", ListenAddress: ":7777", Backend: "127.0.0.1:3389", OIDCGroups: []string{"ops"}}
+	for _, config := range []ApplicationConfig{
+		{Routes: []RouteConfig{route}}, // oidcGroups without an issuer
+		{Routes: []RouteConfig{route}, OIDC: OIDCConfig{Issuer: "login.example.com", ClientID: "gatekeeper"}},
+		{Routes: []RouteConfig{route}, OIDC: OIDCConfig{Issuer: "https://login.example.com"}},
+		{Routes: []RouteConfig{route}, OIDC: OIDCConfig{Issuer: "https://login.example.com", ClientID: "gatekeeper", RedirectURL: "/api/oidc/callback"}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", config.OIDC)
+		}
+	}
+
+	valid := ApplicationConfig{
+		Routes:        []RouteConfig{route},
+		DefaultApiUrl: "https://gatekeeper.example.com/api",
+		OIDC:          OIDCConfig{Issuer: "https://login.example.com", ClientID: "gatekeeper"},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	if redirect := valid.GetOIDCRedirectURL(); redirect != "https://gatekeeper.example.com/api/oidc/callback" {
+		t.Errorf("unexpected default redirectURL %s", redirect)
+	}
+}
+
+func TestInvalidRequiredApprovals(t *testing.T) {
+	route := RouteConfig{Name: "rdp", ListenAddress: ":7777", Backend: "127.0.0.1:3389", RequiredApprovals: 3}
+	for _, emails := range [][]string{
+		nil,
+		{"alice@example.com", "bob@example.com"},
+		{"alice@example.com", "bob@example.com", "alice@example.com"}, // repeats are one administrator
+	} {
+		if err := (&ApplicationConfig{Routes: []RouteConfig{route}, Emails: emails}).Validate(); err == nil {
+			t.Errorf("expected requiredApprovals of 3 with emails %v to be rejected", emails)
+		}
+	}
+
+	// personal approval links are only sent by email
+	valid := ApplicationConfig{Routes: []RouteConfig{route}, Emails: []string{"alice@example.com", "bob@example.com", "carol@example.com"}}
+	if err := valid.Validate(); err == nil {
+		t.Error("expected requiredApprovals of 3 without an SMTP server to be rejected")
+	}
+	valid.SMTP = SMTPConfig{Host: "smtp.example.com", Port: 587, From: "alerts@example.com"}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	// signing in through OIDC would skip the approvals
+	valid.OIDC = OIDCConfig{Issuer: "https://login.example.com", ClientID: "gatekeeper"}
+	valid.DefaultApiUrl = "https://gatekeeper.example.com/api"
+	valid.Routes[0].OIDCGroups = []string{"ops"}
+	if err := valid.Validate(); err == nil {
+		t.Error("expected oidcGroups on a route needing several approvals to be rejected")
+	}
+
+	route.RequiredApprovals = -1
+	if err := (&ApplicationConfig{Routes: []RouteConfig{route}}).Validate(); err == nil {
+		t.Error("expected negative requiredApprovals to be rejected")
+	}
+	if approvals := (&RouteConfig{}).GetRequiredApprovals(); approvals != 1 {
+		t.Errorf("expected requiredApprovals to default to 1, got %d", approvals)
+	}
 }
@@ -0,0 +1,122 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/ipset"
+)
+
+// a record of a single finished connection through the proxy
+type Session struct {
+	ID       uint64    `json:"id"`             // the ID the connection had while it was live
+	Route    string    `json:"route"`          // the name of the route the connection was accepted on
+	IP       string    `json:"ip"`             // the IP address of the client
+	User     string    `json:"user,omitempty"` // the registered user of the client, if known
+	Backend  string    `json:"backend"`        // the address of the backend the connection was piped to
+	Start    time.Time `json:"start"`          // when piping started
+	End      time.Time `json:"end"`            // when the connection was closed
+	Duration string    `json:"duration"`       // how long the session lasted, e.g. "1h2m3s"
+	BytesIn  uint64    `json:"bytesIn"`        // the number of bytes sent from the client to the backend
+	BytesOut uint64    `json:"bytesOut"`       // the number of bytes sent from the backend to the client
+	Reason   string    `json:"reason"`         // why the session ended, e.g. "client closed"
+}
+
+// the session history, stored as a file with one JSON encoded session per
+// line so that recording a session only ever appends to the file
+type Store struct {
+	Filepath string     // the path to the session history file
+	file     *os.File   // the history file opened for appending, guarded by mutex
+	mutex    sync.Mutex // guards writes to and reads of the file
+}
+
+// constructor for the session history store - it opens the file
+// for appending, creating it if it does not exist yet
+func NewStore(filepath string) (*Store, error) {
+	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		Filepath: filepath,
+		file:     file,
+	}, nil
+}
+
+// appends a finished session to the history file
+func (s *Store) Record(session Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the record and its newline are written together so that
+	// a session is never split across lines
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// returns every recorded session matching the filters in the order they were
+// recorded - ip may be an address or a CIDR block and matches every session
+// if empty, and only sessions which ended at or after since are returned
+func (s *Store) Query(ip string, since time.Time) ([]Session, error) {
+	// parses the ip filter into a network, nil matches every IP
+	var network *net.IPNet
+	if ip != "" {
+		parsed, err := ipset.ParseEntry(ip)
+		if err != nil {
+			return nil, err
+		}
+		network = parsed
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := os.Open(s.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sessions := []Session{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var session Session
+		if err := json.Unmarshal(scanner.Bytes(), &session); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", s.Filepath, line, err)
+		}
+		if session.End.Before(since) {
+			continue
+		}
+		if network != nil && !network.Contains(net.ParseIP(session.IP)) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, scanner.Err()
+}
+
+// flushes the history file to disk and closes it
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
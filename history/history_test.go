@@ -0,0 +1,63 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	records := []Session{
+		{Route: "rdp", IP: "10.0.0.1", End: now.Add(-48 * time.Hour)},
+		{Route: "rdp", IP: "10.0.0.2", End: now.Add(-time.Hour)},
+		{Route: "rdp", IP: "2001:db8::1", End: now},
+	}
+	for _, session := range records {
+		if err := store.Record(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the history survives the store being reopened
+	store, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	cases := []struct {
+		ip       string
+		since    time.Time
+		expected int
+	}{
+		{"", time.Time{}, 3},
+		{"10.0.0.0/8", time.Time{}, 2},
+		{"10.0.0.2", time.Time{}, 1},
+		{"2001:db8::/32", time.Time{}, 1},
+		{"", now.Add(-24 * time.Hour), 2},
+		{"10.0.0.1", now.Add(-24 * time.Hour), 0},
+	}
+	for _, c := range cases {
+		sessions, err := store.Query(c.ip, c.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != c.expected {
+			t.Errorf("Query(%q, %s): expected %d sessions, got %d", c.ip, c.since, c.expected, len(sessions))
+		}
+	}
+
+	if _, err := store.Query("not an ip", time.Time{}); err == nil {
+		t.Error("expected an invalid ip filter to be rejected")
+	}
+}
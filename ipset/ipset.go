@@ -0,0 +1,214 @@
+package ipset
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// a set of IPv4 and IPv6 addresses and CIDR blocks backed by a binary
+// prefix trie per address family, so lookups take at most 32 or 128 steps
+// no matter how many entries are in the set
+type IPSet struct {
+	v4    *node // root of the trie holding IPv4 prefixes
+	v6    *node // root of the trie holding IPv6 prefixes
+	count int   // the number of prefixes currently held in the set
+}
+
+// a single node of the prefix trie - each level represents one bit
+// of an address, and 'terminal' marks the end of a stored prefix
+type node struct {
+	children [2]*node
+	terminal bool
+	entry    string // the canonical form of the prefix ending here, set while terminal
+}
+
+// constructor for an IPSet, adding every entry given and returning
+// an error for the first entry that is not a valid address or CIDR
+func NewIPSet(entries ...string) (*IPSet, error) {
+	set := &IPSet{v4: &node{}, v6: &node{}}
+	for _, entry := range entries {
+		if err := set.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// parses a whitelist entry which may be either a single IPv4/IPv6 address
+// or a CIDR block and returns it as a network
+func ParseEntry(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+
+	// CIDR blocks are parsed with net.ParseCIDR, masking off any host bits
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %q", entry)
+		}
+		return normalize(network), nil
+	}
+
+	// otherwise treat the entry as a single address with a full-length mask
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", entry)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// returns the canonical text form of an entry - single addresses are written
+// without a prefix length and CIDR blocks are written with their host bits cleared
+func Canonical(entry string) (string, error) {
+	network, err := ParseEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	return canonical(network), nil
+}
+
+// returns the canonical text form of a parsed entry
+func canonical(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+// adds an address or CIDR block to the set
+func (s *IPSet) Add(entry string) error {
+	network, err := ParseEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// walks down the trie creating nodes for every bit of the prefix
+	ones, _ := network.Mask.Size()
+	current := s.root(network.IP)
+	for i := 0; i < ones; i++ {
+		b := bit(network.IP, i)
+		if current.children[b] == nil {
+			current.children[b] = &node{}
+		}
+		current = current.children[b]
+	}
+
+	if !current.terminal {
+		current.terminal = true
+		current.entry = canonical(network)
+		s.count++
+	}
+	return nil
+}
+
+// removes an exact address or CIDR block from the set, returning
+// whether or not the entry was present
+func (s *IPSet) Remove(entry string) bool {
+	network, err := ParseEntry(entry)
+	if err != nil {
+		return false
+	}
+
+	ones, _ := network.Mask.Size()
+	current := s.root(network.IP)
+	for i := 0; i < ones && current != nil; i++ {
+		current = current.children[bit(network.IP, i)]
+	}
+
+	if current == nil || !current.terminal {
+		return false
+	}
+	current.terminal = false
+	current.entry = ""
+	s.count--
+	return true
+}
+
+// returns whether or not an IP address falls within any
+// address or CIDR block held in the set
+func (s *IPSet) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	return s.ContainsIP(ip)
+}
+
+// same as Contains but for an already parsed address
+func (s *IPSet) ContainsIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	// walks down the trie following the bits of the address - any
+	// terminal node passed on the way is a prefix that matches
+	current := s.root(ip)
+	for i := 0; current != nil; i++ {
+		if current.terminal {
+			return true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		current = current.children[bit(ip, i)]
+	}
+	return false
+}
+
+// returns the canonical form of every address or CIDR block held in the set
+// which an IP address falls within, from the widest block to the narrowest
+func (s *IPSet) Matching(address string) []string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	// walks down the trie in the same way as ContainsIP, collecting
+	// every terminal node rather than stopping at the first
+	var matching []string
+	current := s.root(ip)
+	for i := 0; current != nil; i++ {
+		if current.terminal {
+			matching = append(matching, current.entry)
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		current = current.children[bit(ip, i)]
+	}
+	return matching
+}
+
+// returns the number of entries held in the set
+func (s *IPSet) Len() int {
+	return s.count
+}
+
+// returns the trie root for the address family of an IP
+func (s *IPSet) root(ip net.IP) *node {
+	if len(ip) == net.IPv4len {
+		return s.v4
+	}
+	return s.v6
+}
+
+// function to normalize a network so IPv4 networks always use
+// a 4 byte representation
+func normalize(network *net.IPNet) *net.IPNet {
+	if v4 := network.IP.To4(); v4 != nil && len(network.Mask) == net.IPv4len {
+		return &net.IPNet{IP: v4, Mask: network.Mask}
+	}
+	return network
+}
+
+// returns the i-th most significant bit of an IP address
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,120 @@
+package ipset
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIPSetMatching(t *testing.T) {
+	set, err := NewIPSet("10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"10.1.2.3":         true,
+		"11.0.0.1":         false,
+		"192.168.1.10":     true,
+		"192.168.1.11":     false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"::1":              true,
+		"::ffff:10.9.9.9":  true,
+		"not an address":   false,
+		"2001:0db8:ffff::": true,
+	}
+
+	for ip, expected := range cases {
+		if set.Contains(ip) != expected {
+			t.Errorf("Contains(%q) = %v, expected %v", ip, !expected, expected)
+		}
+	}
+}
+
+func TestIPSetMatchingEntries(t *testing.T) {
+	set, err := NewIPSet("10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", "2001:db8::/32", "10.2.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every entry an address falls within, from the widest to the narrowest
+	cases := map[string]string{
+		"10.1.2.3":        "[10.0.0.0/8 10.1.0.0/16 10.1.2.3]",
+		"10.1.9.9":        "[10.0.0.0/8 10.1.0.0/16]",
+		"::ffff:10.2.0.1": "[10.0.0.0/8 10.2.0.0/16]",
+		"2001:db8::1":     "[2001:db8::/32]",
+		"11.0.0.1":        "[]",
+		"not an address":  "[]",
+	}
+	for ip, expected := range cases {
+		if matching := fmt.Sprint(set.Matching(ip)); matching != expected {
+			t.Errorf("Matching(%q) = %s, expected %s", ip, matching, expected)
+		}
+	}
+
+	set.Remove("10.1.0.0/16")
+	if matching := fmt.Sprint(set.Matching("10.1.2.3")); matching != "[10.0.0.0/8 10.1.2.3]" {
+		t.Errorf("expected a removed entry not to match, got %s", matching)
+	}
+}
+
+func TestIPSetRemove(t *testing.T) {
+	set, err := NewIPSet("10.0.0.0/8", "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !set.Remove("10.0.0.0/8") {
+		t.Error("expected 10.0.0.0/8 to be removed")
+	}
+	if set.Contains("10.2.0.1") {
+		t.Error("10.2.0.1 should no longer match")
+	}
+	if !set.Contains("10.1.0.1") {
+		t.Error("10.1.0.1 should still match 10.1.0.0/16")
+	}
+	if set.Remove("10.0.0.0/8") {
+		t.Error("removing an absent entry should return false")
+	}
+	if set.Len() != 1 {
+		t.Errorf("expected 1 entry, got %d", set.Len())
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	cases := map[string]string{
+		"10.1.2.3/8":      "10.0.0.0/8",
+		"192.168.0.1":     "192.168.0.1",
+		"192.168.0.1/32":  "192.168.0.1",
+		"2001:DB8::1/32":  "2001:db8::/32",
+		" 2001:db8::1 ":   "2001:db8::1",
+		"::ffff:10.0.0.1": "10.0.0.1",
+	}
+
+	for entry, expected := range cases {
+		canonical, err := Canonical(entry)
+		if err != nil {
+			t.Errorf("Canonical(%q): %s", entry, err)
+			continue
+		}
+		if canonical != expected {
+			t.Errorf("Canonical(%q) = %q, expected %q", entry, canonical, expected)
+		}
+	}
+
+	if _, err := Canonical("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid prefix length to be rejected")
+	}
+}
+
+func BenchmarkIPSetContains(b *testing.B) {
+	set, _ := NewIPSet()
+	for i := 0; i < 10000; i++ {
+		_ = set.Add(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains("10.39.15.200")
+	}
+}
@@ -5,24 +5,47 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 )
 
+// the program's log, written to the console and a file and
+// cached in memory so it can be served by the API
 type Logger struct {
-	File *os.File
-	CachedLog []byte
+	File      *os.File
+	CachedLog []byte     // guarded by mutex, read it through Cached
+	mutex     sync.Mutex // guards CachedLog and writes to File
 }
 
 func (l *Logger) Write(data []byte) (n int, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	fmt.Print(string(data))
 	l.CachedLog = append(l.CachedLog, data...)
 	return l.File.Write(data)
 }
 
+// returns a copy of the cached log that is safe to use
+// while the log is being written to
+func (l *Logger) Cached() []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	cached := make([]byte, len(l.CachedLog))
+	copy(cached, l.CachedLog)
+	return cached
+}
+
+// flushes the log file to disk and closes it
 func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.File.Sync(); err != nil {
+		_ = l.File.Close()
+		return err
+	}
 	return l.File.Close()
 }
 
-func InitializeLogger(filepath string) Logger {
+func InitializeLogger(filepath string) *Logger {
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
 		file, err := os.Create(filepath)
 		if err != nil {
@@ -31,7 +54,7 @@ func InitializeLogger(filepath string) Logger {
 		file.Close()
 	}
 
-	file, err := os.OpenFile(filepath, os.O_RDWR, 0644)
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		panic(err)
 	}
@@ -39,10 +62,10 @@ func InitializeLogger(filepath string) Logger {
 	if err != nil {
 		panic(err)
 	}
-	logger := Logger{
-		File: file,
+	logger := &Logger{
+		File:      file,
 		CachedLog: cached,
 	}
-	log.SetOutput(&logger)
+	log.SetOutput(logger)
 	return logger
 }
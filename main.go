@@ -1,17 +1,62 @@
 package main
 
 import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/saifsuleman/gatekeeper/config"
 	"github.com/saifsuleman/gatekeeper/logger"
 	"github.com/saifsuleman/gatekeeper/server"
 )
 
 func main() {
+	// the token and user commands manage API tokens and registered
+	// users instead of running the proxy
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runTokenCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		os.Exit(runUserCommand(os.Args[2:]))
+	}
+
 	appConfig, err := config.NewApplicationConfig("config.json")
 	if err != nil {
 		panic(err)
 	}
 	l := logger.InitializeLogger(appConfig.LoggerPath)
 	proxyServer := server.NewProxyServer(appConfig, l)
-	proxyServer.Listen()
+
+	// listens for SIGINT and SIGTERM so that a restart drains
+	// live sessions rather than cutting them off
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// SIGHUP reloads the certificates without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Printf("Received SIGHUP, reloading certificates\n")
+			proxyServer.ReloadCertificates()
+		}
+	}()
+
+	go proxyServer.Listen()
+
+	sig := <-signals
+	log.Printf("Received %s, shutting down\n", sig)
+
+	// a second signal skips the drain and exits straight away
+	go func() {
+		<-signals
+		log.Printf("Received second signal, exiting immediately\n")
+		_ = l.Close()
+		os.Exit(1)
+	}()
+
+	proxyServer.Shutdown()
+	log.Printf("Shutdown complete\n")
+	_ = l.Close()
 }
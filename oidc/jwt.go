@@ -0,0 +1,211 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how long after fetching the provider's keys a token signed by an unknown
+// key may make them be fetched again, in case the provider rotated its keys
+const keyRefetchInterval = time.Minute
+
+// a parsed but not yet verified JSON web token
+type jwt struct {
+	algorithm    string // the algorithm the token says it is signed with
+	keyID        string // the ID of the key the token says it is signed with, empty if it does not say
+	signingInput []byte // the encoded header and claims the signature is over
+	signature    []byte // the decoded signature
+	claims       Claims // the decoded claims
+}
+
+// splits a compact JSON web token into its header, claims and signature
+func parseJWT(raw string) (*jwt, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: ID token is not a signed JWT")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: ID token header: %s", err)
+	}
+	token := &jwt{
+		algorithm:    header.Algorithm,
+		keyID:        header.KeyID,
+		signingInput: []byte(parts[0] + "." + parts[1]),
+	}
+	if err := decodeSegment(parts[1], &token.claims); err != nil {
+		return nil, fmt.Errorf("oidc: ID token claims: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: ID token signature: %s", err)
+	}
+	token.signature = signature
+	return token, nil
+}
+
+// decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// a key of a JSON web key set, of which only RSA and P-256 signing keys are used
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// returns the public key of a JSON web key, or an error if it is not a key
+// gatekeeper can verify signatures with
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key %s", k.KeyID)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid key %s", k.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s of key %s", k.Curve, k.KeyID)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid key %s", k.KeyID)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s of key %s", k.KeyType, k.KeyID)
+}
+
+// verifies a token's signature with the provider's key it names, fetching
+// the provider's keys again if it names a key which is not known yet
+func (p *Provider) verifySignature(ctx context.Context, token *jwt) error {
+	// the algorithm is checked before any key is looked at, so that a token
+	// cannot choose an algorithm such as "none" or HS256 to skip verification
+	if token.algorithm != "RS256" && token.algorithm != "ES256" {
+		return fmt.Errorf("oidc: unsupported ID token algorithm %q", token.algorithm)
+	}
+
+	p.mutex.Lock()
+	keys, fetched := p.keys, p.keysFetched
+	p.mutex.Unlock()
+	if err := verifyWithKeys(token, keys); err != errUnknownKey {
+		return err
+	}
+	if !fetched.IsZero() && time.Since(fetched) < keyRefetchInterval {
+		return errUnknownKey
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return err
+	}
+	return verifyWithKeys(token, keys)
+}
+
+// returned when a token is not signed by any of the provider's keys
+var errUnknownKey = errors.New("oidc: ID token is not signed by a key of the provider")
+
+// verifies a token's signature with the key it names, or with every key
+// if it names none, returning errUnknownKey if no key verifies it
+func verifyWithKeys(token *jwt, keys []jsonWebKey) error {
+	digest := sha256.Sum256(token.signingInput)
+	for _, key := range keys {
+		if key.Use == "enc" || (token.keyID != "" && key.KeyID != token.keyID) {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			continue
+		}
+		switch publicKey := publicKey.(type) {
+		case *rsa.PublicKey:
+			if token.algorithm == "RS256" && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], token.signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// ES256 signatures are the 32 byte r and s values one after the other
+			if token.algorithm == "ES256" && len(token.signature) == 64 {
+				r := new(big.Int).SetBytes(token.signature[:32])
+				s := new(big.Int).SetBytes(token.signature[32:])
+				if ecdsa.Verify(publicKey, digest[:], r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errUnknownKey
+}
+
+// fetches the provider's keys from its JSON web key set
+func (p *Provider) fetchKeys(ctx context.Context) ([]jsonWebKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	status, err := p.do(request, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: fetching keys: %s", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: fetching keys: unexpected status %d", status)
+	}
+
+	p.mutex.Lock()
+	p.keys, p.keysFetched = set.Keys, time.Now()
+	p.mutex.Unlock()
+	return set.Keys, nil
+}
@@ -0,0 +1,269 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the most of a response from the provider which is read, so a
+// misbehaving provider cannot make gatekeeper buffer without end
+const maxResponseSize = 1 << 20
+
+// an OpenID Connect provider which users sign in through with the authorization
+// code flow and PKCE - its endpoints are discovered from the issuer URL and its
+// ID tokens are verified against the keys it publishes, so it is safe for
+// concurrent use once configured
+type Provider struct {
+	Issuer       string       // the issuer URL, which must match the issuer of the ID tokens exactly
+	ClientID     string       // the client ID gatekeeper is registered with at the provider
+	ClientSecret string       // the client secret, empty for a public client relying on PKCE alone
+	RedirectURL  string       // the callback URL registered with the provider
+	Scopes       []string     // the scopes requested besides openid
+	Client       *http.Client // the client used to reach the provider, http.DefaultClient if nil
+	mutex        sync.Mutex   // guards the discovery, keys and keysFetched fields
+	discovery    *discovery   // the provider's discovery document, nil until it has been fetched
+	keys         []jsonWebKey // the provider's signing keys, refetched when a token is signed by an unknown key
+	keysFetched  time.Time    // when the keys were last fetched, so unknown keys cannot make gatekeeper refetch them constantly
+}
+
+// the parts of a provider's discovery document which gatekeeper uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// the claims of a verified ID token
+type Claims map[string]interface{}
+
+// returns a claim which is a string, or an empty string if it is missing or is not one
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// returns a claim which is a list of strings, such as a groups claim - a
+// single string is a list of one, as some providers send single groups that way
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// generates a random value which cannot be guessed, used for the state,
+// the nonce and the PKCE code verifier of a sign in
+func RandomValue() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// returns the S256 PKCE code challenge of a code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// returns the URL of the provider's authorization endpoint which a user is
+// sent to in order to sign in, carrying the state and nonce of the sign in
+// and the challenge of its code verifier
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("oidc: invalid authorization_endpoint: %s", err)
+	}
+
+	query := endpoint.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	endpoint.RawQuery = query.Encode()
+	return endpoint.String(), nil
+}
+
+// exchanges the authorization code the provider sent the user back with for
+// an ID token, returning its claims once it has been verified against the
+// nonce of the sign in
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (Claims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// the credentials are form encoded before being used for basic
+		// authentication, as RFC 6749 requires
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(request, &response)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %s", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("oidc: token request: %s %s", response.Error, response.ErrorDescription)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token request: unexpected status %d", status)
+	}
+	if response.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	return p.Verify(ctx, response.IDToken, nonce)
+}
+
+// verifies an ID token's signature against the provider's keys and checks
+// that it was issued by the provider to gatekeeper for the sign in with the
+// nonce and has not expired, returning its claims
+func (p *Provider) Verify(ctx context.Context, rawIDToken string, nonce string) (Claims, error) {
+	token, err := parseJWT(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verifySignature(ctx, token); err != nil {
+		return nil, err
+	}
+
+	claims := token.claims
+	if claims.String("iss") != p.Issuer {
+		return nil, fmt.Errorf("oidc: ID token issued by %q, not %q", claims.String("iss"), p.Issuer)
+	}
+	audiences := claims.Strings("aud")
+	audience := false
+	for _, a := range audiences {
+		audience = audience || a == p.ClientID
+	}
+	if !audience {
+		return nil, errors.New("oidc: ID token was not issued to this client")
+	}
+	if azp := claims.String("azp"); len(audiences) > 1 && azp != p.ClientID {
+		return nil, errors.New("oidc: ID token was not authorized for this client")
+	}
+
+	// a minute of leeway allows for the clocks of gatekeeper and the provider drifting
+	expiry, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("oidc: ID token has no expiry")
+	}
+	if time.Now().Add(-time.Minute).After(time.Unix(int64(expiry), 0)) {
+		return nil, errors.New("oidc: ID token has expired")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+
+	// the nonce ties the token to the sign in it was requested for,
+	// so a token from another sign in cannot be replayed
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("oidc: ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// returns the provider's discovery document, fetching it the first time
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mutex.Lock()
+	d := p.discovery
+	p.mutex.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	d = &discovery{}
+	status, err := p.do(request, d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %s", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery: unexpected status %d", status)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: missing endpoints")
+	}
+
+	p.mutex.Lock()
+	p.discovery = d
+	p.mutex.Unlock()
+	return d, nil
+}
+
+// sends a request to the provider and decodes its JSON response, returning its status
+func (p *Provider) do(request *http.Request, v interface{}) (int, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, v); err != nil && response.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("invalid response: %s", err)
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,132 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/oidc/oidctest"
+)
+
+// returns a provider for a mock issuer, whose client has a secret
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	issuer := oidctest.NewIssuer("gatekeeper", "s3cret/+")
+	t.Cleanup(issuer.Close)
+	return &Provider{
+		Issuer:       issuer.URL,
+		ClientID:     "gatekeeper",
+		ClientSecret: "s3cret/+",
+		RedirectURL:  "https://gatekeeper.example.com/api/oidc/callback",
+		Scopes:       []string{"profile", "groups"},
+	}, issuer
+}
+
+// signs in through the mock issuer, returning the code and state it sends back
+func authorize(t *testing.T, provider *Provider, state string, nonce string, verifier string) (string, string) {
+	authURL, err := provider.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("expected the issuer to redirect back, got %s", response.Status)
+	}
+	location, _ := url.Parse(response.Header.Get("Location"))
+	if !strings.HasPrefix(location.String(), provider.RedirectURL) {
+		t.Fatalf("expected to be sent back to the redirect URL, got %s", location)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	provider, issuer := newTestProvider(t)
+	issuer.SetClaims(map[string]interface{}{"sub": "1234", "preferred_username": "alice", "groups": []string{"admins", "ops"}})
+
+	verifier, _ := RandomValue()
+	code, state := authorize(t, provider, "the-state", "the-nonce", verifier)
+	if state != "the-state" {
+		t.Errorf("expected the state to be sent back, got %q", state)
+	}
+
+	claims, err := provider.Exchange(context.Background(), code, verifier, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.String("sub") != "1234" || claims.String("preferred_username") != "alice" {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	if groups := claims.Strings("groups"); len(groups) != 2 || groups[0] != "admins" || groups[1] != "ops" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	// a code can only be exchanged once
+	if _, err := provider.Exchange(context.Background(), code, verifier, "the-nonce"); err == nil {
+		t.Error("expected a used code to be refused")
+	}
+}
+
+func TestExchangeNeedsVerifierAndNonce(t *testing.T) {
+	provider, _ := newTestProvider(t)
+
+	// the issuer refuses a code exchanged without its verifier
+	verifier, _ := RandomValue()
+	code, _ := authorize(t, provider, "state", "nonce", verifier)
+	if _, err := provider.Exchange(context.Background(), code, "another-verifier", "nonce"); err == nil {
+		t.Error("expected a wrong code verifier to be refused")
+	}
+
+	// and gatekeeper refuses a token from another sign in
+	code, _ = authorize(t, provider, "state", "nonce", verifier)
+	if _, err := provider.Exchange(context.Background(), code, verifier, "another-nonce"); err == nil {
+		t.Error("expected a token with another nonce to be refused")
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	provider, issuer := newTestProvider(t)
+	ctx := context.Background()
+	valid := map[string]interface{}{"sub": "1234", "nonce": "nonce"}
+	if _, err := provider.Verify(ctx, issuer.SignIDToken(valid), "nonce"); err != nil {
+		t.Fatalf("expected a valid token to verify, got %s", err)
+	}
+
+	// a token whose signature does not match its claims
+	token := issuer.SignIDToken(valid)
+	other := issuer.SignIDToken(map[string]interface{}{"sub": "5678", "nonce": "nonce"})
+	parts, otherParts := strings.Split(token, "."), strings.Split(other, ".")
+	forged := parts[0] + "." + otherParts[1] + "." + parts[2]
+
+	// an unsigned token
+	unsigned := "eyJhbGciOiJub25lIn0." + otherParts[1] + "."
+
+	for name, token := range map[string]string{
+		"forged":          forged,
+		"unsigned":        unsigned,
+		"malformed":       "not-a-token",
+		"expired":         issuer.SignIDToken(map[string]interface{}{"sub": "1234", "nonce": "nonce", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"other audience":  issuer.SignIDToken(map[string]interface{}{"sub": "1234", "nonce": "nonce", "aud": "someone-else"}),
+		"other issuer":    issuer.SignIDToken(map[string]interface{}{"sub": "1234", "nonce": "nonce", "iss": "https://evil.example.com"}),
+		"no subject":      issuer.SignIDToken(map[string]interface{}{"nonce": "nonce"}),
+		"shared audience": issuer.SignIDToken(map[string]interface{}{"sub": "1234", "nonce": "nonce", "aud": []string{"gatekeeper", "other"}, "azp": "other"}),
+	} {
+		if _, err := provider.Verify(ctx, token, "nonce"); err == nil {
+			t.Errorf("expected the %s token to be rejected", name)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMustMatch(t *testing.T) {
+	provider, _ := newTestProvider(t)
+	provider.Issuer += "/"
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Error("expected an issuer which does not match the discovery document to be refused")
+	}
+}
@@ -0,0 +1,227 @@
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the ID of the issuer's only signing key
+const keyID = "test"
+
+// a mock OpenID Connect issuer for tests serving discovery, authorization,
+// token and key set endpoints over HTTP - every authorization is granted
+// straight away, without asking who is signing in, to a user with the
+// issuer's current claims
+type Issuer struct {
+	URL          string                   // the issuer URL, which is also the URL of its server
+	ClientID     string                   // the only client the issuer issues tokens to
+	ClientSecret string                   // the client's secret, empty for a public client
+	Key          *rsa.PrivateKey          // the key the issuer signs ID tokens with
+	server       *httptest.Server         // the HTTP server of the issuer's endpoints
+	mutex        sync.Mutex               // guards the claims and codes fields
+	claims       map[string]interface{}   // the claims of the user who is signed in next
+	codes        map[string]authorization // the authorization codes not yet exchanged
+}
+
+// an authorization code the issuer granted, with what it was granted for
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	claims      map[string]interface{}
+}
+
+// starts a mock issuer for a client, which signs in a user with the subject
+// "user" until other claims are set - it must be closed once the test is done
+func NewIssuer(clientID string, clientSecret string) *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	issuer := &Issuer{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Key:          key,
+		claims:       map[string]interface{}{"sub": "user"},
+		codes:        map[string]authorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("/authorize", issuer.handleAuthorize)
+	mux.HandleFunc("/token", issuer.handleToken)
+	mux.HandleFunc("/keys", issuer.handleKeys)
+	issuer.server = httptest.NewServer(mux)
+	issuer.URL = issuer.server.URL
+	return issuer
+}
+
+// stops the issuer's server
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// sets the claims of the user who is signed in by the next authorizations,
+// e.g. {"sub": "1234", "preferred_username": "alice", "groups": ["admins"]}
+func (i *Issuer) SetClaims(claims map[string]interface{}) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.claims = claims
+}
+
+// signs claims as an RS256 ID token with the issuer's key, adding the
+// issuer, audience, issue time and expiry unless the claims already have them
+func (i *Issuer) SignIDToken(claims map[string]interface{}) string {
+	token := map[string]interface{}{
+		"iss": i.URL,
+		"aud": i.ClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range claims {
+		token[name] = value
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(token)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// serves the discovery document clients find the other endpoints from
+func (i *Issuer) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// grants an authorization code straight away and sends the user back to the client
+func (i *Issuer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != i.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" ||
+		!strings.Contains(" "+query.Get("scope")+" ", " openid ") {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomValue()
+	i.mutex.Lock()
+	i.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		claims:      i.claims,
+	}
+	i.mutex.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// exchanges an authorization code for an ID token once the client has
+// authenticated and proved it holds the code verifier
+func (i *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if i.ClientSecret != "" {
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if id != i.ClientID || secret != i.ClientSecret {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+	}
+
+	// codes can only be exchanged once
+	i.mutex.Lock()
+	grant, found := i.codes[r.PostFormValue("code")]
+	delete(i.codes, r.PostFormValue("code"))
+	i.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || r.PostFormValue("client_id") != i.ClientID || r.PostFormValue("redirect_uri") != grant.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]interface{}{}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomValue(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     i.SignIDToken(claims),
+	})
+}
+
+// serves the key set clients verify ID tokens with
+func (i *Issuer) handleKeys(w http.ResponseWriter, _ *http.Request) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(i.Key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(i.Key.E)).Bytes()),
+		}},
+	})
+}
+
+// writes a JSON response with a status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// generates a random code or access token
+func randomValue() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -1,71 +1,261 @@
 package pipe
 
-import "net"
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the buffer size used when a connection pipe has none configured
+const DefaultBufferSize = 32 * 1024
+
+// how long the other direction is given to finish after one direction
+// has finished and half-closed, when a connection pipe has none configured
+const DefaultHalfCloseTimeout = 30 * time.Second
+
+// the reasons a connection pipe can end for, other reasons can be given to KillWithReason
+const (
+	ReasonLeftClosed       = "left closed"        // the left side closed its connection
+	ReasonRightClosed      = "right closed"       // the right side closed its connection
+	ReasonLeftError        = "left error"         // copying from the left side failed
+	ReasonRightError       = "right error"        // copying from the right side failed
+	ReasonHalfCloseTimeout = "half-close timeout" // one side closed and the other did not follow in time
+	ReasonKilled           = "killed"             // the pipe was killed
+)
 
 // struct for an active or inactive connection pipe
 type ConnectionPipe struct {
-	Alive bool // represents whether or not the connection pipe is actively piping data
-	Left net.Conn // left-hand-side of this connection pipe
-	Right net.Conn // right-hand-side of this connection pipe
+	leftToRight      uint64        // the number of bytes copied from left to right, accessed atomically
+	rightToLeft      uint64        // the number of bytes copied from right to left, accessed atomically
+	alive            int32         // 1 while the connection pipe is actively piping data, accessed atomically as both directions read it
+	Left             net.Conn      // left-hand-side of this connection pipe
+	Right            net.Conn      // right-hand-side of this connection pipe
+	BufferSize       int           // the size of the buffers used to copy data, DefaultBufferSize if 0
+	HalfCloseTimeout time.Duration // how long the other direction may run on after a half-close, DefaultHalfCloseTimeout if 0
+	closeOnce        sync.Once     // makes sure both sides are only closed once
+	started          time.Time     // when the pipe started piping, guarded by mutex
+	ended            time.Time     // when both directions finished, guarded by mutex
+	reason           string        // why the pipe ended, the first reason given wins, guarded by mutex
+	mutex            sync.Mutex    // guards the started, ended and reason fields
 }
 
 // main constructor function for a connection pipe, accepting
-// left and right as parameters and default 'Alive' = false
+// left and right as parameters and defaulting to not alive
 func NewConnectionPipe(left net.Conn, right net.Conn) ConnectionPipe {
 	return ConnectionPipe{
-		Alive: false,
 		Left:  left,
 		Right: right,
 	}
 }
 
+// returns whether or not the connection pipe is actively piping data
+func (cp *ConnectionPipe) IsAlive() bool {
+	return atomic.LoadInt32(&cp.alive) == 1
+}
+
+// sets whether or not the connection pipe is alive
+func (cp *ConnectionPipe) setAlive(alive bool) {
+	var value int32
+	if alive {
+		value = 1
+	}
+	atomic.StoreInt32(&cp.alive, value)
+}
+
+// returns the number of bytes copied from left to right so far, which
+// lags behind by less than the buffer size while the pipe is live
+func (cp *ConnectionPipe) LeftToRight() uint64 {
+	return atomic.LoadUint64(&cp.leftToRight)
+}
+
+// returns the number of bytes copied from right to left so far, which
+// lags behind by less than the buffer size while the pipe is live
+func (cp *ConnectionPipe) RightToLeft() uint64 {
+	return atomic.LoadUint64(&cp.rightToLeft)
+}
+
+// returns when the pipe started and finished piping, either is zero if
+// the pipe has not started or finished yet
+func (cp *ConnectionPipe) Times() (started time.Time, ended time.Time) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.started, cp.ended
+}
+
+// returns why the pipe ended, or an empty string if it has not ended
+func (cp *ConnectionPipe) Reason() string {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.reason
+}
+
+// records why the pipe ended unless a reason has already been recorded
+func (cp *ConnectionPipe) setReason(reason string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.reason == "" {
+		cp.reason = reason
+	}
+}
+
+// buffer pools, one per buffer size, so that buffers are reused across
+// connections rather than allocated for every pipe
+var (
+	poolsMutex sync.Mutex
+	pools      = map[int]*sync.Pool{}
+)
+
+// returns the buffer pool for a certain buffer size, creating it if needed
+func bufferPool(size int) *sync.Pool {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	pool, has := pools[size]
+	if !has {
+		pool = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		pools[size] = pool
+	}
+	return pool
+}
+
+// the result of copying one direction of the pipe
+type copyResult struct {
+	read  net.Conn // the connection that was being read from
+	write net.Conn // the connection that was being written to
+	err   error    // the error the copy ended with, nil for a clean EOF
+}
+
 // function existing as a method on the ConnectionPipe to pipe connections,
-// it reads from one connection and directly pipes it to the other
+// it copies from one connection to the other until the reading side ends -
 // this alone is NOT bidirectional
-func (cp *ConnectionPipe) pipeConnection(read net.Conn, write net.Conn) {
-	// creates our buffer of 2048 bytes (2KB)
-	buf := make([]byte, 2048)
-
-	// while this connection pipe is alive
-	for cp.Alive {
-		// reads from the 'read' connection and dumps that data into buf
-		length, err := read.Read(buf)
-		
-		// if an error was thrown or the length of the data read is 0
-		if err != nil || length == 0 {
-			// kill the connection pipe and break from the loop
-			cp.Alive = false
-			break
-		}
+func (cp *ConnectionPipe) pipeConnection(read net.Conn, write net.Conn, counter *uint64, results chan<- copyResult) {
+	// takes a buffer from the pool and returns it once the copy ends
+	size := cp.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	pool := bufferPool(size)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
 
-		// writes to the 'write' connection the contents of the buf
-		// up to the length returned from the read function
-		length, err = write.Write(buf[:length])
+	// io.CopyBuffer only uses the buffer if neither side can copy by itself,
+	// so two TCP connections on Linux are copied with splice in the kernel -
+	// the copy is made in chunks through an io.LimitedReader, which splice
+	// still accepts, so the bytes can be counted while the pipe is live
+	var err error
+	for {
+		var n int64
+		n, err = io.CopyBuffer(write, &io.LimitedReader{R: read, N: int64(size)}, *buf)
+		atomic.AddUint64(counter, uint64(n))
 
-		// if an error was returned or the length successfully written is 0:
-		// terminate the connection pipe and break out of the loop
-		if err != nil || length == 0 {
-			cp.Alive = false
+		// a short chunk without an error means the reading side reached EOF
+		if err != nil || n < int64(size) {
 			break
 		}
 	}
+	results <- copyResult{read: read, write: write, err: err}
 }
 
-// function to begin piping on the connection pipe bidirectionally
+// function to begin piping on the connection pipe bidirectionally, it
+// blocks until both directions have finished and both sides are closed
 func (cp *ConnectionPipe) Pipe() {
-	// first, set the Alive field equal to true to represent
+	// first, mark the pipe as alive to represent
 	// the connection pipe as now being active
-	cp.Alive = true
+	cp.setAlive(true)
+	defer cp.setAlive(false)
 
-	// in a goroutine, pipe connection from one way to the other
-	go cp.pipeConnection(cp.Left, cp.Right)
+	cp.mutex.Lock()
+	cp.started = time.Now()
+	cp.mutex.Unlock()
+
+	// records when the pipe ended once both directions have finished
+	defer func() {
+		cp.mutex.Lock()
+		cp.ended = time.Now()
+		cp.mutex.Unlock()
+	}()
+
+	// in a goroutine each, pipe connection from one way to the other
+	results := make(chan copyResult, 2)
+	go cp.pipeConnection(cp.Left, cp.Right, &cp.leftToRight, results)
+	go cp.pipeConnection(cp.Right, cp.Left, &cp.rightToLeft, results)
+
+	// when the first direction finishes cleanly, the side it was writing to is
+	// half-closed so the peer sees EOF while the other direction keeps running,
+	// otherwise both sides are closed straight away
+	first := <-results
+	cp.setReason(cp.describe(first))
+	if first.err != nil || !closeWrite(first.write) {
+		cp.Kill()
+		<-results
+		return
+	}
+
+	// the other direction is given a limited time to finish by itself
+	// before both sides are closed
+	timeout := cp.HalfCloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultHalfCloseTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	// blocking this thread context, pipe the connection in a reverse direction to the initial way
-	cp.pipeConnection(cp.Right, cp.Left)
+	select {
+	case <-results:
+		cp.Kill()
+	case <-timer.C:
+		cp.KillWithReason(ReasonHalfCloseTimeout)
+		<-results
+	}
+}
+
+// returns the reason a direction of the pipe finished for
+func (cp *ConnectionPipe) describe(result copyResult) string {
+	left := result.read == cp.Left
+	switch {
+	case result.err != nil && left:
+		return ReasonLeftError
+	case result.err != nil:
+		return ReasonRightError
+	case left:
+		return ReasonLeftClosed
+	default:
+		return ReasonRightClosed
+	}
 }
 
-// function to kill a connection pipe early
+// half-closes a connection if it supports it, returning whether it did
+func closeWrite(conn net.Conn) bool {
+	halfCloser, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	err := halfCloser.CloseWrite()
+	return err == nil || errors.Is(err, net.ErrClosed)
+}
+
+// function to kill a connection pipe early - both sides are closed,
+// which stops any blocked reads and makes Pipe return
 func (cp *ConnectionPipe) Kill() {
-	// sets the Alive field = false
-	cp.Alive = false
+	cp.KillWithReason(ReasonKilled)
+}
+
+// kills the connection pipe, recording why it was killed
+// unless the pipe has already ended for another reason
+func (cp *ConnectionPipe) KillWithReason(reason string) {
+	cp.setReason(reason)
+
+	// marks the pipe as no longer alive
+	cp.setAlive(false)
+
+	cp.closeOnce.Do(func() {
+		_ = cp.Left.Close()
+		_ = cp.Right.Close()
+	})
 }
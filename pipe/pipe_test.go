@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 const (
@@ -103,3 +104,103 @@ func TestConnectionPiping(t *testing.T) {
 
 	conn.Write(clientToServerPayload)
 }
+
+// returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+func TestKillStopsBlockedPipe(t *testing.T) {
+	client, left := tcpPair(t)
+	defer client.Close()
+	right, backend := tcpPair(t)
+	defer backend.Close()
+
+	// neither side sends anything so both directions are blocked reading
+	pipe := NewConnectionPipe(left, right)
+	finished := make(chan struct{})
+	go func() {
+		pipe.Pipe()
+		close(finished)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if !pipe.IsAlive() {
+		t.Fatal("pipe should be alive while piping")
+	}
+	pipe.Kill()
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pipe did not return after Kill")
+	}
+	if pipe.IsAlive() {
+		t.Error("pipe should not be alive after Kill")
+	}
+
+	// the client should see its connection closed
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF on the client after Kill, got %v", err)
+	}
+}
+
+func TestHalfClosePropagates(t *testing.T) {
+	client, left := tcpPair(t)
+	defer client.Close()
+	right, backend := tcpPair(t)
+	defer backend.Close()
+
+	pipe := NewConnectionPipe(left, right)
+	pipe.BufferSize = 512
+	finished := make(chan struct{})
+	go func() {
+		pipe.Pipe()
+		close(finished)
+	}()
+
+	// the client sends a request and half-closes, the backend should see
+	// the request followed by EOF while still being able to respond
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	request, err := io.ReadAll(backend)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("backend read %q, %v", request, err)
+	}
+
+	if _, err := backend.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("client read %q, %v", response, err)
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pipe did not return after both directions finished")
+	}
+}
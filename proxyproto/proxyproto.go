@@ -0,0 +1,233 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the signature every version 2 header starts with
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the longest a version 1 header may be, including its CRLF
+const v1MaxLength = 107
+
+// the version 2 commands and address families used by gatekeeper
+const (
+	v2CommandLocal = 0x20 // version 2, LOCAL - the connection was made by the proxy itself
+	v2CommandProxy = 0x21 // version 2, PROXY - the connection is relayed for a client
+	v2FamilyTCP4   = 0x11 // TCP over IPv4
+	v2FamilyTCP6   = 0x21 // TCP over IPv6
+)
+
+// a PROXY protocol header, which an upstream proxy sends before the
+// client's data to say who the client is and what it connected to
+type Header struct {
+	Version     int          // the version of the protocol the header was read in, 1 or 2
+	Source      *net.TCPAddr // the address of the client, nil if the header does not relay one
+	Destination *net.TCPAddr // the address the client connected to, nil if the header does not relay one
+}
+
+// reads a version 1 or 2 PROXY protocol header from the start of a connection,
+// reading no further than its end so the client's data can be read after it
+func Read(r io.Reader) (*Header, error) {
+	// both versions are told apart by their first 6 bytes
+	start := make([]byte, 6)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %s", err)
+	}
+	switch {
+	case string(start) == "PROXY ":
+		return readV1(r, start)
+	case bytes.Equal(start, v2Signature[:6]):
+		return readV2(r, start)
+	}
+	return nil, errors.New("connection did not start with a PROXY header")
+}
+
+// reads the rest of a version 1 header a byte at a time up to its CRLF,
+// e.g. "PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\n"
+func readV1(r io.Reader, start []byte) (*Header, error) {
+	line := append([]byte{}, start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, errors.New("PROXY v1 header is too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header: %s", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	source, err := parseV1Address(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Address(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: source, Destination: destination}, nil
+}
+
+// parses an address and port of a version 1 header
+func parseV1Address(host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY v1 header", host)
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY v1 header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// reads the rest of a version 2 header - its fixed 16 bytes and
+// then the addresses and any extensions that follow them
+func readV2(r io.Reader, start []byte) (*Header, error) {
+	fixed := make([]byte, 16)
+	copy(fixed, start)
+	if _, err := io.ReadFull(r, fixed[len(start):]); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %s", err)
+	}
+	if !bytes.Equal(fixed[:12], v2Signature) {
+		return nil, errors.New("invalid PROXY v2 signature")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %s", err)
+	}
+
+	header := &Header{Version: 2}
+	switch fixed[12] {
+	case v2CommandLocal:
+		// health checks from the upstream proxy itself relay no client
+		return header, nil
+	case v2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command 0x%02x", fixed[12])
+	}
+
+	// the extensions after the addresses are skipped, as are
+	// the addresses of families other than TCP
+	var size int
+	switch fixed[13] {
+	case v2FamilyTCP4:
+		size = net.IPv4len
+	case v2FamilyTCP6:
+		size = net.IPv6len
+	default:
+		return header, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errors.New("PROXY v2 header is too short for its addresses")
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[:size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return header, nil
+}
+
+// encodes a header relaying a client's connection in a version of the
+// protocol - if either address is not a TCP address the header relays no
+// client, so the receiver uses the address of the connection itself
+func Encode(version int, source net.Addr, destination net.Addr) []byte {
+	from, fromOK := source.(*net.TCPAddr)
+	to, toOK := destination.(*net.TCPAddr)
+	relayed := fromOK && toOK
+
+	// both addresses must be of the same family, so an IPv4 address
+	// is sent as IPv6 if the other address is IPv6
+	v4 := relayed && from.IP.To4() != nil && to.IP.To4() != nil
+
+	if version == 1 {
+		if !relayed {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, v1Address(from.IP, v4), v1Address(to.IP, v4), from.Port, to.Port))
+	}
+
+	header := append([]byte{}, v2Signature...)
+	if !relayed {
+		return append(header, v2CommandLocal, 0x00, 0x00, 0x00)
+	}
+	family, size := byte(v2FamilyTCP6), net.IPv6len
+	fromIP, toIP := from.IP.To16(), to.IP.To16()
+	if v4 {
+		family, size = v2FamilyTCP4, net.IPv4len
+		fromIP, toIP = from.IP.To4(), to.IP.To4()
+	}
+	header = append(header, v2CommandProxy, family, 0x00, byte(2*size+4))
+	header = append(header, fromIP...)
+	header = append(header, toIP...)
+	header = append(header, byte(from.Port>>8), byte(from.Port), byte(to.Port>>8), byte(to.Port))
+	return header
+}
+
+// formats an address of a version 1 header in the header's family
+func v1Address(ip net.IP, v4 bool) string {
+	if v4 {
+		return ip.To4().String()
+	}
+	// an IPv4 address in an IPv6 header is written as an IPv4-mapped address
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+// a connection which was relayed by an upstream proxy, reporting the
+// addresses from its PROXY header instead of the upstream proxy's
+type Conn struct {
+	net.Conn
+	Header *Header // the header the connection started with
+}
+
+// returns the address of the client the upstream proxy relayed
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// returns the address the client connected to on the upstream proxy
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// half-closes the underlying connection so that the pipe can still
+// half-close connections relayed by an upstream proxy
+func (c *Conn) CloseWrite() error {
+	if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return errors.New("connection does not support half-closing")
+}
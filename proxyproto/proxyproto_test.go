@@ -0,0 +1,78 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEncodeAndRead(t *testing.T) {
+	for _, addresses := range [][2]string{
+		{"203.0.113.7:51234", "192.0.2.1:443"},
+		{"[2001:db8::7]:51234", "[2001:db8::1]:443"},
+		{"203.0.113.7:51234", "[2001:db8::1]:443"},
+	} {
+		source, _ := net.ResolveTCPAddr("tcp", addresses[0])
+		destination, _ := net.ResolveTCPAddr("tcp", addresses[1])
+
+		for _, version := range []int{1, 2} {
+			// the client's data after the header must be left unread
+			stream := bytes.NewReader(append(Encode(version, source, destination), "hello"...))
+			header, err := Read(stream)
+			if err != nil {
+				t.Fatalf("v%d %s: %s", version, addresses, err)
+			}
+			if header.Version != version {
+				t.Errorf("v%d %s: read as version %d", version, addresses, header.Version)
+			}
+			if !header.Source.IP.Equal(source.IP) || header.Source.Port != source.Port {
+				t.Errorf("v%d %s: expected source %s, got %s", version, addresses, source, header.Source)
+			}
+			if !header.Destination.IP.Equal(destination.IP) || header.Destination.Port != destination.Port {
+				t.Errorf("v%d %s: expected destination %s, got %s", version, addresses, destination, header.Destination)
+			}
+			if rest, _ := ioutil.ReadAll(stream); string(rest) != "hello" {
+				t.Errorf("v%d %s: expected the data after the header to be left, got %q", version, addresses, rest)
+			}
+		}
+	}
+}
+
+func TestHeadersWithoutClient(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		header, err := Read(bytes.NewReader(Encode(version, nil, nil)))
+		if err != nil {
+			t.Fatalf("v%d: %s", version, err)
+		}
+		if header.Source != nil || header.Destination != nil {
+			t.Errorf("v%d: expected no addresses, got %+v", version, header)
+		}
+
+		// the connection then reports the upstream's own addresses
+		upstream, other := net.Pipe()
+		conn := &Conn{Conn: upstream, Header: header}
+		if conn.RemoteAddr() != upstream.RemoteAddr() || conn.LocalAddr() != upstream.LocalAddr() {
+			t.Errorf("v%d: expected the connection's own addresses to be used", version)
+		}
+		_ = upstream.Close()
+		_ = other.Close()
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234\r\n",
+		"PROXY TCP4 not-an-ip 192.0.2.1 51234 443\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234 99999\r\n",
+		"PROXY " + strings.Repeat("A", 200),
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x02\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+	} {
+		if _, err := Read(strings.NewReader(data)); err == nil {
+			t.Errorf("expected %q to be rejected", data)
+		}
+	}
+}
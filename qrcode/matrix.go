@@ -0,0 +1,307 @@
+package qrcode
+
+// the bits of error correction level M in the format information
+const levelM = 0
+
+// a QR code being drawn, along with which modules belong to the function
+// patterns so that the data and the mask leave them alone
+type matrix struct {
+	*Code
+	version  int      // the version of the code, from 1 to 10
+	function [][]bool // whether or not each module is part of a function pattern, by row and then column
+}
+
+// returns a code of a version with its function patterns drawn
+func newCode(v int) *matrix {
+	size := v*4 + 17
+	m := &matrix{Code: &Code{Size: size}, version: v}
+	m.modules = make([][]bool, size)
+	m.function = make([][]bool, size)
+	for y := range m.modules {
+		m.modules[y] = make([]bool, size)
+		m.function[y] = make([]bool, size)
+	}
+
+	// the timing patterns, which the finder patterns are then drawn over
+	for i := 0; i < size; i++ {
+		m.setFunction(6, i, i%2 == 0)
+		m.setFunction(i, 6, i%2 == 0)
+	}
+	m.drawFinder(3, 3)
+	m.drawFinder(size-4, 3)
+	m.drawFinder(3, size-4)
+
+	// the alignment patterns go everywhere their centres meet,
+	// except on the three corners taken by the finder patterns
+	alignment := versions[v-1].alignment
+	last := len(alignment) - 1
+	for i, x := range alignment {
+		for j, y := range alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			m.drawAlignment(x, y)
+		}
+	}
+
+	// the format information is reserved now and drawn once the mask is known
+	m.drawFormat(0)
+	m.drawVersion()
+	return m
+}
+
+// sets a module as part of a function pattern
+func (m *matrix) setFunction(x int, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.function[y][x] = true
+}
+
+// draws a finder pattern centred on a module along with its separator
+func (m *matrix) drawFinder(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= m.Size || yy >= m.Size {
+				continue
+			}
+			distance := max(abs(dx), abs(dy))
+			m.setFunction(xx, yy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+// draws an alignment pattern centred on a module
+func (m *matrix) drawAlignment(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			m.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// draws both copies of the format information for a mask, along with
+// the dark module which always sits beside the bottom left copy
+func (m *matrix) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 == 1
+	}
+
+	// the copy around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		m.setFunction(8, i, bit(i))
+	}
+	m.setFunction(8, 7, bit(6))
+	m.setFunction(8, 8, bit(7))
+	m.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.setFunction(14-i, 8, bit(i))
+	}
+
+	// the copy split between the other two finder patterns
+	for i := 0; i < 8; i++ {
+		m.setFunction(m.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.setFunction(8, m.Size-15+i, bit(i))
+	}
+	m.setFunction(8, m.Size-8, true)
+}
+
+// returns the 15 bits of format information for a mask at level M,
+// protected by a BCH code and masked so they are never all zero
+func formatBits(mask int) int {
+	data := levelM<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	return (data<<10 | remainder) ^ 0x5412
+}
+
+// draws both copies of the version information, which versions 7 and up carry
+func (m *matrix) drawVersion() {
+	if m.version < 7 {
+		return
+	}
+	bits := versionBits(m.version)
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := m.Size-11+i%3, i/3
+		m.setFunction(a, b, dark)
+		m.setFunction(b, a, dark)
+	}
+}
+
+// returns the 18 bits of version information, protected by a BCH code
+func versionBits(v int) int {
+	remainder := v
+	for i := 0; i < 12; i++ {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+	return v<<12 | remainder
+}
+
+// draws the codewords into the modules which are not part of a function
+// pattern, in two module wide columns zigzagging up and down from the
+// bottom right - any modules left over are the remainder bits, left light
+func (m *matrix) drawCodewords(codewords []byte) {
+	i := 0
+	for right := m.Size - 1; right >= 1; right -= 2 {
+		// the vertical timing pattern is skipped over entirely
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := 0; vertical < m.Size; vertical++ {
+			y := vertical
+			if upward {
+				y = m.Size - 1 - vertical
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if m.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				m.modules[y][x] = codewords[i>>3]>>uint(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// returns whether or not a mask flips the module at a column and row
+func masked(mask int, x int, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// flips the data modules a mask covers, so applying it twice undoes it
+func (m *matrix) applyMask(mask int) {
+	for y := 0; y < m.Size; y++ {
+		for x := 0; x < m.Size; x++ {
+			if !m.function[y][x] && masked(mask, x, y) {
+				m.modules[y][x] = !m.modules[y][x]
+			}
+		}
+	}
+}
+
+// applies whichever of the eight masks leaves the fewest patterns that
+// confuse scanners, and draws the format information for it
+func (m *matrix) applyBestMask() {
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		m.applyMask(mask)
+		m.drawFormat(mask)
+		if penalty := m.penalty(); lowest < 0 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		m.applyMask(mask)
+	}
+	m.applyMask(best)
+	m.drawFormat(best)
+}
+
+// scores the modules by the four penalty rules of the QR code standard -
+// long runs of one colour, 2x2 blocks of one colour, patterns which look
+// like finder patterns and an imbalance between dark and light modules
+func (m *matrix) penalty() int {
+	penalty := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	// the rows and then the columns as lines of modules
+	lines := make([][]bool, 0, 2*m.Size)
+	for y := 0; y < m.Size; y++ {
+		lines = append(lines, m.modules[y])
+	}
+	for x := 0; x < m.Size; x++ {
+		column := make([]bool, m.Size)
+		for y := range column {
+			column[y] = m.modules[y][x]
+		}
+		lines = append(lines, column)
+	}
+
+	for _, line := range lines {
+		run := 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				penalty += 3 + run - 5
+			}
+			run = 1
+		}
+		for i := 0; i+len(finderLike[0]) <= len(line); i++ {
+			for _, pattern := range finderLike {
+				if matches(line[i:], pattern) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < m.Size; y++ {
+		for x := 0; x < m.Size; x++ {
+			if m.modules[y][x] {
+				dark++
+			}
+			if x+1 < m.Size && y+1 < m.Size {
+				colour := m.modules[y][x]
+				if m.modules[y][x+1] == colour && m.modules[y+1][x] == colour && m.modules[y+1][x+1] == colour {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := m.Size * m.Size
+	penalty += abs(dark*100/total-50) / 5 * 10
+	return penalty
+}
+
+// returns whether or not a line of modules starts with a pattern
+func matches(line []bool, pattern []bool) bool {
+	for i, dark := range pattern {
+		if line[i] != dark {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
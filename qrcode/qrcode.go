@@ -0,0 +1,210 @@
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// a QR code of a string, encoded in byte mode at error correction level M -
+// only versions 1 to 10 are supported, which hold up to 213 bytes and so any
+// otpauth URI, as that is all the codes are used for
+type Code struct {
+	Size    int      // the number of modules along each side, not counting the quiet zone
+	modules [][]bool // the modules by row and then column, true for dark
+}
+
+// the layout of the error correction blocks of a version at level M
+type version struct {
+	ecPerBlock int   // the error correction codewords of every block
+	blocks     []int // the data codewords of each block
+	alignment  []int // the rows and columns the alignment patterns are centred on
+}
+
+// versions 1 to 10 at error correction level M, indexed by version - 1
+var versions = []version{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// encodes a string as the smallest QR code which holds it, returning an
+// error if it is too long for any supported version
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+	for i, v := range versions {
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		// the byte mode header is a 4 bit mode and an 8 or 16 bit length
+		header := 12
+		if i+1 >= 10 {
+			header = 20
+		}
+		if header+len(data)*8 > capacity*8 {
+			continue
+		}
+
+		m := newCode(i + 1)
+		m.drawCodewords(v.interleave(encodeData(data, capacity, header-4)))
+		m.applyBestMask()
+		return m.Code, nil
+	}
+	return nil, fmt.Errorf("%d bytes is too long for a QR code", len(data))
+}
+
+// returns whether or not the module at a column and row is dark
+func (c *Code) Dark(x int, y int) bool {
+	return c.modules[y][x]
+}
+
+// renders the code for a terminal, two rows of modules to a line of half
+// blocks, drawn black on white whatever the terminal's own colours are so
+// that it scans, and surrounded by a quiet zone of light modules
+func (c *Code) Terminal() string {
+	const quiet = 4
+	dark := func(x int, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+	}
+
+	var builder strings.Builder
+	for y := 0; y < c.Size+2*quiet; y += 2 {
+		builder.WriteString("\x1b[30;47m")
+		for x := 0; x < c.Size+2*quiet; x++ {
+			switch top, bottom := dark(x, y), dark(x, y+1); {
+			case top && bottom:
+				builder.WriteString("█")
+			case top:
+				builder.WriteString("▀")
+			case bottom:
+				builder.WriteString("▄")
+			default:
+				builder.WriteString(" ")
+			}
+		}
+		builder.WriteString("\x1b[0m\n")
+	}
+	return builder.String()
+}
+
+// builds the data codewords of byte mode data - the mode, its length, the
+// data itself and then a terminator and padding up to the capacity
+func encodeData(data []byte, capacity int, lengthBits int) []byte {
+	var bits []bool
+	write := func(value int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 == 1)
+		}
+	}
+	write(0x4, 4)
+	write(len(data), lengthBits)
+	for _, b := range data {
+		write(int(b), 8)
+	}
+
+	// the terminator is up to four zero bits, then zeros to the byte boundary
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// splits the data codewords into the version's blocks, adds the error
+// correction codewords of each and interleaves them in the order they are drawn
+func (v version) interleave(data []byte) []byte {
+	divisor := reedSolomonDivisor(v.ecPerBlock)
+	var blocks, ec [][]byte
+	longest := 0
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		ec = append(ec, reedSolomonRemainder(data[:n], divisor))
+		data = data[n:]
+		if n > longest {
+			longest = n
+		}
+	}
+
+	var result []byte
+	for i := 0; i < longest; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, block := range ec {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// multiplies two elements of GF(256) modulo the QR code polynomial
+func gfMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// returns the coefficients of the Reed-Solomon generator polynomial of a
+// degree, from the highest power down and without its leading 1
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// returns the error correction codewords of a block, the remainder of
+// dividing the block by the generator polynomial
+func reedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
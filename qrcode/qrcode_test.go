@@ -0,0 +1,183 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// the data codewords of "HELLO WORLD" in alphanumeric mode at 1-M, and their error correction
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ec := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ec, expected) {
+		t.Errorf("expected %v, got %v", expected, ec)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	// the format information of level M for each mask, from the standard's table
+	for mask, expected := range []int{
+		0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0,
+	} {
+		if bits := formatBits(mask); bits != expected {
+			t.Errorf("mask %d: expected %015b, got %015b", mask, expected, bits)
+		}
+	}
+	if bits := versionBits(7); bits != 0x07C94 {
+		t.Errorf("version 7: expected %018b, got %018b", 0x07C94, bits)
+	}
+}
+
+// reads the text back out of a code by reversing every step of encoding it
+func decode(t *testing.T, code *Code) string {
+	v := (code.Size - 17) / 4
+	m := newCode(v)
+	layout := versions[v-1]
+
+	// the format information says which mask to undo
+	format := 0
+	for i := 14; i >= 9; i-- {
+		format = format<<1 | bit(code.Dark(14-i, 8))
+	}
+	format = format<<1 | bit(code.Dark(7, 8))
+	format = format<<1 | bit(code.Dark(8, 8))
+	format = format<<1 | bit(code.Dark(8, 7))
+	for i := 5; i >= 0; i-- {
+		format = format<<1 | bit(code.Dark(8, i))
+	}
+	mask := -1
+	for candidate := 0; candidate < 8; candidate++ {
+		if formatBits(candidate) == format {
+			mask = candidate
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("unknown format information %015b", format)
+	}
+	m.modules = code.modules
+	m.applyMask(mask)
+	defer m.applyMask(mask)
+
+	// reads the codewords in the order they were drawn
+	var codewords []byte
+	var current byte
+	read := 0
+	for right := m.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := 0; vertical < m.Size; vertical++ {
+			y := vertical
+			if upward {
+				y = m.Size - 1 - vertical
+			}
+			for j := 0; j < 2; j++ {
+				if x := right - j; !m.function[y][x] {
+					current = current<<1 | byte(bit(m.modules[y][x]))
+					if read++; read%8 == 0 {
+						codewords = append(codewords, current)
+					}
+				}
+			}
+		}
+	}
+
+	// undoes the interleaving, checking the error correction of every block
+	blocks := make([][]byte, len(layout.blocks))
+	for i := 0; len(codewords) > 0 && i < 44; i++ {
+		for b, n := range layout.blocks {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[0])
+				codewords = codewords[1:]
+			}
+		}
+	}
+	divisor := reedSolomonDivisor(layout.ecPerBlock)
+	var data []byte
+	for b := range blocks {
+		var expected []byte
+		for i := 0; i < layout.ecPerBlock; i++ {
+			expected = append(expected, codewords[b+i*len(blocks)])
+		}
+		if remainder := reedSolomonRemainder(blocks[b], divisor); !bytes.Equal(remainder, expected) {
+			t.Fatalf("block %d: expected error correction %v, got %v", b, remainder, expected)
+		}
+		data = append(data, blocks[b]...)
+	}
+
+	// the data is in byte mode with an 8 or 16 bit length
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("expected byte mode, got %x", data[0]>>4)
+	}
+	var length, offset int
+	if v < 10 {
+		length = int(data[0]&0xF)<<4 | int(data[1]>>4)
+		offset = 1
+	} else {
+		length = int(data[0]&0xF)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		offset = 2
+	}
+	text := make([]byte, length)
+	for i := range text {
+		text[i] = data[offset+i]<<4 | data[offset+i+1]>>4
+	}
+	return string(text)
+}
+
+func bit(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
+
+func TestEncode(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		size int
+	}{
+		{"hello", 21},
+		{strings.Repeat("a", 14), 21},
+		{strings.Repeat("a", 15), 25},
+		{"otpauth://totp/Gatekeeper:alice?algorithm=SHA1&digits=6&issuer=Gatekeeper&period=30&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP", 49},
+		{strings.Repeat("b", 213), 57},
+	} {
+		code, err := Encode(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Size != test.size {
+			t.Errorf("%q: expected a size of %d, got %d", test.text, test.size, code.Size)
+		}
+		if text := decode(t, code); text != test.text {
+			t.Errorf("expected %q to decode, got %q", test.text, text)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("b", 214)); err == nil {
+		t.Error("expected text too long for version 10 to be rejected")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	code, err := Encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two rows of modules to a line, with a quiet zone of four modules around the code
+	lines := strings.Split(strings.TrimSuffix(code.Terminal(), "\n"), "\n")
+	if len(lines) != 15 {
+		t.Fatalf("expected 15 lines, got %d", len(lines))
+	}
+	for _, line := range lines[:2] {
+		if quiet := strings.TrimSuffix(strings.TrimPrefix(line, "\x1b[30;47m"), "\x1b[0m"); quiet != strings.Repeat(" ", 29) {
+			t.Errorf("expected the first lines to be the quiet zone, got %q", quiet)
+		}
+	}
+	// the top row of the top left finder pattern starts on the third line
+	if !strings.HasPrefix(strings.TrimPrefix(lines[2], "\x1b[30;47m"), "    █▀▀▀▀▀█ ") {
+		t.Errorf("expected the finder pattern on the third line, got %q", lines[2])
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// a single backend target of a route
+type Backend struct {
+	DialFailures     uint64 // the number of failed dials to this backend, accessed atomically
+	Address          string // the address of the backend
+	Fallback         bool   // whether this backend is only used when no pool backend can be reached
+	active           int64  // the number of live connections piped to this backend, accessed atomically
+	unhealthy        int32  // 1 while the backend is out of rotation, accessed atomically
+	failureStreak    int32  // consecutive failed dials or health checks, accessed atomically
+	successStreak    int32  // consecutive successful dials or health checks, accessed atomically
+	failureThreshold int32  // failures in a row before the backend is taken out of rotation, 0 to never do so
+	recoveryStreak   int32  // successes in a row before the backend is put back in rotation
+}
+
+// returns whether or not the backend is in rotation
+func (b *Backend) IsHealthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+// returns the number of live connections piped to the backend
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// records a failed dial or health check, taking the backend out of
+// rotation once it has failed failureThreshold times in a row
+func (b *Backend) recordFailure(route string) {
+	atomic.StoreInt32(&b.successStreak, 0)
+	streak := atomic.AddInt32(&b.failureStreak, 1)
+	if b.failureThreshold > 0 && streak >= b.failureThreshold && atomic.CompareAndSwapInt32(&b.unhealthy, 0, 1) {
+		log.Printf("[%s] Backend %s taken out of rotation after %d failures\n", route, b.Address, streak)
+	}
+}
+
+// records a successful dial or health check, putting the backend back
+// in rotation once it has succeeded recoveryStreak times in a row
+func (b *Backend) recordSuccess(route string) {
+	atomic.StoreInt32(&b.failureStreak, 0)
+	streak := atomic.AddInt32(&b.successStreak, 1)
+	if streak >= b.recoveryStreak && atomic.CompareAndSwapInt32(&b.unhealthy, 1, 0) {
+		log.Printf("[%s] Backend %s back in rotation\n", route, b.Address)
+	}
+}
+
+// a set of backends connections are balanced across
+type BackendPool struct {
+	Strategy  string     // one of config.BalanceRoundRobin, config.BalanceLeastConnections or config.BalanceSourceIP
+	Backends  []*Backend // the backends connections are balanced across
+	Fallbacks []*Backend // backends tried in order once every pool backend has been tried
+	next      uint64     // the round-robin counter, accessed atomically
+}
+
+// constructor for a backend pool - a failureThreshold of 0 means backends are
+// never taken out of rotation, which is used when health checks are disabled
+func NewBackendPool(strategy string, addresses []string, fallbacks []string, failureThreshold int, recoveryThreshold int) *BackendPool {
+	newBackend := func(address string, fallback bool) *Backend {
+		return &Backend{
+			Address:          address,
+			Fallback:         fallback,
+			failureThreshold: int32(failureThreshold),
+			recoveryStreak:   int32(recoveryThreshold),
+		}
+	}
+
+	pool := &BackendPool{Strategy: strategy}
+	for _, address := range addresses {
+		pool.Backends = append(pool.Backends, newBackend(address, false))
+	}
+	for _, address := range fallbacks {
+		pool.Fallbacks = append(pool.Fallbacks, newBackend(address, true))
+	}
+	return pool
+}
+
+// returns a short description of the pool for logs
+func (pool *BackendPool) Describe() string {
+	var addresses []string
+	for _, backend := range pool.Backends {
+		addresses = append(addresses, backend.Address)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(addresses, ", "), pool.Strategy)
+}
+
+// returns every backend of the pool, fallbacks last
+func (pool *BackendPool) All() []*Backend {
+	return append(append([]*Backend{}, pool.Backends...), pool.Fallbacks...)
+}
+
+// returns the backends in the order they should be tried for a client - the
+// pool backends ordered by the strategy, then the fallbacks in order, with any
+// backend out of rotation moved to the end so it is only tried as a last resort
+func (pool *BackendPool) Order(clientIP string) []*Backend {
+	ordered := pool.ordered(clientIP)
+	ordered = append(ordered, pool.Fallbacks...)
+
+	var healthy, unhealthy []*Backend
+	for _, backend := range ordered {
+		if backend.IsHealthy() {
+			healthy = append(healthy, backend)
+		} else {
+			unhealthy = append(unhealthy, backend)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// orders the pool backends by the strategy
+func (pool *BackendPool) ordered(clientIP string) []*Backend {
+	n := len(pool.Backends)
+	if n == 0 {
+		return nil
+	}
+
+	// picks the backend to start from, every strategy then
+	// continues around the list from there
+	var start int
+	switch pool.Strategy {
+	case config.BalanceSourceIP:
+		// hashes the client IP so the same client sticks to the same backend
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(clientIP))
+		start = int(hash.Sum32() % uint32(n))
+	default:
+		// starts from the next backend in turn, which for least-connections
+		// spreads connections out across backends with equal counts
+		start = int((atomic.AddUint64(&pool.next, 1) - 1) % uint64(n))
+	}
+
+	ordered := make([]*Backend, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, pool.Backends[(start+i)%n])
+	}
+
+	// the least-connections strategy then sorts by live connections,
+	// keeping the rotated order for backends with equal counts
+	if pool.Strategy == config.BalanceLeastConnections {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].ActiveConnections() < ordered[j].ActiveConnections()
+		})
+	}
+	return ordered
+}
+
+// settings for the active health checks of a route's backends
+type HealthCheck struct {
+	Interval time.Duration // how often every backend is checked, 0 to disable checks
+	Timeout  time.Duration // how long a check may take to connect
+}
+
+// loops until shutdown, checking every backend of a route by opening
+// and immediately closing a TCP connection to it
+func (p *ProxyServer) healthCheckLoop(route *Route) {
+	if route.HealthCheck.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(route.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		for _, backend := range route.Pool.All() {
+			conn, err := net.DialTimeout("tcp", backend.Address, route.HealthCheck.Timeout)
+			if err != nil {
+				backend.recordFailure(route.Name)
+				continue
+			}
+			_ = conn.Close()
+			backend.recordSuccess(route.Name)
+		}
+	}
+}
+
+// the status of a backend as shown through the API
+type BackendStatus struct {
+	Address           string `json:"address"`
+	Fallback          bool   `json:"fallback"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int64  `json:"activeConnections"`
+	DialFailures      uint64 `json:"dialFailures"`
+}
+
+// the status of a route's backends as shown through the API
+type RouteBackendStatus struct {
+	Route             string          `json:"route"`
+	Strategy          string          `json:"strategy"`
+	DialFailures      uint64          `json:"dialFailures"`
+	FailedConnections uint64          `json:"failedConnections"`
+	Backends          []BackendStatus `json:"backends"`
+}
+
+// handler function for our /api/backends route which writes
+// the status of every route's backends as JSON
+func (p *ProxyServer) ViewBackends(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.BackendStatus())
+}
+
+// returns the current status of every route's backends
+func (p *ProxyServer) BackendStatus() []RouteBackendStatus {
+	var statuses []RouteBackendStatus
+	for i := range p.Routes {
+		route := &p.Routes[i]
+		status := RouteBackendStatus{
+			Route:             route.Name,
+			Strategy:          route.Pool.Strategy,
+			DialFailures:      atomic.LoadUint64(&route.DialFailures),
+			FailedConnections: atomic.LoadUint64(&route.FailedConnections),
+		}
+		for _, backend := range route.Pool.All() {
+			status.Backends = append(status.Backends, BackendStatus{
+				Address:           backend.Address,
+				Fallback:          backend.Fallback,
+				Healthy:           backend.IsHealthy(),
+				ActiveConnections: backend.ActiveConnections(),
+				DialFailures:      atomic.LoadUint64(&backend.DialFailures),
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
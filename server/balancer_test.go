@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+func TestRoundRobinRotates(t *testing.T) {
+	pool := NewBackendPool(config.BalanceRoundRobin, []string{"a:1", "b:1", "c:1"}, nil, 1, 1)
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, pool.Order("192.0.2.1")[0].Address)
+	}
+	if fmt.Sprint(picked) != "[a:1 b:1 c:1 a:1 b:1 c:1]" {
+		t.Errorf("unexpected rotation: %v", picked)
+	}
+}
+
+func TestLeastConnectionsPicksIdlestBackend(t *testing.T) {
+	pool := NewBackendPool(config.BalanceLeastConnections, []string{"a:1", "b:1", "c:1"}, nil, 1, 1)
+	pool.Backends[0].active = 5
+	pool.Backends[1].active = 1
+	pool.Backends[2].active = 3
+
+	if picked := pool.Order("192.0.2.1")[0].Address; picked != "b:1" {
+		t.Errorf("expected b:1 to be picked, got %s", picked)
+	}
+}
+
+func TestSourceIPIsSticky(t *testing.T) {
+	pool := NewBackendPool(config.BalanceSourceIP, []string{"a:1", "b:1", "c:1", "d:1"}, nil, 1, 1)
+
+	first := pool.Order("192.0.2.1")[0]
+	for i := 0; i < 10; i++ {
+		if picked := pool.Order("192.0.2.1")[0]; picked != first {
+			t.Fatalf("expected %s on every pick, got %s", first.Address, picked.Address)
+		}
+	}
+
+	// when the sticky backend is out of rotation the client moves on
+	first.recordFailure("test")
+	if picked := pool.Order("192.0.2.1")[0]; picked == first {
+		t.Error("an unhealthy backend should not be picked first")
+	}
+}
+
+func TestBackendRotation(t *testing.T) {
+	pool := NewBackendPool(config.BalanceRoundRobin, []string{"a:1", "b:1"}, []string{"fallback:1"}, 2, 2)
+	a := pool.Backends[0]
+
+	a.recordFailure("test")
+	if !a.IsHealthy() {
+		t.Error("a single failure should not take a backend out of rotation")
+	}
+	a.recordFailure("test")
+	if a.IsHealthy() {
+		t.Error("repeated failures should take a backend out of rotation")
+	}
+
+	// the unhealthy backend is only ever tried after the healthy ones
+	for i := 0; i < 4; i++ {
+		order := pool.Order("192.0.2.1")
+		if order[len(order)-1] != a || order[1].Address != "fallback:1" {
+			t.Fatalf("unexpected order: %s, %s, %s", order[0].Address, order[1].Address, order[2].Address)
+		}
+	}
+
+	a.recordSuccess("test")
+	a.recordSuccess("test")
+	if !a.IsHealthy() {
+		t.Error("repeated successes should put a backend back in rotation")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/certs"
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// a certificate served by the proxy server along with how
+// often its files are checked for changes, 0 to never check
+type watchedCertificate struct {
+	*certs.Reloader
+	Interval time.Duration
+}
+
+// loads the certificate the API is served with, generating a
+// self-signed one first if the config asks for it
+func loadAPICertificate(config config.ApplicationConfig) (*certs.Reloader, error) {
+	certFile, keyFile := config.ApiTLS.GetCertFile(), config.ApiTLS.GetKeyFile()
+	if config.ApiTLS.SelfSigned {
+		// the certificate covers the host of the links in alerts and the loopback addresses
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if u, err := url.Parse(config.DefaultApiUrl); err == nil && u.Hostname() != "" {
+			hosts = append([]string{u.Hostname()}, hosts...)
+		}
+		if err := certs.GenerateSelfSigned(certFile, keyFile, hosts); err != nil {
+			return nil, err
+		}
+		log.Printf("Warning: the API is served with the self-signed certificate %s, which is only meant for development\n", certFile)
+	}
+	return certs.NewReloader(certFile, keyFile)
+}
+
+// reloads every certificate served by the proxy server from its files,
+// it is called when the program receives SIGHUP
+func (p *ProxyServer) ReloadCertificates() {
+	for _, certificate := range p.certificates {
+		if err := certificate.Reload(); err != nil {
+			log.Printf("Error reloading certificate %s: %s\n", certificate.CertFile, err)
+		} else {
+			log.Printf("Reloaded certificate %s\n", certificate.CertFile)
+		}
+	}
+}
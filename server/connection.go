@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/ipset"
+	"github.com/saifsuleman/gatekeeper/pipe"
+)
+
+// how often the whitelist is checked for expired grants
+const grantEvictionInterval = 30 * time.Second
+
+// how a connection was let onto its route
+const (
+	AdmittedByRouteWhitelist = "route whitelist" // the route's own whitelist from the config
+	AdmittedByCertificate    = "certificate"     // a verified client certificate which may skip MFA
+	AdmittedByGrant          = "whitelist"       // an entry in the whitelist, which may expire or be revoked
+)
+
+// a record of a live connection being piped by the proxy server
+type Connection struct {
+	ID        uint64               // the ID of the connection, unique while the proxy server is running
+	Route     *Route               // the route the connection was accepted on
+	IP        string               // the IP address of the connecting client
+	User      string               // the registered user of the client, empty if the client is not known to be anyone
+	Admission string               // how the connection was let onto its route, e.g. AdmittedByCertificate
+	Backend   *Backend             // the backend the connection is piped to
+	Pipe      *pipe.ConnectionPipe // the connection pipe moving data between the client and backend
+}
+
+// function to kill a live connection, its pipe closes both sides of it
+// and the reason is recorded in the connection's session
+func (c *Connection) Kill(reason string) {
+	c.Pipe.KillWithReason(reason)
+}
+
+// the status of a live connection as written by the API
+type ConnectionStatus struct {
+	ID        uint64    `json:"id"`             // the ID of the connection, used to kill it
+	Route     string    `json:"route"`          // the name of the route the connection was accepted on
+	IP        string    `json:"ip"`             // the IP address of the client
+	User      string    `json:"user,omitempty"` // the registered user of the client, if known
+	Admission string    `json:"admission"`      // how the connection was let onto its route, e.g. "certificate"
+	Backend   string    `json:"backend"`        // the address of the backend the connection is piped to
+	Start     time.Time `json:"start"`          // when piping started
+	Duration  string    `json:"duration"`       // how long the connection has been live, e.g. "1h2m3s"
+	BytesIn   uint64    `json:"bytesIn"`        // the number of bytes sent from the client to the backend so far
+	BytesOut  uint64    `json:"bytesOut"`       // the number of bytes sent from the backend to the client so far
+}
+
+// returns the current status of the connection
+func (c *Connection) Status() ConnectionStatus {
+	started, _ := c.Pipe.Times()
+	var duration time.Duration
+	if !started.IsZero() {
+		duration = time.Since(started).Round(time.Second)
+	}
+	return ConnectionStatus{
+		ID:        c.ID,
+		Route:     c.Route.Name,
+		IP:        c.IP,
+		User:      c.User,
+		Admission: c.Admission,
+		Backend:   c.Backend.Address,
+		Start:     started,
+		Duration:  duration.String(),
+		BytesIn:   c.Pipe.LeftToRight(),
+		BytesOut:  c.Pipe.RightToLeft(),
+	}
+}
+
+// adds a connection to the Connections map
+func (p *ProxyServer) trackConnection(conn net.Conn, connection *Connection) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	p.Connections[conn] = connection
+}
+
+// removes a connection from the Connections map
+func (p *ProxyServer) untrackConnection(conn net.Conn) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	delete(p.Connections, conn)
+}
+
+// returns whether or not a connection is still allowed on its route, without
+// sending any alerts for connections that are not - only a connection let in
+// by the whitelist depends on it, so expired and revoked entries never affect
+// connections let in by the route's own whitelist or a client certificate
+func (p *ProxyServer) isAllowed(connection *Connection) bool {
+	if connection.Admission != AdmittedByGrant || connection.Route.IsWhitelisted(connection.IP) {
+		return true
+	}
+	_, whitelisted := p.Auth.WhitelistedUser(connection.IP, connection.Route.Name)
+	return whitelisted
+}
+
+// function to kill every live connection which is no longer
+// allowed on its route, returning the number of connections killed
+func (p *ProxyServer) killUnauthorizedConnections() int {
+	killed := p.killConnections("grant expired", func(connection *Connection) bool {
+		return !p.isAllowed(connection)
+	})
+	return len(killed)
+}
+
+// kills every live connection matched by the function, logging and
+// recording the reason, and returns the IDs of the connections killed
+func (p *ProxyServer) killConnections(reason string, match func(connection *Connection) bool) []uint64 {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+
+	killed := []uint64{}
+	for _, connection := range p.Connections {
+		if match(connection) {
+			log.Printf("[%s] Killing connection %d from %s - %s\n", connection.Route.Name, connection.ID, authentication.DescribeClient(connection.IP, connection.User), reason)
+			connection.Kill(reason)
+			killed = append(killed, connection.ID)
+		}
+	}
+	sort.Slice(killed, func(i, j int) bool { return killed[i] < killed[j] })
+	return killed
+}
+
+// returns the status of every live connection, ordered by ID
+func (p *ProxyServer) ConnectionStatus() []ConnectionStatus {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+
+	statuses := []ConnectionStatus{}
+	for _, connection := range p.Connections {
+		statuses = append(statuses, connection.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// handler function for our /api/connections route which writes
+// the status of every live connection as JSON
+func (p *ProxyServer) ViewConnections(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.ConnectionStatus())
+}
+
+// handler function for our /api/connections/kill route - it kills the live
+// connection with the "id" form value, or every live connection from the
+// "ip" form value which may also be a CIDR block, and writes the killed IDs
+func (p *ProxyServer) HandleKillConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var killed []uint64
+	switch {
+	case r.FormValue("id") != "":
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		killed = p.killConnections("killed by administrator", func(connection *Connection) bool {
+			return connection.ID == id
+		})
+		if len(killed) == 0 {
+			http.Error(w, fmt.Sprintf("no live connection with id %d", id), http.StatusNotFound)
+			return
+		}
+	case r.FormValue("ip") != "":
+		network, err := ipset.ParseEntry(r.FormValue("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		killed = p.killConnections("killed by administrator", func(connection *Connection) bool {
+			return network.Contains(net.ParseIP(connection.IP))
+		})
+	default:
+		http.Error(w, "an id or ip is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]uint64{"killed": killed})
+}
+
+// loops until shutdown, evicting expired whitelist grants and saving
+// the whitelist file, then killing any live pipes from the expired IPs
+func (p *ProxyServer) evictExpiredGrants() {
+	ticker := time.NewTicker(grantEvictionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		evicted, err := p.Auth.ProxyAuthHandler.EvictExpired()
+		if err != nil {
+			log.Printf("Error saving whitelist after evicting expired grants: %s\n", err)
+		}
+		if len(evicted) == 0 {
+			continue
+		}
+		for _, entry := range evicted {
+			log.Printf("Whitelist grant for %s expired\n", entry.Address)
+		}
+		p.killUnauthorizedConnections()
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// opens a connection through the proxy and waits for it to be piped
+func dialThroughProxy(t *testing.T, address string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_, _ = conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// checks that a connection is closed by the proxy
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestListAndKillConnections(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go p.acceptLoop(&p.Routes[0], listener)
+
+	first := dialThroughProxy(t, listener.Addr().String())
+	second := dialThroughProxy(t, listener.Addr().String())
+
+	recorder := httptest.NewRecorder()
+	p.ViewConnections(recorder, httptest.NewRequest("GET", "/api/connections", nil))
+	var statuses []ConnectionStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 live connections, got %d", len(statuses))
+	}
+	if statuses[0].IP != "127.0.0.1" || statuses[0].Backend != backend.Addr().String() || statuses[0].Route != "test" {
+		t.Errorf("unexpected connection status %+v", statuses[0])
+	}
+
+	// only GET lists, killing must be a POST or DELETE
+	recorder = httptest.NewRecorder()
+	p.HandleKillConnections(recorder, httptest.NewRequest("GET", "/api/connections/kill?id=1", nil))
+	if recorder.Code != 405 {
+		t.Errorf("expected 405 for a GET kill, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	p.HandleKillConnections(recorder, httptest.NewRequest("POST", "/api/connections/kill?id=999", nil))
+	if recorder.Code != 404 {
+		t.Errorf("expected 404 for an unknown id, got %d", recorder.Code)
+	}
+
+	// kills the first connection by its ID, leaving the second alone
+	recorder = httptest.NewRecorder()
+	p.HandleKillConnections(recorder, httptest.NewRequest("POST", "/api/connections/kill?id="+strconv.FormatUint(statuses[0].ID, 10), nil))
+	if recorder.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	expectClosed(t, first)
+	if _, err := second.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(second, make([]byte, 4)); err != nil {
+		t.Errorf("second connection should still be live: %s", err)
+	}
+
+	// kills the rest by IP address
+	recorder = httptest.NewRecorder()
+	p.HandleKillConnections(recorder, httptest.NewRequest("DELETE", "/api/connections/kill?ip=127.0.0.0/8", nil))
+	var result map[string][]uint64
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result["killed"]) != 1 || result["killed"][0] != statuses[1].ID {
+		t.Errorf("expected connection %d to be killed, got %v", statuses[1].ID, result["killed"])
+	}
+	expectClosed(t, second)
+}
+
+func TestRevokeKillsLiveConnections(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go p.acceptLoop(&p.Routes[0], listener)
+
+	conn := dialThroughProxy(t, listener.Addr().String())
+
+	recorder := httptest.NewRecorder()
+	p.HandleRevoke(recorder, httptest.NewRequest("POST", "/api/revoke?ip=127.0.0.1&kill=true", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if p.Auth.ProxyAuthHandler.IsWhitelisted("127.0.0.1") {
+		t.Error("expected 127.0.0.1 to no longer be whitelisted")
+	}
+	expectClosed(t, conn)
+
+	// revoking is only a POST or DELETE
+	recorder = httptest.NewRecorder()
+	p.HandleRevoke(recorder, httptest.NewRequest("GET", "/api/revoke?ip=127.0.0.1", nil))
+	if recorder.Code != 405 {
+		t.Errorf("expected 405 for a GET revoke, got %d", recorder.Code)
+	}
+
+	// the session records why it ended
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sessions, err := p.Sessions.Query("127.0.0.1", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) == 1 {
+			if sessions[0].Reason != "whitelist entry revoked" {
+				t.Errorf("unexpected session reason %q", sessions[0].Reason)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the killed session to be recorded")
+}
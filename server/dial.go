@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// how a route dials its backends
+type DialPolicy struct {
+	Timeout time.Duration // how long a single dial may take
+	Retries int           // how many more rounds of dials are made after the first round fails
+	Backoff time.Duration // the wait before the first retry, doubled for every retry after
+}
+
+// function to dial a backend for a client of a route - the backends are tried
+// in the order the route's pool picks for the client, and if none can be reached
+// the whole round is retried after a backoff which doubles each time - the
+// PROXY header, if there is one, is sent to the backend before anything else
+func (p *ProxyServer) dialBackend(route *Route, clientIP string, proxyHeader []byte) (net.Conn, *Backend, error) {
+	backoff := route.Dial.Backoff
+	var lastErr error
+
+	for attempt := 0; attempt <= route.Dial.Retries; attempt++ {
+		// waits before retrying, giving up early if the server is shutting down
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-p.done:
+				return nil, nil, fmt.Errorf("server is shutting down")
+			}
+			backoff *= 2
+		}
+
+		for _, backend := range route.Pool.Order(clientIP) {
+			conn, err := net.DialTimeout("tcp", backend.Address, route.Dial.Timeout)
+			if err == nil {
+				// the PROXY header goes first, then the connection is re-encrypted
+				// if the route does - a failed write or handshake counts against
+				// the backend like a failed dial
+				if proxyHeader != nil {
+					_, err = conn.Write(proxyHeader)
+				}
+				var encrypted net.Conn
+				if err == nil {
+					encrypted, err = route.dialTLS(conn, backend.Address)
+				}
+				if err == nil {
+					backend.recordSuccess(route.Name)
+					return encrypted, backend, nil
+				}
+				_ = conn.Close()
+			}
+
+			// every failed attempt is logged and counted against the route and backend
+			atomic.AddUint64(&route.DialFailures, 1)
+			atomic.AddUint64(&backend.DialFailures, 1)
+			backend.recordFailure(route.Name)
+			log.Printf("[%s] Error dialing backend %s (attempt %d): %s\n", route.Name, backend.Address, attempt+1, err)
+			lastErr = err
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no backend reachable after %d attempts: %s", route.Dial.Retries+1, lastErr)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// returns an address which nothing is listening on
+func deadAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+	return address
+}
+
+func TestDialFallsBackInOrder(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, deadAddress(t))
+
+	route := &p.Routes[0]
+	route.Pool = NewBackendPool(config.BalanceRoundRobin, []string{deadAddress(t)}, []string{deadAddress(t), backend.Addr().String()}, 0, 1)
+	route.Dial = DialPolicy{Timeout: time.Second}
+
+	conn, picked, err := p.dialBackend(route, "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if picked.Address != backend.Addr().String() || !picked.Fallback {
+		t.Errorf("expected fallback %s to be used, got %s", backend.Addr(), picked.Address)
+	}
+	if failures := atomic.LoadUint64(&route.DialFailures); failures != 2 {
+		t.Errorf("expected 2 failed dials to be counted, got %d", failures)
+	}
+}
+
+func TestUnreachableBackendClosesClient(t *testing.T) {
+	p, _ := newTestProxyServer(t, deadAddress(t))
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	route := &p.Routes[0]
+	route.Dial = DialPolicy{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	// net.Pipe has no IP address, so the proxy side of the
+	// pipe reports the whitelisted 127.0.0.1 instead
+	done := make(chan struct{})
+	go func() {
+		p.handleConnection(route, &addressedConn{Conn: proxy, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection did not return for an unreachable backend")
+	}
+
+	// the client must see its connection closed rather than the process panicking
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the client connection to be closed")
+	}
+	if failures := atomic.LoadUint64(&route.DialFailures); failures != 3 {
+		t.Errorf("expected 3 failed dials to be counted, got %d", failures)
+	}
+	if failed := atomic.LoadUint64(&route.FailedConnections); failed != 1 {
+		t.Errorf("expected 1 failed connection to be counted, got %d", failed)
+	}
+}
+
+// a connection which reports a chosen remote address
+type addressedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (a *addressedConn) RemoteAddr() net.Addr {
+	return a.remote
+}
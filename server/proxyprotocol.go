@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/config"
+	"github.com/saifsuleman/gatekeeper/proxyproto"
+)
+
+// how long a trusted upstream has to send its PROXY header
+const proxyHeaderTimeout = 10 * time.Second
+
+// returns the version of the PROXY protocol a route sends to its backends, 0 for none
+func proxyProtocolVersion(send string) int {
+	switch send {
+	case config.ProxyProtocolV1:
+		return 1
+	case config.ProxyProtocolV2:
+		return 2
+	}
+	return 0
+}
+
+// reads the PROXY header of a connection from one of the route's trusted
+// upstreams, returning a connection which reports the real client's address -
+// connections from anywhere else are returned untouched as they are not
+// trusted to say who the client is
+func (r *Route) acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	if r.ProxyUpstreams == nil || !r.ProxyUpstreams.Contains(GetIP(conn)) {
+		return conn, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	header, err := proxyproto.Read(conn)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", GetIP(conn), err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return &proxyproto.Conn{Conn: conn, Header: header}, nil
+}
+
+// returns the PROXY header sent to a backend ahead of a client's
+// connection, or nil if the route does not send one
+func (r *Route) proxyHeader(conn net.Conn) []byte {
+	if r.SendProxyHeader == 0 {
+		return nil
+	}
+	return proxyproto.Encode(r.SendProxyHeader, conn.RemoteAddr(), conn.LocalAddr())
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/ipset"
+	"github.com/saifsuleman/gatekeeper/proxyproto"
+)
+
+// starts a backend which reads the PROXY header of every connection,
+// sends the header's source address on the channel and then echoes
+func startProxyProtocolBackend(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header, err := proxyproto.Read(conn)
+				if err != nil {
+					sources <- err.Error()
+					return
+				}
+				sources <- header.Source.String()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener, sources
+}
+
+func TestProxyProtocol(t *testing.T) {
+	backend, sources := startProxyProtocolBackend(t)
+	p, notifier := newTestProxyServer(t, backend.Addr().String())
+
+	// the load balancer is on 127.0.0.1, only the client it relays is whitelisted
+	p.Routes[0].ProxyUpstreams, _ = ipset.NewIPSet("127.0.0.1")
+	p.Routes[0].Whitelist, _ = ipset.NewIPSet("203.0.113.7")
+	p.Routes[0].SendProxyHeader = 2
+	address := startTestRoute(t, p)
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(proxyproto.Encode(1, client, conn.RemoteAddr())); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+
+	// the backend is told about the relayed client, not the load balancer
+	select {
+	case source := <-sources:
+		if source != client.String() {
+			t.Errorf("expected the backend to be sent %s, got %s", client, source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend never read a PROXY header")
+	}
+	if statuses := p.ConnectionStatus(); len(statuses) != 1 || statuses[0].IP != "203.0.113.7" {
+		t.Errorf("expected the live connection to be from the relayed client, got %+v", statuses)
+	}
+
+	// a trusted upstream which sends no header is closed, its data is not
+	// mistaken for the client's and nobody is alerted
+	conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello, this is not a PROXY header\r\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected an upstream without a PROXY header to be closed")
+	}
+
+	notifier.mutex.Lock()
+	alerts := len(notifier.alerts)
+	notifier.mutex.Unlock()
+	if alerts != 0 {
+		t.Errorf("expected no alerts, got %d", alerts)
+	}
+}
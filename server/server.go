@@ -1,28 +1,69 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/saifsuleman/gatekeeper/authentication"
 	"github.com/saifsuleman/gatekeeper/config"
+	"github.com/saifsuleman/gatekeeper/history"
+	"github.com/saifsuleman/gatekeeper/ipset"
 	"github.com/saifsuleman/gatekeeper/logger"
+	"github.com/saifsuleman/gatekeeper/oidc"
 	"github.com/saifsuleman/gatekeeper/pipe"
 )
 
 // The struct for the main ProxyServer
 // contains all the relevant data required to work
 type ProxyServer struct {
-	Address     string                           // the address this proxy server should listen on and accept incoming connections
-	Redirect    string                           // the address this proxy server should pipe incoming connections to
-	Connections map[net.Conn]pipe.ConnectionPipe // a map of all connections to connection pipe instances
-	Auth        authentication.MultiFactorAuth   // the instance of the MultiFactorAuth object
-	APIAddress  string                           // the address the API listener is listening on
+	lastConnectionID uint64                          // the ID given to the latest connection, accessed atomically
+	Routes           []Route                         // the listener-to-backend routes this proxy server serves
+	Connections      map[net.Conn]*Connection        // a map of all connections to their live connection records
+	Auth             *authentication.MultiFactorAuth // the instance of the MultiFactorAuth object shared by every route
+	Sessions         *history.Store                  // the history finished sessions are recorded to
+	APIAddress       string                          // the address the API listener is listening on
+	DrainTimeout     time.Duration                   // how long Shutdown waits for live connections to finish before closing them
+	BufferSize       int                             // the size of the buffers connection pipes copy data with, the pipe's default if 0
+	HalfCloseTimeout time.Duration                   // how long a connection pipe lets one direction run on after the other has closed
+	connMutex        sync.Mutex                      // guards the Connections map, listeners and closed flag across goroutines
+	listeners        []net.Listener                  // the bound listener of every route, closed on shutdown
+	certificates     []watchedCertificate            // the certificates served by the proxy server, reloaded on SIGHUP or when their files change
+	closed           bool                            // set once Shutdown has been called
+	connWG           sync.WaitGroup                  // counts connections which are being handled
+	done             chan struct{}                   // closed on shutdown to stop the background goroutines
+}
+
+// a single listener-to-backend route of the proxy server
+type Route struct {
+	DialFailures       uint64        // the number of failed dials to this route's backends, accessed atomically
+	FailedConnections  uint64        // the number of clients closed because no backend could be reached, accessed atomically
+	Name               string        // the name of this route used in logs
+	Address            string        // the address this route should listen on and accept incoming connections
+	Pool               *BackendPool  // the backends this route should pipe incoming connections to
+	Whitelist          *ipset.IPSet  // IP addresses and CIDR blocks that are always allowed on this route without MFA
+	GrantTTL           time.Duration // how long an approved IP stays whitelisted by default, 0 for no expiry
+	Dial               DialPolicy    // how the backends of this route are dialed
+	HealthCheck        HealthCheck   // how the backends of this route are health checked
+	TLS                *tls.Config   // terminates TLS on incoming connections, nil to pipe bytes through untouched
+	ClientCertSkipsMFA bool          // lets clients with a verified certificate in without email MFA
+	BackendTLS         *tls.Config   // re-encrypts connections to the backends, nil to connect in plaintext
+	ServerNames        []string      // the TLS server names this route serves when it shares its address, e.g. "rdp.example.com" or "*.example.com"
+	SNIDefault         bool          // serves clients asking for a server name no route on the address serves
+	ProxyUpstreams     *ipset.IPSet  // load balancers whose connections start with a PROXY header naming the real client, nil for none
+	SendProxyHeader    int           // the version of the PROXY header sent to the backends, 0 for none
 }
 
 // the main constructor for the ProxyServer struct
-func NewProxyServer(config config.ApplicationConfig, logger logger.Logger) ProxyServer {
+func NewProxyServer(config config.ApplicationConfig, logger *logger.Logger) *ProxyServer {
 	// instantiates a new ProxyAuthHandler which is responsible for maintaining the list
 	// of whitelisted IP addresses
 	proxyAuthHandler, err := authentication.NewProxyAuthHandler("whitelist.json")
@@ -30,99 +71,566 @@ func NewProxyServer(config config.ApplicationConfig, logger logger.Logger) Proxy
 	if err != nil {
 		panic(err)
 	}
-	// instantiates a new MFA instance which is required for email alerts & more
-	auth := authentication.NewMFA(proxyAuthHandler, logger, config.ApiWhitelist, config.DefaultApiUrl, config.Emails...)
+	// opens the session history which every finished connection is recorded to
+	sessions, err := history.NewStore(config.GetSessionsPath())
+	if err != nil {
+		panic(err)
+	}
+	// instantiates a new MFA instance which is required for alerts & more
+	auth := authentication.NewMFA(proxyAuthHandler, logger, config.ApiWhitelist, config.DefaultApiUrl, newNotifier(config))
+
+	// API requests from the trusted reverse proxies are from the client
+	// their forwarding headers name, rather than from the proxy itself
+	if len(config.TrustedProxies) > 0 {
+		auth.TrustedProxies, err = ipset.NewIPSet(config.TrustedProxies...)
+		if err != nil {
+			panic(fmt.Errorf("trustedProxies: %s", err))
+		}
+	}
+
+	// loads the API tokens from the config and from the token file
+	tokens, err := authentication.LoadAPITokens(config.GetApiTokensPath())
+	if err != nil {
+		panic(err)
+	}
+	for _, token := range config.ApiTokens {
+		tokens = append(tokens, authentication.APIToken{Name: token.Name, Hash: strings.ToLower(token.Hash), Scopes: token.Scopes})
+	}
+	auth.Tokens = tokens
+	if len(tokens) == 0 && len(config.ApiWhitelist) == 0 {
+		log.Printf("Warning: no API tokens or API whitelist are configured, so the administrator API is disabled\n")
+	}
+
+	// serves the API over HTTPS if a certificate is configured
+	var certificates []watchedCertificate
+	if config.ApiTLS.Enabled() {
+		reloader, err := loadAPICertificate(config)
+		if err != nil {
+			panic(fmt.Errorf("apiTLS: %s", err))
+		}
+		interval, _ := config.ApiTLS.GetReloadInterval()
+		certificates = append(certificates, watchedCertificate{Reloader: reloader, Interval: interval})
+		auth.TLS = reloader
+		auth.RedirectAddress = config.ApiTLS.RedirectAddress
+	}
+
+	// loads the registered users, who sign in on the login page and are
+	// tied to connection attempts, optionally accepting their TOTP codes -
+	// the grant ttl has already been checked by the config's validation
+	auth.Users, err = authentication.NewUserRegistry(config.GetUsersPath())
+	if err != nil {
+		panic(err)
+	}
+	auth.TOTP = config.TOTP.Enabled
+	auth.TOTPGrantTTL, _ = config.TOTP.GetGrantTTL()
+
+	// configures how long codes last and how long denied IPs are blocklisted,
+	// both durations have already been checked by the config's validation
+	auth.CodeTTL, _ = config.GetCodeTTL()
+	auth.DenyBlockTTL, _ = config.GetDenyBlockTTL()
+
+	// builds a route for every configured route entry
+	var routes []Route
+	for _, r := range config.GetRoutes() {
+		// parses the route's whitelist into a prefix trie and throws on invalid entries
+		whitelist, err := ipset.NewIPSet(r.Whitelist...)
+		if err != nil {
+			panic(fmt.Errorf("route %s: %s", r.Name, err))
+		}
+		grantTTL, err := r.GetGrantTTL()
+		if err != nil {
+			panic(fmt.Errorf("route %s: %s", r.Name, err))
+		}
+
+		// the dial and health check durations have already been checked by the config's validation
+		dialTimeout, _ := r.GetDialTimeout()
+		dialBackoff, _ := r.GetDialBackoff()
+		checkInterval, _ := r.HealthCheck.GetInterval()
+		checkTimeout, _ := r.HealthCheck.GetTimeout()
+
+		// parses the load balancers trusted to send PROXY headers
+		var proxyUpstreams *ipset.IPSet
+		if len(r.ProxyProtocol.TrustedUpstreams) > 0 {
+			proxyUpstreams, err = ipset.NewIPSet(r.ProxyProtocol.TrustedUpstreams...)
+			if err != nil {
+				panic(fmt.Errorf("route %s: %s", r.Name, err))
+			}
+		}
+
+		// builds the route's TLS termination and re-encryption and
+		// reloads its certificate along with the API's
+		serverTLS, reloader, backendTLS, err := newRouteTLS(r)
+		if err != nil {
+			panic(fmt.Errorf("route %s: %s", r.Name, err))
+		}
+		if reloader != nil {
+			certificates = append(certificates, watchedCertificate{Reloader: reloader, Interval: time.Minute})
+		}
+
+		// backends are only taken out of rotation when health checks
+		// are enabled, as otherwise nothing would put them back
+		failureThreshold := 0
+		if checkInterval > 0 {
+			failureThreshold = r.HealthCheck.GetFailureThreshold()
+		}
+
+		routes = append(routes, Route{
+			Name:      r.Name,
+			Address:   r.ListenAddress,
+			Pool:      NewBackendPool(r.GetBalance(), r.GetBackends(), r.FallbackBackends, failureThreshold, r.HealthCheck.GetRecoveryThreshold()),
+			Whitelist: whitelist,
+			GrantTTL:  grantTTL,
+			Dial: DialPolicy{
+				Timeout: dialTimeout,
+				Retries: r.DialRetries,
+				Backoff: dialBackoff,
+			},
+			HealthCheck: HealthCheck{
+				Interval: checkInterval,
+				Timeout:  checkTimeout,
+			},
+			TLS:                serverTLS,
+			ClientCertSkipsMFA: r.TLS.ClientCertSkipsMFA,
+			BackendTLS:         backendTLS,
+			ServerNames:        r.ServerNames,
+			SNIDefault:         r.SNIDefault,
+			ProxyUpstreams:     proxyUpstreams,
+			SendProxyHeader:    proxyProtocolVersion(r.ProxyProtocol.Send),
+		})
+	}
+
+	// users may ask for access to any route on the access request page,
+	// the longest access has already been checked by the config's validation
+	auth.AccessRequests = config.AccessRequests.Enabled
+	auth.MaxRequestTTL, _ = config.AccessRequests.GetMaxTTL()
+	for _, route := range routes {
+		auth.RequestRoutes = append(auth.RequestRoutes, route.Name)
+	}
+
+	// routes needing several approvals send every administrator a personal
+	// code, which has already been checked by the config's validation - TOTP
+	// codes are only accepted on the other routes, as one user's code must
+	// never stand in for the administrators' approvals
+	auth.Approvers = config.GetApprovers()
+	auth.Quorums = map[string]int{}
+	for _, r := range config.GetRoutes() {
+		if r.GetRequiredApprovals() > 1 {
+			auth.Quorums[r.Name] = r.GetRequiredApprovals()
+		} else {
+			auth.TOTPRoutes = append(auth.TOTPRoutes, r.Name)
+		}
+	}
+
+	// users may authorize their own IP address on the routes with oidc
+	// groups by signing in through the OIDC provider, for the route's grant ttl
+	if config.OIDC.Enabled() {
+		secret, err := config.OIDC.GetClientSecret()
+		if err != nil {
+			panic(fmt.Errorf("oidc: %s", err))
+		}
+		auth.OIDC = &oidc.Provider{
+			Issuer:       config.OIDC.Issuer,
+			ClientID:     config.OIDC.ClientID,
+			ClientSecret: secret,
+			RedirectURL:  config.GetOIDCRedirectURL(),
+			Scopes:       config.OIDC.GetScopes(),
+			Client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		auth.OIDCUsernameClaim = config.OIDC.GetUsernameClaim()
+		auth.OIDCGroupsClaim = config.OIDC.GetGroupsClaim()
+		for i, r := range config.GetRoutes() {
+			if len(r.OIDCGroups) > 0 {
+				auth.OIDCRoutes = append(auth.OIDCRoutes, authentication.OIDCRoute{Name: r.Name, Groups: r.OIDCGroups, GrantTTL: routes[i].GrantTTL})
+			}
+		}
+	}
+
+	// the drain and half-close timeouts have already been checked by the config's validation
+	drainTimeout, _ := config.GetDrainTimeout()
+	halfClose, _ := config.GetHalfCloseTimeout()
 
 	// constructs the struct and returns it
-	return ProxyServer{
-		Address:     config.ProxyAddress,
-		Redirect:    config.RedirectAddress,
-		Connections: map[net.Conn]pipe.ConnectionPipe{},
-		Auth:        auth,
-		APIAddress:  config.ApiAddress,
+	return &ProxyServer{
+		Routes:           routes,
+		Connections:      map[net.Conn]*Connection{},
+		Auth:             auth,
+		Sessions:         sessions,
+		APIAddress:       config.ApiAddress,
+		DrainTimeout:     drainTimeout,
+		BufferSize:       config.GetBufferSize(),
+		HalfCloseTimeout: halfClose,
+		certificates:     certificates,
+		done:             make(chan struct{}),
+	}
+}
+
+// builds the notifier alerts are sent through from the configured
+// email administrators and webhooks, or nil if none are configured
+func newNotifier(config config.ApplicationConfig) authentication.Notifier {
+	var notifiers authentication.MultiNotifier
+
+	// emails are sent if there are administrators to send them to
+	if len(config.Emails) > 0 {
+		// reads the SMTP password from its environment variable or file
+		smtpPassword, err := config.SMTP.GetPassword()
+		if err != nil {
+			panic(fmt.Errorf("smtp: %s", err))
+		}
+		notifiers = append(notifiers, &authentication.EmailNotifier{
+			Emails: config.Emails,
+			SMTP: authentication.SMTPSettings{
+				Host:               config.SMTP.Host,
+				Port:               config.SMTP.Port,
+				Username:           config.SMTP.Username,
+				Password:           smtpPassword,
+				From:               config.SMTP.From,
+				TLSMode:            config.SMTP.GetTLSMode(),
+				CAFile:             config.SMTP.CAFile,
+				InsecureSkipVerify: config.SMTP.InsecureSkipVerify,
+			},
+		})
+	}
+
+	// every webhook gets its own notifier with its own signing secret
+	for _, webhook := range config.Webhooks {
+		secret, err := webhook.GetSecret()
+		if err != nil {
+			panic(fmt.Errorf("webhook %s: %s", webhook.URL, err))
+		}
+		notifiers = append(notifiers, &authentication.WebhookNotifier{
+			URL:    webhook.URL,
+			Secret: secret,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	if len(notifiers) == 0 {
+		return nil
 	}
+	return notifiers
 }
 
 // function used on the proxy server to begin listening
 func (p *ProxyServer) Listen() {
-	// in a goroutine it starts the MFA handler and starts the REST API listeners
+	// registers the proxy server's own API routes and then in a goroutine
+	// it starts the MFA handler and starts the REST API listeners
+	p.Auth.HandleApiFunc("/api/backends", authentication.ScopeReadLog, p.ViewBackends)
+	p.Auth.HandleApiFunc("/api/sessions", authentication.ScopeReadLog, p.ViewSessions)
+	p.Auth.HandleApiFunc("/api/connections", authentication.ScopeReadLog, p.ViewConnections)
+	p.Auth.HandleApiFunc("/api/connections/kill", authentication.ScopeKillSessions, p.HandleKillConnections)
+	p.Auth.HandleApiFunc("/api/whitelist", authentication.ScopeManageWhitelist, p.HandleWhitelist)
+	p.Auth.HandleApiFunc("/api/revoke", authentication.ScopeManageWhitelist, p.HandleRevoke)
 	go p.Auth.Start(p.APIAddress)
-	// creates a new TCP listener the proxy piping
-	listener, err := net.Listen("tcp", p.Address)
-	// if an error is returned, throw the error
-	if err != nil {
-		log.Fatalf("Error binding to address: %s\n", err)
+
+	// in a goroutine per certificate it reloads the certificate when its files change
+	for _, certificate := range p.certificates {
+		if certificate.Interval > 0 {
+			go certificate.Watch(certificate.Interval, p.done)
+		}
+	}
+
+	// in a goroutine it evicts expired whitelist grants in the background
+	go p.evictExpiredGrants()
+
+	// in a goroutine per route it health checks the route's backends
+	for i := range p.Routes {
+		go p.healthCheckLoop(&p.Routes[i])
+	}
+
+	// binds every listen address up front so a bad address halts the program
+	// before any connection is accepted, routes sharing an address are
+	// picked between by the server name their clients ask for
+	groups := p.listenGroups()
+	listeners := make([]net.Listener, len(groups))
+	for i, group := range groups {
+		listener, err := net.Listen("tcp", group.Address)
+		// if an error is returned, throw the error
+		if err != nil {
+			log.Fatalf("Error binding route %s to address: %s\n", group.Routes[0].Name, err)
+			return
+		}
+		for _, route := range group.Routes {
+			if group.SNI {
+				log.Printf("Route %s listening on %s for %s -> %s\n", route.Name, route.Address, route.describeServerNames(), route.Pool.Describe())
+			} else {
+				log.Printf("Route %s listening on %s -> %s\n", route.Name, route.Address, route.Pool.Describe())
+			}
+		}
+		listeners[i] = listener
+	}
+
+	// stores the listeners so Shutdown can close them, unless
+	// Shutdown was already called while they were being bound
+	p.connMutex.Lock()
+	if p.closed {
+		p.connMutex.Unlock()
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+		return
+	}
+	p.listeners = listeners
+	p.connMutex.Unlock()
+
+	// starts one accept loop per listener and blocks until they all end,
+	// which happens once Shutdown closes the listeners
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(group listenGroup, listener net.Listener) {
+			defer wg.Done()
+			if group.SNI {
+				p.acceptSNILoop(group.Routes, listener)
+			} else {
+				p.acceptLoop(group.Routes[0], listener)
+			}
+		}(group, listeners[i])
+	}
+	wg.Wait()
+}
+
+// stops the proxy server gracefully - it stops accepting connections, closes
+// the API, waits up to the DrainTimeout for live connections to finish and then
+// force-closes whatever is left, finally flushing the whitelist to disk
+func (p *ProxyServer) Shutdown() {
+	// marks the server as closed and takes the listeners to close
+	p.connMutex.Lock()
+	if p.closed {
+		p.connMutex.Unlock()
 		return
 	}
+	p.closed = true
+	listeners := p.listeners
+	p.connMutex.Unlock()
+
+	// stops the background goroutines and the accept loops
+	close(p.done)
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+
+	// the API and the live connections share the drain timeout
+	ctx, cancel := context.WithTimeout(context.Background(), p.DrainTimeout)
+	defer cancel()
+
+	if err := p.Auth.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down API: %s\n", err)
+	}
+
+	// waits for the live connections to finish in a goroutine
+	// so that the wait can be abandoned once the timeout passes
+	drained := make(chan struct{})
+	go func() {
+		p.connWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Printf("All connections finished\n")
+	case <-ctx.Done():
+		// force-closes every connection which is still alive
+		p.connMutex.Lock()
+		log.Printf("Drain timeout reached, closing %d remaining connections\n", len(p.Connections))
+		for _, connection := range p.Connections {
+			connection.Kill("shutdown")
+		}
+		p.connMutex.Unlock()
+		<-drained
+	}
+
+	// flushes the whitelist so nothing is lost on exit
+	if err := p.Auth.ProxyAuthHandler.Save(); err != nil {
+		log.Printf("Error saving whitelist: %s\n", err)
+	}
+	if err := p.Sessions.Close(); err != nil {
+		log.Printf("Error closing session history: %s\n", err)
+	}
+}
+
+// accepts incoming connections for a single route
+func (p *ProxyServer) acceptLoop(route *Route, listener net.Listener) {
+	p.serve(route.Name, listener, func(conn net.Conn) {
+		// the real client of a trusted load balancer is read first, as
+		// everything after is decided by the client's address
+		relayed, err := route.acceptProxyHeader(conn)
+		if err != nil {
+			log.Printf("[%s] Closing connection - %s\n", route.Name, err)
+			_ = conn.Close()
+			return
+		}
+		p.handleConnection(route, relayed)
+	})
+}
+
+// accepts incoming connections on a listener until it is closed,
+// handling each one in its own goroutine
+func (p *ProxyServer) serve(name string, listener net.Listener, handle func(conn net.Conn)) {
 	// in a while(true) loop
 	for {
 		// accept an incoming connection
 		incoming, err := listener.Accept()
 
+		// if the listener has been closed then stop accepting
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
 		// if an error is returned, do not throw the error, instead:
 		// print the error and continue the loop
 		if err != nil {
-			log.Printf("Error accepting user: %s\n", err)
+			log.Printf("Error accepting user on route %s: %s\n", name, err)
 			continue
 		}
 
+		// a connection accepted once Shutdown has begun is closed rather than
+		// counted, checking the closed flag under the same mutex Shutdown sets
+		// it with so that no connection is added after it starts waiting
+		p.connMutex.Lock()
+		if p.closed {
+			p.connMutex.Unlock()
+			_ = incoming.Close()
+			return
+		}
+
 		// in a goroutine handle the connection,
-		// this is so its not thread blocking other incoming connections
-		go p.handleConnection(incoming)
+		// this is so its not thread blocking other incoming connections,
+		// counting it so that Shutdown can wait for it to finish
+		p.connWG.Add(1)
+		p.connMutex.Unlock()
+		go func() {
+			defer p.connWG.Done()
+			handle(incoming)
+		}()
 	}
 }
 
+// returns whether or not an IP address is on this route's own whitelist
+func (r *Route) IsWhitelisted(ip string) bool {
+	return r.Whitelist != nil && r.Whitelist.Contains(ip)
+}
+
 // connection handler function which is called upon every connection to
 // the proxy server's TCP listener
-func (p *ProxyServer) handleConnection(conn net.Conn) {
+func (p *ProxyServer) handleConnection(route *Route, conn net.Conn) {
 	// gets the IP address of the incoming connection
 	ip := GetIP(conn)
 
-	// leverages the AuthHandler to determine whether or not this
-	// IP address is whitelisted
-	whitelisted := p.Auth.IsAuthenticated(ip)
+	// terminates TLS first if the route does, as a client certificate
+	// can let the client in without email MFA
+	accepted, certificate, err := route.acceptTLS(conn)
+	if err != nil {
+		log.Printf("[%s] Closing connection from %s - %s\n", route.Name, ip, err)
+		_ = conn.Close()
+		return
+	}
+	conn = accepted
+
+	// a verified client certificate identifies its user straight away
+	user := p.Auth.CertificateUser(certificate)
+	request := authentication.AuthRequest{
+		IP:       ip,
+		Route:    route.Name,
+		GrantTTL: route.GrantTTL,
+		User:     user,
+	}
+	if user != "" {
+		request.IdentifiedBy = authentication.IdentifiedByCertificate
+	}
+
+	// the route's own whitelist is checked first, then the client's certificate,
+	// otherwise we leverage the AuthHandler to determine whether or not this IP
+	// address is whitelisted - recording which let the connection in, as only
+	// a connection let in by the whitelist is killed once its entry is gone
+	admission := ""
+	switch {
+	case route.IsWhitelisted(ip):
+		admission = AdmittedByRouteWhitelist
+	case certificate != nil && route.ClientCertSkipsMFA && p.Auth.CertificateAllows(certificate, route.Name):
+		admission = AdmittedByCertificate
+	case p.Auth.IsAuthenticated(request):
+		admission = AdmittedByGrant
+	}
 
 	// if its not whitelisted, log this event and
 	// close the connection and return
-	if !whitelisted {
-		log.Printf("Connection dialed from %s - IP not authenticated!\n", ip)
+	if admission == "" {
+		log.Printf("[%s] Connection dialed from %s - IP not authenticated!\n", route.Name, authentication.DescribeClient(ip, user))
 		_ = conn.Close()
 		return
 	}
 
+	// a client without a certificate is the user its whitelist entry was granted to
+	if user == "" {
+		user, _ = p.Auth.WhitelistedUser(ip, route.Name)
+	}
+
 	// log the successful connection
-	log.Printf("Connection dialed from %s - IP authenticated!\n", ip)
+	log.Printf("[%s] Connection dialed from %s - IP authenticated!\n", route.Name, authentication.DescribeClient(ip, user))
 
-	// dial TCP to the target service of this proxy (used for piping)
-	redirect, err := net.Dial("tcp", p.Redirect)
-	// if an error is returned, throw the error
+	// dial TCP to a target service of this route (used for piping),
+	// balancing, falling back and retrying as the route allows
+	redirect, backend, err := p.dialBackend(route, ip, route.proxyHeader(conn))
+	// if no backend could be reached, log and count the failure and
+	// close the client's connection rather than halting the program
 	if err != nil {
-		panic(err)
+		atomic.AddUint64(&route.FailedConnections, 1)
+		log.Printf("[%s] Closing connection from %s - %s\n", route.Name, ip, err)
+		_ = conn.Close()
+		return
 	}
+	if backend.Fallback {
+		log.Printf("[%s] Connection from %s piped to fallback backend %s\n", route.Name, ip, backend.Address)
+	}
+
+	// counts the connection against the backend for the least-connections
+	// strategy until the pipe has been terminated
+	atomic.AddInt64(&backend.active, 1)
+	defer atomic.AddInt64(&backend.active, -1)
 
 	// instantiate a new connection pipe instance and pipe the incoming connection
 	// and the dialed TCP connection to the target service
 	connectionPipe := pipe.NewConnectionPipe(conn, redirect)
+	connectionPipe.BufferSize = p.BufferSize
+	connectionPipe.HalfCloseTimeout = p.HalfCloseTimeout
 
 	// updates the connection map with the network connection as the key
-	// and the connectionPipe as the value
-	p.Connections[conn] = connectionPipe
+	// and a record of the route, IP and connectionPipe as the value
+	connection := &Connection{
+		ID:        atomic.AddUint64(&p.lastConnectionID, 1),
+		Route:     route,
+		IP:        ip,
+		User:      user,
+		Admission: admission,
+		Backend:   backend,
+		Pipe:      &connectionPipe,
+	}
+	p.trackConnection(conn, connection)
 
 	// as the connectionPipe.Pipe() is thread blocking, we can defer
 	// the execution of deleting this from the map because we know that
 	// this host function will only end once the connection pipe has been terminated
 	// (it's quite smart really)
-	defer delete(p.Connections, conn)
+	defer p.untrackConnection(conn)
 
 	// using our connection pipe instance, we begin piping the connection
+	// and record the session once the pipe has been terminated
 	connectionPipe.Pipe()
+	p.recordSession(connection)
 }
 
 // function to get an IP address of an existing network connection
-// it takes the whole IP address and splits it at the colon and then returns the
-// LHS (left-hand side) of that statement - for example: 51.146.6.229:5274 -> 51.146.6.229
+// it splits the whole address into its host and port and returns the host,
+// this works for both IPv4 and IPv6 - for example: 51.146.6.229:5274 -> 51.146.6.229
+// and [2001:db8::1]:5274 -> 2001:db8::1
 func GetIP(conn net.Conn) string {
-	return strings.Split(conn.RemoteAddr().String(), ":")[0]
+	address := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		// the address has no port so it is returned as-is
+		return address
+	}
+	return host
 }
 
 func testConnectionPiping() {
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/config"
+	"github.com/saifsuleman/gatekeeper/history"
+	"github.com/saifsuleman/gatekeeper/ipset"
+	"github.com/saifsuleman/gatekeeper/logger"
+)
+
+// a notifier which counts the alerts it is given
+type countingNotifier struct {
+	mutex  sync.Mutex
+	alerts map[string]int
+}
+
+func (c *countingNotifier) Notify(alert authentication.Alert) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.alerts[alert.IP]++
+	return nil
+}
+
+// starts a backend which echoes everything written to it
+func startEchoBackend(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+// builds a proxy server with a single route to the backend, backed
+// by a whitelist file in a temporary directory
+func newTestProxyServer(t *testing.T, backend string) (*ProxyServer, *countingNotifier) {
+	dir := t.TempDir()
+
+	l := logger.InitializeLogger(filepath.Join(dir, "gatekeeper.log"))
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		_ = l.Close()
+	})
+
+	handler, err := authentication.NewProxyAuthHandler(filepath.Join(dir, "whitelist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := history.NewStore(filepath.Join(dir, "sessions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sessions.Close() })
+
+	notifier := &countingNotifier{alerts: map[string]int{}}
+	whitelist, _ := ipset.NewIPSet()
+	p := &ProxyServer{
+		Routes: []Route{{
+			Name:      "test",
+			Address:   "127.0.0.1:0",
+			Pool:      NewBackendPool(config.BalanceRoundRobin, []string{backend}, nil, 0, 1),
+			Whitelist: whitelist,
+			GrantTTL:  time.Hour,
+		}},
+		Connections: map[net.Conn]*Connection{},
+		Auth:        authentication.NewMFA(handler, l, nil, "http://127.0.0.1/api", notifier),
+		Sessions:    sessions,
+		done:        make(chan struct{}),
+	}
+	return p, notifier
+}
+
+// hammers connections, approvals, alerts, evictions and API reads at the
+// same time - run with `go test -race` to check the shared state is guarded
+func TestConcurrentStateAccess(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, notifier := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go p.acceptLoop(&p.Routes[0], listener)
+
+	const workers = 8
+	const iterations = 25
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(5)
+
+		// connects through the proxy and checks data makes it to the backend and back
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				payload := []byte("ping")
+				_, _ = conn.Write(payload)
+				buf := make([]byte, len(payload))
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					t.Errorf("echo through proxy failed: %s", err)
+				}
+				_ = conn.Close()
+			}
+		}()
+
+		// approves and denies codes through the HTTP handlers
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				ip := fmt.Sprintf("10.%d.0.%d", w, i)
+				code, err := p.Auth.GenerateCode(authentication.AuthRequest{IP: ip, Route: "test", GrantTTL: time.Hour})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				path := "/api/authenticate?code=" + code
+				handle := p.Auth.HandleAuthenticate
+				if i%3 == 0 {
+					path = "/api/deny?code=" + code
+					handle = p.Auth.HandleDeny
+				}
+				handle(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+		}(w)
+
+		// triggers alerts from the same set of IPs from every worker
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				p.Auth.IsAuthenticated(authentication.AuthRequest{IP: fmt.Sprintf("172.16.0.%d", i), Route: "test"})
+			}
+		}()
+
+		// reads the API at the same time
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				p.Auth.ViewLog(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/log", nil))
+				_ = p.Auth.ProxyAuthHandler.Entries()
+				p.Auth.IsBlocked("10.0.0.0")
+			}
+		}()
+
+		// runs the background maintenance at the same time
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, _ = p.Auth.ProxyAuthHandler.EvictExpired()
+				p.Auth.RemoveExpired()
+				p.killUnauthorizedConnections()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every IP should have exactly one pending code no matter
+	// how many workers tried to connect from it at once
+	pending := map[string]int{}
+	for _, request := range p.Auth.AuthCodes {
+		pending[request.IP]++
+	}
+	for i := 0; i < iterations; i++ {
+		ip := fmt.Sprintf("172.16.0.%d", i)
+		if pending[ip] != 1 {
+			t.Errorf("expected 1 pending code for %s, got %d", ip, pending[ip])
+		}
+	}
+
+	// the alerts are delivered in the background so wait for them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		notifier.mutex.Lock()
+		delivered := len(notifier.alerts)
+		notifier.mutex.Unlock()
+		if delivered == iterations || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	for ip, count := range notifier.alerts {
+		if count != 1 {
+			t.Errorf("expected 1 alert for %s, got %d", ip, count)
+		}
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+	p.DrainTimeout = 200 * time.Millisecond
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.listeners = []net.Listener{listener}
+	stopped := make(chan struct{})
+	go func() {
+		p.acceptLoop(&p.Routes[0], listener)
+		close(stopped)
+	}()
+
+	// opens a session which stays idle so it can only end by being force-closed
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	p.Shutdown()
+
+	if elapsed := time.Since(start); elapsed < p.DrainTimeout {
+		t.Errorf("shutdown returned after %s, before the drain timeout", elapsed)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("accept loop did not stop after shutdown")
+	}
+
+	// the idle session must have been closed by the proxy
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expected the session to be closed after the drain timeout")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+}
+
+func TestNoConnectionsAfterShutdown(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	p.Shutdown()
+
+	// a listener Shutdown did not close, standing in for a
+	// connection accepted just as the server was shutting down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stopped := make(chan struct{})
+	go func() {
+		p.acceptLoop(&p.Routes[0], listener)
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the connection is closed without being handled, and the loop stops
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("accept loop did not stop after shutdown")
+	}
+	if len(p.Connections) != 0 {
+		t.Errorf("expected no connections to be tracked, got %d", len(p.Connections))
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/history"
+	"github.com/saifsuleman/gatekeeper/pipe"
+)
+
+// the close reasons of a connection pipe in terms of the proxy,
+// whose pipes always have the client on the left and the backend on the right
+var closeReasons = map[string]string{
+	pipe.ReasonLeftClosed:  "client closed",
+	pipe.ReasonRightClosed: "backend closed",
+	pipe.ReasonLeftError:   "client error",
+	pipe.ReasonRightError:  "backend error",
+}
+
+// records a finished connection to the session history
+func (p *ProxyServer) recordSession(connection *Connection) {
+	started, ended := connection.Pipe.Times()
+	reason := connection.Pipe.Reason()
+	if described, has := closeReasons[reason]; has {
+		reason = described
+	}
+
+	session := history.Session{
+		ID:       connection.ID,
+		Route:    connection.Route.Name,
+		IP:       connection.IP,
+		User:     connection.User,
+		Backend:  connection.Backend.Address,
+		Start:    started,
+		End:      ended,
+		Duration: ended.Sub(started).Round(time.Second).String(),
+		BytesIn:  connection.Pipe.LeftToRight(),
+		BytesOut: connection.Pipe.RightToLeft(),
+		Reason:   reason,
+	}
+	if err := p.Sessions.Record(session); err != nil {
+		log.Printf("[%s] Error recording session of %s: %s\n", connection.Route.Name, authentication.DescribeClient(connection.IP, connection.User), err)
+	}
+}
+
+// handler function for our /api/sessions route which writes the recorded
+// sessions as JSON - the optional "ip" form value filters by an address or
+// CIDR block and "since" filters by when sessions ended, either as a time
+// such as 2021-06-01T00:00:00Z or as a duration before now such as 24h
+func (p *ProxyServer) ViewSessions(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if value := r.FormValue("since"); value != "" {
+		parsed, err := parseSince(value)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	sessions, err := p.Sessions.Query(r.FormValue("ip"), since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sessions)
+}
+
+// parses the since filter as an RFC 3339 time, or as a duration before now
+func parseSince(value string) (time.Time, error) {
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-duration), nil
+}
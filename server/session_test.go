@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/history"
+)
+
+func TestSessionRecordedWhenClientCloses(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go p.acceptLoop(&p.Routes[0], listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("hello, backend")
+	_, _ = conn.Write(payload)
+	if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// the session is recorded in the background once the pipe ends
+	var sessions []history.Session
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sessions) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		sessions, err = p.Sessions.Query("", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+
+	session := sessions[0]
+	if session.Route != "test" || session.IP != "127.0.0.1" || session.Backend != backend.Addr().String() {
+		t.Errorf("unexpected session %+v", session)
+	}
+	if session.BytesIn != uint64(len(payload)) || session.BytesOut != uint64(len(payload)) {
+		t.Errorf("expected %d bytes each way, got %d in and %d out", len(payload), session.BytesIn, session.BytesOut)
+	}
+	if session.Reason != "client closed" {
+		t.Errorf("expected reason client closed, got %q", session.Reason)
+	}
+	if session.Start.IsZero() || session.End.Before(session.Start) {
+		t.Errorf("invalid session times %s - %s", session.Start, session.End)
+	}
+
+	// the API filters sessions by IP address and by when they ended
+	for query, expected := range map[string]int{
+		"":                           1,
+		"ip=127.0.0.0/8":             1,
+		"ip=10.0.0.1":                0,
+		"since=1h":                   1,
+		"since=2999-01-01T00:00:00Z": 0,
+	} {
+		recorder := httptest.NewRecorder()
+		p.ViewSessions(recorder, httptest.NewRequest("GET", "/api/sessions?"+query, nil))
+		var found []history.Session
+		if err := json.NewDecoder(recorder.Body).Decode(&found); err != nil {
+			t.Fatalf("%q: %s", query, err)
+		}
+		if len(found) != expected {
+			t.Errorf("%q: expected %d sessions, got %d", query, expected, len(found))
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	p.ViewSessions(recorder, httptest.NewRequest("GET", "/api/sessions?since=yesterday", nil))
+	if recorder.Code != 400 {
+		t.Errorf("expected 400 for an invalid since, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// the routes sharing a listen address
+type listenGroup struct {
+	Address string   // the address the routes listen on
+	Routes  []*Route // the routes listening on the address, in the order they were configured
+	SNI     bool     // whether or not the route is picked by the server name clients ask for
+}
+
+// groups the routes by their listen address, keeping the order
+// the addresses were first configured in
+func (p *ProxyServer) listenGroups() []listenGroup {
+	var groups []listenGroup
+	indexes := map[string]int{}
+	for i := range p.Routes {
+		route := &p.Routes[i]
+		index, has := indexes[route.Address]
+		if !has {
+			index = len(groups)
+			indexes[route.Address] = index
+			groups = append(groups, listenGroup{Address: route.Address})
+		}
+		groups[index].Routes = append(groups[index].Routes, route)
+		if len(route.ServerNames) > 0 || route.SNIDefault {
+			groups[index].SNI = true
+		}
+	}
+	return groups
+}
+
+// accepts incoming connections for routes sharing a listener, handing each
+// one to the route serving the server name in its TLS ClientHello
+func (p *ProxyServer) acceptSNILoop(routes []*Route, listener net.Listener) {
+	p.serve(listener.Addr().String(), listener, func(conn net.Conn) {
+		// the routes sharing a listener trust the same upstreams, and the
+		// PROXY header comes before the ClientHello
+		relayed, err := routes[0].acceptProxyHeader(conn)
+		if err != nil {
+			log.Printf("Closing connection on %s - %s\n", listener.Addr(), err)
+			_ = conn.Close()
+			return
+		}
+		p.handleSNIConnection(routes, relayed)
+	})
+}
+
+// reads the server name a client asks for without terminating TLS, then
+// hands the connection to the matching route with the read bytes replayed
+func (p *ProxyServer) handleSNIConnection(routes []*Route, conn net.Conn) {
+	ip := GetIP(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Closing connection from %s on %s - %s\n", ip, conn.LocalAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	route := matchServerName(routes, serverName)
+	if route == nil {
+		log.Printf("Closing connection from %s on %s - no route serves %q\n", ip, conn.LocalAddr(), serverName)
+		_ = conn.Close()
+		return
+	}
+
+	p.handleConnection(route, &peekedConn{Conn: conn, peeked: peeked})
+}
+
+// returns the route serving a server name - exact names are preferred over
+// wildcards, and the default route serves names no other route does
+func matchServerName(routes []*Route, serverName string) *Route {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	var wildcard, fallback *Route
+	for _, route := range routes {
+		for _, name := range route.ServerNames {
+			name = strings.ToLower(name)
+			if name == serverName {
+				return route
+			}
+			// a wildcard matches exactly one label, e.g. *.example.com
+			// matches rdp.example.com but not a.rdp.example.com
+			if wildcard == nil && strings.HasPrefix(name, "*.") {
+				if dot := strings.IndexByte(serverName, '.'); dot > 0 && serverName[dot:] == name[1:] {
+					wildcard = route
+				}
+			}
+		}
+		if route.SNIDefault && fallback == nil {
+			fallback = route
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallback
+}
+
+// describes the server names of a route for the logs
+func (r *Route) describeServerNames() string {
+	names := strings.Join(r.ServerNames, ", ")
+	if r.SNIDefault {
+		if names == "" {
+			return "any other server name"
+		}
+		names += " and any other server name"
+	}
+	return names
+}
+
+// returned by the ClientHello callback to stop the handshake once the
+// server name has been read
+var errHelloRead = errors.New("client hello read")
+
+// reads the TLS ClientHello from a connection and returns the server name
+// it asks for, which is empty if it asks for none, along with every byte that
+// was read so that they can be replayed to whoever handles the connection
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	var read bool
+
+	// the crypto/tls parser reads the ClientHello, and the handshake is
+	// aborted from the callback before anything is written back
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			read = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if !read {
+		return "", nil, errors.New("not a TLS ClientHello: " + err.Error())
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// a connection which can only be read from, used to parse a ClientHello
+// without anything being sent back to the client
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)       { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// a connection whose first bytes have already been read, which
+// replays them before reading anything more from the connection
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// half-closes the underlying connection so that the pipe can still
+// half-close connections whose bytes were peeked
+func (c *peekedConn) CloseWrite() error {
+	if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return errors.New("connection does not support half-closing")
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/config"
+	"github.com/saifsuleman/gatekeeper/ipset"
+)
+
+// starts a TLS backend which answers every connection with its name
+func startNamedTLSBackend(t *testing.T, certificate tls.Certificate, name string) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = conn.Write([]byte(name))
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener.Addr().String()
+}
+
+// dials the proxy asking for a server name and returns what the backend answered
+func dialServerName(t *testing.T, address string, serverName string) (string, error) {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", address, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	answer, err := ioutil.ReadAll(conn)
+	return string(answer), err
+}
+
+func TestSNIRouting(t *testing.T) {
+	ca := newTestCA(t)
+	certificate := ca.issue(t, false)
+	p, _ := newTestProxyServer(t, startNamedTLSBackend(t, certificate, "app"))
+
+	whitelist, _ := ipset.NewIPSet("127.0.0.1")
+	p.Routes[0].Name = "app"
+	p.Routes[0].ServerNames = []string{"app.example.com"}
+	p.Routes[0].Whitelist = whitelist
+	p.Routes = append(p.Routes, Route{
+		Name:        "wildcard",
+		Address:     p.Routes[0].Address,
+		Pool:        NewBackendPool(config.BalanceRoundRobin, []string{startNamedTLSBackend(t, certificate, "wildcard")}, nil, 0, 1),
+		Whitelist:   whitelist,
+		GrantTTL:    time.Hour,
+		ServerNames: []string{"*.example.com"},
+	}, Route{
+		Name:       "default",
+		Address:    p.Routes[0].Address,
+		Pool:       NewBackendPool(config.BalanceRoundRobin, []string{startNamedTLSBackend(t, certificate, "default")}, nil, 0, 1),
+		Whitelist:  whitelist,
+		GrantTTL:   time.Hour,
+		SNIDefault: true,
+	}, Route{
+		Name:        "locked",
+		Address:     p.Routes[0].Address,
+		Pool:        NewBackendPool(config.BalanceRoundRobin, []string{startNamedTLSBackend(t, certificate, "locked")}, nil, 0, 1),
+		GrantTTL:    time.Hour,
+		ServerNames: []string{"locked.example.com"},
+	})
+
+	groups := p.listenGroups()
+	if len(groups) != 1 || !groups[0].SNI || len(groups[0].Routes) != 4 {
+		t.Fatalf("expected the routes to share one SNI listener, got %+v", groups)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go p.acceptSNILoop(groups[0].Routes, listener)
+	address := listener.Addr().String()
+
+	for serverName, expected := range map[string]string{
+		"app.example.com":   "app",
+		"APP.example.com":   "app",
+		"rdp.example.com":   "wildcard",
+		"a.b.example.com":   "default",
+		"other.example.org": "default",
+	} {
+		answer, err := dialServerName(t, address, serverName)
+		if err != nil {
+			t.Errorf("%s: %s", serverName, err)
+		} else if answer != expected {
+			t.Errorf("%s: expected route %s, got %s", serverName, expected, answer)
+		}
+	}
+
+	// the route's own whitelist applies, so a client which is not on it is
+	// sent to MFA instead of reaching the backend
+	if answer, err := dialServerName(t, address, "locked.example.com"); err == nil && answer != "" {
+		t.Errorf("expected a client outside the locked route's whitelist to be turned away, got %s", answer)
+	}
+
+	// a client which does not speak TLS is closed without reaching a backend
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	expectClosed(t, conn)
+}
+
+func TestSNIWithoutDefaultRejectsUnknownNames(t *testing.T) {
+	ca := newTestCA(t)
+	p, _ := newTestProxyServer(t, startNamedTLSBackend(t, ca.issue(t, false), "app"))
+	whitelist, _ := ipset.NewIPSet("127.0.0.1")
+	p.Routes[0].ServerNames = []string{"app.example.com"}
+	p.Routes[0].Whitelist = whitelist
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go p.acceptSNILoop([]*Route{&p.Routes[0]}, listener)
+
+	if answer, err := dialServerName(t, listener.Addr().String(), "app.example.com"); err != nil || answer != "app" {
+		t.Fatalf("expected app.example.com to reach its route, got %q (%v)", answer, err)
+	}
+	if _, err := dialServerName(t, listener.Addr().String(), "other.example.com"); err == nil {
+		t.Error("expected a server name no route serves to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/certs"
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// how long a client or backend has to complete a TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// builds the TLS configs of a route from its configuration - the server
+// config is nil if TLS is not terminated on the route and the backend
+// config is nil if connections to the backends are not re-encrypted
+func newRouteTLS(r config.RouteConfig) (*tls.Config, *certs.Reloader, *tls.Config, error) {
+	var serverConfig *tls.Config
+	var reloader *certs.Reloader
+	if r.TLS.Enabled() {
+		var err error
+		reloader, err = certs.NewReloader(r.TLS.CertFile, r.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		serverConfig = reloader.TLSConfig()
+
+		// client certificates are asked for if there are CAs to verify them
+		// with, and only required if the route says so
+		if r.TLS.ClientCAFile != "" {
+			pool, err := certs.LoadCertPool(r.TLS.ClientCAFile)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			serverConfig.ClientCAs = pool
+			serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if r.TLS.RequireClientCert {
+				serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+	}
+
+	var backendConfig *tls.Config
+	if r.TLS.Backend.Enabled {
+		backendConfig = &tls.Config{
+			ServerName:         r.TLS.Backend.ServerName,
+			InsecureSkipVerify: r.TLS.Backend.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		}
+		if r.TLS.Backend.CAFile != "" {
+			pool, err := certs.LoadCertPool(r.TLS.Backend.CAFile)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			backendConfig.RootCAs = pool
+		}
+	}
+
+	return serverConfig, reloader, backendConfig, nil
+}
+
+// terminates TLS on a client's connection if the route does, returning the
+// connection to pipe and the certificate the client presented if it was
+// verified against the route's client CAs, otherwise nil
+func (r *Route) acceptTLS(conn net.Conn) (net.Conn, *x509.Certificate, error) {
+	if r.TLS == nil {
+		return conn, nil, nil
+	}
+
+	tlsConn := tls.Server(conn, r.TLS)
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	// the verified chains are only set once a certificate passed verification
+	if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+		return tlsConn, chains[0][0], nil
+	}
+	return tlsConn, nil, nil
+}
+
+// re-encrypts a connection to a backend if the route does, verifying the
+// backend's certificate against its host unless a server name is configured
+func (r *Route) dialTLS(conn net.Conn, address string) (net.Conn, error) {
+	if r.BackendTLS == nil {
+		return conn, nil
+	}
+
+	config := r.BackendTLS
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(r.Dial.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
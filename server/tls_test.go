@@ -0,0 +1,319 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/certs"
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// a certificate authority which issues certificates for tests
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &testCA{certificate: certificate, key: key, pool: pool}
+}
+
+// issues a server certificate for 127.0.0.1, or a client certificate
+func (ca *testCA) issue(t *testing.T, client bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// starts the proxy server's single route on a new listener
+func startTestRoute(t *testing.T, p *ProxyServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go p.acceptLoop(&p.Routes[0], listener)
+	return listener.Addr().String()
+}
+
+// checks that data written to a connection is echoed back
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("echo through proxy failed: %s", err)
+	}
+}
+
+func TestClientCertificateSkipsMFA(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, notifier := newTestProxyServer(t, backend.Addr().String())
+
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, false)
+	p.Routes[0].TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	p.Routes[0].ClientCertSkipsMFA = true
+	address := startTestRoute(t, p)
+
+	// a client with a certificate from the CA is let straight in
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, true)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	// a client without one goes through email MFA and is turned away
+	conn, err = tls.Dial("tcp", address, &tls.Config{RootCAs: ca.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected a client without a certificate to be closed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		notifier.mutex.Lock()
+		alerts := notifier.alerts["127.0.0.1"]
+		notifier.mutex.Unlock()
+		if alerts == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected an alert for the client without a certificate only")
+}
+
+func TestExpiredGrantLeavesCertificateConnections(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	ca := newTestCA(t)
+	p.Routes[0].TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, false)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	p.Routes[0].ClientCertSkipsMFA = true
+	address := startTestRoute(t, p)
+	if err := p.Auth.ProxyAuthHandler.GrantWhitelistIP("127.0.0.1", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// one client is let in by its certificate and the other by the grant
+	withCert, err := tls.Dial("tcp", address, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.issue(t, true)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withCert.Close()
+	expectEcho(t, withCert)
+	withGrant, err := tls.Dial("tcp", address, &tls.Config{RootCAs: ca.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withGrant.Close()
+	expectEcho(t, withGrant)
+
+	// once the grant expires only the connection it let in is killed
+	time.Sleep(150 * time.Millisecond)
+	if _, err := p.Auth.ProxyAuthHandler.EvictExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if killed := p.killUnauthorizedConnections(); killed != 1 {
+		t.Errorf("expected only the connection let in by the grant to be killed, got %d", killed)
+	}
+	expectClosed(t, withGrant)
+	expectEcho(t, withCert)
+}
+
+func TestBackendReencryption(t *testing.T) {
+	ca := newTestCA(t)
+
+	// starts a TLS echo backend with a certificate from the CA
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{ca.issue(t, false)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// starts a route to the backend which verifies it against a pool
+	startRoute := func(pool *x509.CertPool) string {
+		p, _ := newTestProxyServer(t, listener.Addr().String())
+		if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		p.Routes[0].Dial.Timeout = time.Second
+		p.Routes[0].BackendTLS = &tls.Config{RootCAs: pool}
+		return startTestRoute(t, p)
+	}
+
+	conn, err := net.Dial("tcp", startRoute(ca.pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	// a backend whose certificate cannot be verified is not piped to
+	conn, err = net.Dial("tcp", startRoute(x509.NewCertPool()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the client to be closed when the backend cannot be verified")
+	}
+}
+
+func TestRouteTLSFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "route.crt"), filepath.Join(dir, "route.key")
+	if err := certs.GenerateSelfSigned(certFile, keyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	serverTLS, reloader, backendTLS, err := newRouteTLS(config.RouteConfig{
+		Name: "rdp",
+		TLS: config.RouteTLSConfig{
+			CertFile:          certFile,
+			KeyFile:           keyFile,
+			ClientCAFile:      certFile,
+			RequireClientCert: true,
+			Backend:           config.BackendTLSConfig{Enabled: true, ServerName: "rdp.internal"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverTLS == nil || reloader == nil || serverTLS.ClientAuth != tls.RequireAndVerifyClientCert || serverTLS.ClientCAs == nil {
+		t.Errorf("unexpected server TLS config %+v", serverTLS)
+	}
+	if backendTLS == nil || backendTLS.ServerName != "rdp.internal" {
+		t.Errorf("unexpected backend TLS config %+v", backendTLS)
+	}
+
+	if _, _, _, err := newRouteTLS(config.RouteConfig{TLS: config.RouteTLSConfig{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile}}); err == nil {
+		t.Error("expected a missing certificate to be an error")
+	}
+}
+
+func TestClientCertificateIdentifiesUser(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	// the client certificates issued for tests have the common name 127.0.0.1
+	users := filepath.Join(t.TempDir(), "users.json")
+	if err := authentication.SaveUsers(users, []authentication.User{{Name: "127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := authentication.NewUserRegistry(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Auth.Users = registry
+
+	ca := newTestCA(t)
+	p.Routes[0].TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, false)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	p.Routes[0].ClientCertSkipsMFA = true
+	address := startTestRoute(t, p)
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, true)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	for _, connection := range p.Connections {
+		if connection.User != "127.0.0.1" {
+			t.Errorf("expected the connection to be recorded as the certificate's user, got %q", connection.User)
+		}
+		return
+	}
+	t.Error("expected the connection to be recorded")
+}
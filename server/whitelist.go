@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/ipset"
+)
+
+// handler function for our /api/whitelist route - GET lists the whitelist,
+// POST adds an entry and DELETE removes one, all changes take effect straight away
+func (p *ProxyServer) HandleWhitelist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p.viewWhitelist(w, r)
+	case http.MethodPost:
+		p.addWhitelist(w, r)
+	case http.MethodDelete:
+		p.removeWhitelist(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writes every whitelist entry and its metadata as JSON
+func (p *ProxyServer) viewWhitelist(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.Auth.ProxyAuthHandler.Entries())
+}
+
+// adds the "ip" form value, which may be a CIDR block, to the whitelist - the
+// optional "ttl" form value limits how long it lasts, "reason" records why it
+// was added and "user" grants it to a registered user, while who added it is
+// always the caller's token or address so callers cannot name someone else
+func (p *ProxyServer) addWhitelist(w http.ResponseWriter, r *http.Request) {
+	entry := authentication.WhitelistEntry{
+		Address: r.FormValue("ip"),
+		AddedBy: p.Auth.ApiCaller(r),
+		Reason:  r.FormValue("reason"),
+		User:    r.FormValue("user"),
+	}
+	if entry.User != "" && p.Auth.Users != nil {
+		if _, registered := p.Auth.Users.Get(entry.User); !registered {
+			http.Error(w, "unknown user", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("ttl"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		if ttl > 0 {
+			expires := time.Now().Add(ttl)
+			entry.Expires = &expires
+		}
+	}
+
+	added, err := p.Auth.ProxyAuthHandler.AddWhitelistEntry(entry)
+	if errors.Is(err, authentication.ErrAlreadyWhitelisted) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Whitelist entry %s added by %s\n", authentication.DescribeClient(added.Address, added.User), added.AddedBy)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(added)
+}
+
+// removes the "ip" form value from the whitelist, killing the live
+// connections it allowed if the "kill" form value is true
+func (p *ProxyServer) removeWhitelist(w http.ResponseWriter, r *http.Request) {
+	kill := false
+	if value := r.FormValue("kill"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "invalid kill", http.StatusBadRequest)
+			return
+		}
+		kill = parsed
+	}
+
+	ip := r.FormValue("ip")
+	killed, err := p.RevokeWhitelistIP(ip, kill)
+	if errors.Is(err, authentication.ErrNotWhitelisted) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Whitelist entry %s removed, %d live connections killed\n", ip, len(killed))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]uint64{"killed": killed})
+}
+
+// handler function for our /api/revoke route, kept as an alias of DELETE on
+// /api/whitelist which removes the "ip" form value from the whitelist,
+// killing the live connections it allowed if "kill" is true
+func (p *ProxyServer) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.removeWhitelist(w, r)
+}
+
+// revokes a whitelist entry - if kill is set, every live connection the entry
+// allowed which is no longer allowed by anything else is killed as well,
+// returning the IDs of the connections killed
+func (p *ProxyServer) RevokeWhitelistIP(ip string, kill bool) ([]uint64, error) {
+	network, err := ipset.ParseEntry(ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Auth.ProxyAuthHandler.RemoveWhitelistIP(ip); err != nil {
+		return nil, err
+	}
+	if !kill {
+		return []uint64{}, nil
+	}
+	return p.killConnections("whitelist entry revoked", func(connection *Connection) bool {
+		return network.Contains(net.ParseIP(connection.IP)) && !p.isAllowed(connection)
+	}), nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+)
+
+func TestWhitelistAPI(t *testing.T) {
+	p, _ := newTestProxyServer(t, "127.0.0.1:1")
+
+	// adds an entry with metadata and an expiry, recording the
+	// caller as who added it whoever the caller claims to be
+	form := url.Values{"ip": {"192.0.2.0/24"}, "ttl": {"1h"}, "reason": {"office network"}, "by": {"alice"}}
+	request := httptest.NewRequest("POST", "/api/whitelist", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	p.HandleWhitelist(recorder, request)
+	if recorder.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if !p.Auth.ProxyAuthHandler.IsWhitelisted("192.0.2.7") {
+		t.Error("expected the added entry to take effect straight away")
+	}
+
+	// adding the same entry again is a conflict
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("POST", "/api/whitelist?ip=192.0.2.0/24", nil))
+	if recorder.Code != 409 {
+		t.Errorf("expected 409 for a duplicate entry, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("POST", "/api/whitelist?ip=not-an-ip", nil))
+	if recorder.Code != 400 {
+		t.Errorf("expected 400 for an invalid entry, got %d", recorder.Code)
+	}
+
+	// adds a permanent entry without any metadata
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("POST", "/api/whitelist?ip=2001:db8::1", nil))
+	if recorder.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("GET", "/api/whitelist", nil))
+	var entries []authentication.WhitelistEntry
+	if err := json.NewDecoder(recorder.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	office := entries[0]
+	if office.Address != "192.0.2.0/24" || office.AddedBy != "api (192.0.2.1)" || office.Reason != "office network" {
+		t.Errorf("unexpected entry %+v", office)
+	}
+	if office.Added == nil || office.Expires == nil || office.Expires.Sub(*office.Added) < 59*time.Minute {
+		t.Errorf("expected an added time and an expiry an hour later, got %+v", office)
+	}
+	if entries[1].AddedBy != "api (192.0.2.1)" {
+		t.Errorf("expected the caller's address to be recorded, got %q", entries[1].AddedBy)
+	}
+
+	// removes an entry, then removing it again is not found
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("DELETE", "/api/whitelist?ip=192.0.2.0/24", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if p.Auth.ProxyAuthHandler.IsWhitelisted("192.0.2.7") {
+		t.Error("expected the removed entry to take effect straight away")
+	}
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("DELETE", "/api/whitelist?ip=192.0.2.0/24", nil))
+	if recorder.Code != 404 {
+		t.Errorf("expected 404 for a missing entry, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("PUT", "/api/whitelist", nil))
+	if recorder.Code != 405 {
+		t.Errorf("expected 405 for PUT, got %d", recorder.Code)
+	}
+}
+
+func TestRemoveWhitelistKillsLiveConnections(t *testing.T) {
+	backend := startEchoBackend(t)
+	p, _ := newTestProxyServer(t, backend.Addr().String())
+
+	if err := p.Auth.ProxyAuthHandler.AddWhitelistIP("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go p.acceptLoop(&p.Routes[0], listener)
+
+	conn := dialThroughProxy(t, listener.Addr().String())
+
+	recorder := httptest.NewRecorder()
+	p.HandleWhitelist(recorder, httptest.NewRequest("DELETE", "/api/whitelist?ip=127.0.0.1&kill=true", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	expectClosed(t, conn)
+
+	// the session records why it ended
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sessions, err := p.Sessions.Query("127.0.0.1", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) == 1 {
+			if sessions[0].Reason != "whitelist entry revoked" {
+				t.Errorf("unexpected session reason %q", sessions[0].Reason)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the killed session to be recorded")
+}
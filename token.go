@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/config"
+)
+
+// the usage of the token command
+const tokenUsage = `usage:
+  gatekeeper token create -name <name> -scopes <scope>[,<scope>...]
+  gatekeeper token list
+  gatekeeper token revoke -name <name>
+
+scopes: %s
+`
+
+// runs the token command which manages the API tokens in the token
+// file, returning the exit code of the program
+func runTokenCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, tokenUsage, strings.Join(authentication.Scopes, ", "))
+		return 2
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	name := flags.String("name", "", "the name of the token")
+	scopes := flags.String("scopes", "", "a comma separated list of scopes to grant")
+	file := flags.String("file", "", "the token file, defaults to the apiTokensPath of config.json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// the token file defaults to the one the proxy server loads
+	if *file == "" {
+		appConfig, err := config.NewApplicationConfig("config.json")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+			return 1
+		}
+		*file = appConfig.GetApiTokensPath()
+	}
+
+	tokens, err := authentication.LoadAPITokens(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading tokens: %s\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		if *name == "" || *scopes == "" {
+			fmt.Fprintf(os.Stderr, "a -name and -scopes are required\n")
+			return 2
+		}
+		for _, token := range tokens {
+			if token.Name == *name {
+				fmt.Fprintf(os.Stderr, "a token named %s already exists\n", *name)
+				return 1
+			}
+		}
+		token, apiToken, err := authentication.GenerateAPIToken(*name, strings.Split(*scopes, ","))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating token: %s\n", err)
+			return 1
+		}
+		if err := authentication.SaveAPITokens(*file, append(tokens, apiToken)); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving tokens: %s\n", err)
+			return 1
+		}
+		// the token is only ever shown here as only its hash is kept
+		fmt.Printf("Created token %s with scopes %s, restart gatekeeper to use it:\n%s\n", *name, *scopes, token)
+	case "list":
+		for _, token := range tokens {
+			fmt.Printf("%s\t%s\n", token.Name, strings.Join(token.Scopes, ","))
+		}
+	case "revoke":
+		kept := tokens[:0]
+		for _, token := range tokens {
+			if token.Name != *name {
+				kept = append(kept, token)
+			}
+		}
+		if len(kept) == len(tokens) {
+			fmt.Fprintf(os.Stderr, "no token named %s\n", *name)
+			return 1
+		}
+		if err := authentication.SaveAPITokens(*file, kept); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving tokens: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Revoked token %s, restart gatekeeper for it to take effect\n", *name)
+	default:
+		fmt.Fprintf(os.Stderr, tokenUsage, strings.Join(authentication.Scopes, ", "))
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/saifsuleman/gatekeeper/authentication"
+	"github.com/saifsuleman/gatekeeper/config"
+	"github.com/saifsuleman/gatekeeper/qrcode"
+)
+
+// the usage of the user command
+const userUsage = `usage:
+  gatekeeper user add -name <name> [-email <email>] [-routes <route>[,<route>...]] [-mfa <method>[,<method>...]]
+  gatekeeper user list
+  gatekeeper user totp -name <name>
+  gatekeeper user remove -name <name>
+
+mfa methods: %s - every method is allowed if none are given,
+and adding a user allowed to use totp enrolls them straight away if totp is enabled
+`
+
+// runs the user command which manages the registered users in the
+// users file, returning the exit code of the program
+func runUserCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, userUsage, strings.Join(authentication.MFAMethods, ", "))
+		return 2
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	name := flags.String("name", "", "the name of the user")
+	email := flags.String("email", "", "the email address of the user")
+	routes := flags.String("routes", "", "a comma separated list of the routes the user may use, every route if empty")
+	methods := flags.String("mfa", "", "a comma separated list of the methods the user may authorize with, every method if empty")
+	file := flags.String("file", "", "the users file, defaults to the usersPath of config.json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// the users file and issuer default to the ones the proxy server uses
+	appConfig, err := config.NewApplicationConfig("config.json")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+		return 1
+	}
+	if *file == "" {
+		*file = appConfig.GetUsersPath()
+	}
+
+	users, err := authentication.LoadUsers(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading users: %s\n", err)
+		return 1
+	}
+	index := -1
+	for i, user := range users {
+		if user.Name == *name {
+			index = i
+		}
+	}
+
+	switch args[0] {
+	case "add":
+		if *name == "" {
+			fmt.Fprintf(os.Stderr, "a -name is required\n")
+			return 2
+		}
+		if index > -1 {
+			fmt.Fprintf(os.Stderr, "a user named %s already exists\n", *name)
+			return 1
+		}
+		user := authentication.User{Name: *name, Email: *email, Created: time.Now()}
+		if *routes != "" {
+			user.Routes = strings.Split(*routes, ",")
+		}
+		if *methods != "" {
+			user.MFA = strings.Split(*methods, ",")
+		}
+		if err := authentication.ValidateUser(user); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		// users who may use totp are enrolled as they are added if it is enabled
+		enroll := len(user.MFA) == 0
+		for _, method := range user.MFA {
+			enroll = enroll || method == authentication.MFATOTP
+		}
+		if enroll && appConfig.TOTP.Enabled {
+			if user.TOTPSecret, err = authentication.GenerateTOTPSecret(); err != nil {
+				fmt.Fprintf(os.Stderr, "error enrolling user: %s\n", err)
+				return 1
+			}
+		}
+		if err := authentication.SaveUsers(*file, append(users, user)); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving users: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Added user %s\n", *name)
+		printEnrollment(appConfig, user)
+	case "list":
+		for _, user := range users {
+			routes, methods := strings.Join(user.Routes, ","), strings.Join(user.MFA, ",")
+			if routes == "" {
+				routes = "all routes"
+			}
+			if methods == "" {
+				methods = "all methods"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\ttotp enrolled: %t\n", user.Name, user.Email, routes, methods, user.TOTPSecret != "")
+		}
+	case "totp":
+		if index == -1 {
+			fmt.Fprintf(os.Stderr, "no user named %s\n", *name)
+			return 1
+		}
+		// a new secret replaces any earlier one, so a lost phone can be re-enrolled
+		if users[index].TOTPSecret, err = authentication.GenerateTOTPSecret(); err != nil {
+			fmt.Fprintf(os.Stderr, "error enrolling user: %s\n", err)
+			return 1
+		}
+		if err := authentication.SaveUsers(*file, users); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving users: %s\n", err)
+			return 1
+		}
+		printEnrollment(appConfig, users[index])
+	case "remove":
+		if index == -1 {
+			fmt.Fprintf(os.Stderr, "no user named %s\n", *name)
+			return 1
+		}
+		if err := authentication.SaveUsers(*file, append(users[:index], users[index+1:]...)); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving users: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Removed %s, their whitelist grants no longer let them in\n", *name)
+	default:
+		fmt.Fprintf(os.Stderr, userUsage, strings.Join(authentication.MFAMethods, ", "))
+		return 2
+	}
+	return 0
+}
+
+// prints the otpauth URI of a user enrolled for TOTP codes, along with
+// it as a QR code for their authenticator app to scan
+func printEnrollment(appConfig config.ApplicationConfig, user authentication.User) {
+	if user.TOTPSecret == "" {
+		return
+	}
+	// the URI holds the secret, so it should only be handed to the user
+	uri := authentication.TOTPURI(appConfig.TOTP.GetIssuer(), user.Name, user.TOTPSecret)
+	fmt.Printf("Scan this QR code with %s's authenticator app, or add the URI below to it:\n", user.Name)
+	if code, err := qrcode.Encode(uri); err == nil {
+		fmt.Print(code.Terminal())
+	} else {
+		fmt.Fprintf(os.Stderr, "error drawing QR code: %s\n", err)
+	}
+	fmt.Println(uri)
+}